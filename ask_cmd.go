@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/everestmz/sage/docstate"
+	"github.com/everestmz/sage/rpc/client"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"go.lsp.dev/protocol"
+	"go.lsp.dev/uri"
+)
+
+// How long to wait for a running language server to tell us its open documents
+const stateServerTimeout = time.Second
+
+func init() {
+	flags := AskCmd.PersistentFlags()
+	flags.StringP("model", "m", "", "The model to ask, instead of the default from models.yaml")
+	flags.Bool("no-context", false, "Don't send the context from context.txt, open documents or recent edits")
+	flags.Bool("json", false, "Print the answer as a JSON object once it's finished, instead of streaming it")
+}
+
+// AskResult is what --json prints
+type AskResult struct {
+	Model    string `json:"model"`
+	Question string `json:"question"`
+	Answer   string `json:"answer"`
+	// Whether the open documents came from a running language server
+	LanguageServer bool `json:"language_server"`
+}
+
+var AskCmd = &cobra.Command{
+	Use:     "ask [question]",
+	Short:   "Ask a question within the context of the working directory",
+	Long:    "Adds the question from the arguments or stdin to the workspace's chat, and streams the model's answer. With no question, the chat is sent as it is, so you can write your question in the chat file instead. If the language server is running, what's open in the editor is used too.",
+	Aliases: []string{"c", "complete"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := cmd.Flags()
+
+		model, err := flags.GetString("model")
+		if err != nil {
+			return err
+		}
+
+		noContext, err := flags.GetBool("no-context")
+		if err != nil {
+			return err
+		}
+
+		jsonOutput, err := flags.GetBool("json")
+		if err != nil {
+			return err
+		}
+
+		var question string
+		if len(args) > 0 {
+			question = strings.Join(args, " ")
+		} else {
+			input, err := io.ReadAll(os.Stdin)
+			if err != nil {
+				return err
+			}
+
+			question = string(input)
+		}
+		question = strings.TrimSpace(question)
+
+		wd, err := os.Getwd()
+		if err != nil {
+			panic(err)
+		}
+
+		config, err := getConfigForWd()
+		if err != nil {
+			return err
+		}
+
+		if model == "" {
+			models, err := config.Models.Get()
+			if err != nil {
+				return err
+			}
+
+			model = *models.Default
+		}
+
+		llm, err := NewLLMClient()
+		if err != nil {
+			return err
+		}
+
+		chatPath := getWorkspaceChatPath()
+		transcript, err := readChatFile(chatPath)
+		if err != nil {
+			return err
+		}
+
+		if question != "" {
+			transcript = addChatMessage(transcript, question)
+		}
+
+		var contextApi ContextApi
+		var openDocs map[uri.URI]docstate.OpenDocument
+		languageServer := false
+		if !noContext {
+			db, err := openDB(wd)
+			if err != nil {
+				return err
+			}
+
+			// Without a language server, everything comes from disk and the index
+			openDocs, err = getServerOpenDocuments(wd)
+			if err != nil {
+				log.Debug().Err(err).Msg("Couldn't get open documents from the language server")
+			} else {
+				languageServer = true
+			}
+
+			docs := docstate.NewDocumentState()
+			for _, doc := range openDocs {
+				docs.RestoreDocument(doc)
+			}
+
+			contextApi = &LanguageServerClientInfo{
+				Docs:   docs,
+				Config: config,
+				db:     db,
+				wd:     wd,
+			}
+		}
+
+		messages, err := buildChatMessages(config, contextApi, model, openDocs, transcript)
+		if err != nil {
+			return err
+		}
+
+		out := io.Writer(os.Stdout)
+		if jsonOutput {
+			out = io.Discard
+		}
+
+		answer, err := streamChatReply(context.TODO(), llm, model, messages, out)
+		if err != nil {
+			return err
+		}
+		answer = strings.TrimSpace(answer)
+
+		err = os.WriteFile(chatPath, []byte(transcript+chatReplyPrefix(transcript)+answer+chatReplySuffix), 0644)
+		if err != nil {
+			return err
+		}
+
+		if !jsonOutput {
+			fmt.Println()
+			return nil
+		}
+
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(&AskResult{
+			Model:          model,
+			Question:       messages[len(messages)-1].Content,
+			Answer:         answer,
+			LanguageServer: languageServer,
+		})
+	},
+}
+
+// getServerOpenDocuments asks the workspace's language server, if there is one
+// running, for its open documents
+func getServerOpenDocuments(wd string) (map[uri.URI]docstate.OpenDocument, error) {
+	stateClient, err := client.NewClient(getWorkspaceSocketPath(wd))
+	if err != nil {
+		return nil, err
+	}
+	defer stateClient.Close()
+
+	ctx, cancel := context.WithTimeout(context.TODO(), stateServerTimeout)
+	defer cancel()
+
+	serverDocs, err := stateClient.GetOpenDocuments(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	openDocs := map[uri.URI]docstate.OpenDocument{}
+	for _, doc := range serverDocs {
+		docUri := uri.URI(doc.Uri)
+		openDocs[docUri] = docstate.OpenDocument{
+			TextDocumentItem: protocol.TextDocumentItem{
+				URI:        docUri,
+				LanguageID: protocol.LanguageIdentifier(doc.LanguageId),
+				Version:    doc.Version,
+				Text:       doc.Text,
+			},
+			LastEdit:       doc.LastEdit.AsTime(),
+			LastEditedLine: int(doc.LastEditedLine),
+		}
+	}
+
+	return openDocs, nil
+}
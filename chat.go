@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/everestmz/sage/docstate"
+	"go.lsp.dev/protocol"
+	"go.lsp.dev/uri"
+)
+
+// The chat is a markdown file in the workspace dir. Each message goes under a
+// heading saying who it's from, so the user can edit the whole conversation,
+// and the file is the history we send along with every follow-up.
+const (
+	chatUserHeading = "## You"
+	chatSageHeading = "## Sage"
+)
+
+const chatFileHeader = "# Sage chat\n\nWrite your message under the last \"" + chatUserHeading + "\" heading, then send it with the \"Sage: Send chat message\" code action or `sage ask`.\n\n" + chatUserHeading + "\n\n"
+
+// What goes after a reply, ready for the next message
+const chatReplySuffix = "\n\n" + chatUserHeading + "\n\n"
+
+// readChatFile returns the chat's text, creating the file if it doesn't exist yet
+func readChatFile(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return chatFileHeader, os.WriteFile(path, []byte(chatFileHeader), 0644)
+	}
+
+	return string(content), err
+}
+
+// parseChat splits a chat transcript into messages. Anything before the first
+// heading is ignored, as are empty messages.
+func parseChat(text string) []ChatMessage {
+	var messages []ChatMessage
+	var current *ChatMessage
+	var lines []string
+
+	flush := func() {
+		if current != nil {
+			current.Content = strings.TrimSpace(strings.Join(lines, "\n"))
+			if current.Content != "" {
+				messages = append(messages, *current)
+			}
+		}
+		lines = nil
+	}
+
+	for _, line := range strings.Split(text, "\n") {
+		switch strings.TrimSpace(line) {
+		case chatUserHeading:
+			flush()
+			current = &ChatMessage{Role: "user"}
+		case chatSageHeading:
+			flush()
+			current = &ChatMessage{Role: "assistant"}
+		default:
+			lines = append(lines, line)
+		}
+	}
+	flush()
+
+	return messages
+}
+
+// separateFrom returns what needs to go before text appended to transcript so
+// that it starts after a blank line
+func separateFrom(transcript string) string {
+	switch {
+	case transcript == "" || strings.HasSuffix(transcript, "\n\n"):
+		return ""
+	case strings.HasSuffix(transcript, "\n"):
+		return "\n"
+	default:
+		return "\n\n"
+	}
+}
+
+// addChatMessage adds a message from the user to the end of the transcript,
+// under the empty heading waiting for it if there is one
+func addChatMessage(transcript, message string) string {
+	if strings.HasSuffix(strings.TrimSpace(transcript), chatUserHeading) {
+		return transcript + separateFrom(transcript) + message + "\n"
+	}
+
+	return transcript + separateFrom(transcript) + chatUserHeading + "\n\n" + message + "\n"
+}
+
+// chatReplyPrefix returns what goes between the end of the transcript and the reply
+func chatReplyPrefix(transcript string) string {
+	return separateFrom(transcript) + chatSageHeading + "\n\n"
+}
+
+// buildChatMessages prefixes the conversation with a system message holding
+// the workspace context and the documents open in the editor. A nil api leaves
+// the workspace context out. The context is formatted for model.
+func buildChatMessages(config *SagePathConfig, api ContextApi, model string, openDocs map[uri.URI]docstate.OpenDocument, transcript string) ([]ChatMessage, error) {
+	conversation := parseChat(transcript)
+	if len(conversation) == 0 || conversation[len(conversation)-1].Role != "user" {
+		return nil, fmt.Errorf("Nothing to send - write your message under the last \"%s\" heading", chatUserHeading)
+	}
+
+	data := &PromptData{}
+	if api != nil {
+		var err error
+		data.Context, err = config.BuildContext(api, model)
+		if err != nil {
+			return nil, err
+		}
+
+		models, err := config.Models.Get()
+		if err != nil {
+			return nil, err
+		}
+
+		renderer, err := models.GetContextRenderer(model)
+		if err != nil {
+			return nil, err
+		}
+
+		data.OpenDocuments, err = renderOpenDocuments(renderer, openDocs)
+		if err != nil {
+			return nil, err
+		}
+
+		data.RecentEdits, err = renderRecentEdits(renderer, openDocs)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	systemPrompt, err := config.Prompts.Render("chat", data)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]ChatMessage{{Role: "system", Content: systemPrompt}}, conversation...), nil
+}
+
+// renderOpenDocuments formats the open documents in a stable order, leaving out
+// sage's own files like the chat itself
+func renderOpenDocuments(renderer ContextRenderer, openDocs map[uri.URI]docstate.OpenDocument) (string, error) {
+	docs := sortedOpenDocuments(openDocs, func(a, b docstate.OpenDocument) bool {
+		return a.URI < b.URI
+	})
+
+	var entries []*ContextEntry
+	for _, item := range documentItems(docs) {
+		entries = append(entries, &ContextEntry{Type: ContextItemTypeOpen, ContextItem: item})
+	}
+
+	return renderer.Render(entries)
+}
+
+// How many documents, and how many lines either side of the last edit in each,
+// go in the recent edits
+const (
+	maxRecentEditDocuments = 3
+	recentEditContextLines = 3
+)
+
+// renderRecentEdits formats the lines around the last edit in each of the most
+// recently edited open documents, most recent first
+func renderRecentEdits(renderer ContextRenderer, openDocs map[uri.URI]docstate.OpenDocument) (string, error) {
+	docs := sortedOpenDocuments(openDocs, func(a, b docstate.OpenDocument) bool {
+		return a.LastEdit.After(b.LastEdit)
+	})
+	if len(docs) > maxRecentEditDocuments {
+		docs = docs[:maxRecentEditDocuments]
+	}
+
+	var entries []*ContextEntry
+	for _, doc := range docs {
+		lines := strings.Split(doc.Text, "\n")
+		start := max(doc.LastEditedLine-recentEditContextLines, 0)
+		end := min(doc.LastEditedLine+recentEditContextLines+1, len(lines))
+		if start >= end {
+			continue
+		}
+
+		entries = append(entries, &ContextEntry{
+			Type: ContextItemTypeRecentEdit,
+			ContextItem: &ContextItem{
+				Filename:   doc.URI.Filename(),
+				Identifier: fmt.Sprintf("%d:%d", start+1, end),
+				Content:    strings.Join(lines[start:end], "\n"),
+			},
+		})
+	}
+
+	return renderer.Render(entries)
+}
+
+// isSageFile is whether path is one of sage's own files, like the chat
+func isSageFile(path string) bool {
+	return strings.HasPrefix(path, getConfigDir()+string(filepath.Separator))
+}
+
+// streamChatReply streams the model's reply to w as it's generated, and returns the whole thing
+func streamChatReply(ctx context.Context, llm *LLMClient, model string, messages []ChatMessage, w io.Writer) (string, error) {
+	var reply strings.Builder
+
+	err := llm.StreamChat(ctx, model, messages, func(cr CompletionResponse) error {
+		reply.WriteString(cr.Text)
+		_, err := io.WriteString(w, cr.Text)
+		return err
+	})
+
+	return reply.String(), err
+}
+
+var lspCommandOpenChat = &CommandDefinition{
+	Title:          "Open chat",
+	ShowCodeAction: true,
+	Identifier:     "sage.chat.open",
+	BuildArgs: func(params *protocol.CodeActionParams) ([]any, error) {
+		return []any{}, nil
+	},
+	CodeActionFilter: func(params *protocol.CodeActionParams, clientInfo *LanguageServerClientInfo) bool {
+		return params.TextDocument.URI.Filename() != getWorkspaceChatPath()
+	},
+	Execute: func(params *protocol.ExecuteCommandParams, client LspClient, clientInfo *LanguageServerClientInfo) (*protocol.ApplyWorkspaceEditParams, error) {
+		chatPath := getWorkspaceChatPath()
+		_, err := readChatFile(chatPath)
+		if err != nil {
+			return nil, err
+		}
+
+		result := &protocol.ShowDocumentResult{}
+		_, err = client.Conn().Call(context.TODO(), string(protocol.MethodShowDocument), protocol.ShowDocumentParams{
+			URI:       uri.File(chatPath),
+			External:  false,
+			TakeFocus: true,
+			Selection: nil,
+		}, result)
+
+		return nil, err
+	},
+}
+
+var lspCommandSendChat = &CommandDefinition{
+	Title:          "Send chat message",
+	ShowCodeAction: true,
+	Identifier:     "sage.chat.send",
+	BuildArgs: func(params *protocol.CodeActionParams) ([]any, error) {
+		return []any{}, nil
+	},
+	CodeActionFilter: func(params *protocol.CodeActionParams, clientInfo *LanguageServerClientInfo) bool {
+		return params.TextDocument.URI.Filename() == getWorkspaceChatPath()
+	},
+	Execute: func(params *protocol.ExecuteCommandParams, client LspClient, clientInfo *LanguageServerClientInfo) (*protocol.ApplyWorkspaceEditParams, error) {
+		lsLogger := globalLsLogger.With().Str("code_action", params.Command).Logger()
+
+		chatPath := getWorkspaceChatPath()
+		chatUri := uri.File(chatPath)
+
+		// The editor's copy has whatever the user has typed but not saved yet
+		doc, chatOpen := clientInfo.Docs.GetOpenDocument(chatUri)
+		transcript := doc.Text
+		if !chatOpen {
+			var err error
+			transcript, err = readChatFile(chatPath)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		models, err := clientInfo.Config.Models.Get()
+		if err != nil {
+			return nil, err
+		}
+
+		model := *models.Default
+
+		messages, err := buildChatMessages(clientInfo.Config, clientInfo, model, clientInfo.Docs.OpenDocuments(), transcript)
+		if err != nil {
+			return nil, err
+		}
+
+		lsLogger.Info().Str("model", model).Int("messages", len(messages)).Msg("Sending chat")
+
+		client.Progress(context.TODO(), &protocol.ProgressParams{
+			Value: &protocol.WorkDoneProgressBegin{
+				Kind:    protocol.WorkDoneProgressKindBegin,
+				Title:   "Sage chat",
+				Message: "connecting...",
+			},
+		})
+
+		if chatOpen {
+			editsManager := NewLlmResponseEditsManager(client, clientInfo, chatUri, getPositionOffset(transcript))
+			defer editsManager.Close()
+
+			err = editsManager.NextEdit(chatReplyPrefix(transcript))
+			if err != nil {
+				return nil, err
+			}
+
+			err = streamResponseEdits(editsManager, lsLogger, func(ctx context.Context, handler GenerateResponseFunc) error {
+				return clientInfo.LLM.StreamChat(ctx, model, messages, handler)
+			})
+			if err != nil {
+				return nil, err
+			}
+
+			err = editsManager.NextEdit(chatReplySuffix)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			reply, err := streamChatReply(context.TODO(), clientInfo.LLM, model, messages, io.Discard)
+			if err != nil {
+				return nil, err
+			}
+
+			err = os.WriteFile(chatPath, []byte(transcript+chatReplyPrefix(transcript)+strings.TrimSpace(reply)+chatReplySuffix), 0644)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		client.Progress(context.TODO(), &protocol.ProgressParams{
+			Value: &protocol.WorkDoneProgressEnd{
+				Kind:    protocol.WorkDoneProgressKindEnd,
+				Message: "Done!",
+			},
+		})
+
+		return nil, nil
+	},
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/everestmz/sage/docstate"
+	"go.lsp.dev/protocol"
+	"go.lsp.dev/uri"
+)
+
+func TestParseChat(t *testing.T) {
+	tests := []struct {
+		name       string
+		transcript string
+		expected   []ChatMessage
+	}{
+		{
+			name:       "New chat",
+			transcript: chatFileHeader,
+			expected:   nil,
+		},
+		{
+			name:       "First message",
+			transcript: chatFileHeader + "What does main do?\n",
+			expected: []ChatMessage{
+				{Role: "user", Content: "What does main do?"},
+			},
+		},
+		{
+			name:       "Follow-up",
+			transcript: chatFileHeader + "What does main do?\n\n## Sage\n\nIt starts the server.\n\n## You\n\nWhich one?\n",
+			expected: []ChatMessage{
+				{Role: "user", Content: "What does main do?"},
+				{Role: "assistant", Content: "It starts the server."},
+				{Role: "user", Content: "Which one?"},
+			},
+		},
+		{
+			name:       "Waiting for the next message",
+			transcript: chatFileHeader + "What does main do?\n\n## Sage\n\nIt starts the server." + chatReplySuffix,
+			expected: []ChatMessage{
+				{Role: "user", Content: "What does main do?"},
+				{Role: "assistant", Content: "It starts the server."},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := parseChat(tt.transcript)
+			if !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("Expected messages %v, but got %v", tt.expected, result)
+			}
+		})
+	}
+}
+
+func TestAddChatMessage(t *testing.T) {
+	tests := []struct {
+		name       string
+		transcript string
+		expected   string
+	}{
+		{
+			name:       "Under the waiting heading",
+			transcript: "## Sage\n\nHi" + chatReplySuffix,
+			expected:   "## Sage\n\nHi\n\n## You\n\nWhich one?\n",
+		},
+		{
+			name:       "After a message from the user",
+			transcript: "## You\n\nWhat does main do?\n",
+			expected:   "## You\n\nWhat does main do?\n\n## You\n\nWhich one?\n",
+		},
+		{
+			name:       "After a reply with no heading waiting",
+			transcript: "## Sage\n\nHi",
+			expected:   "## Sage\n\nHi\n\n## You\n\nWhich one?\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := addChatMessage(tt.transcript, "Which one?")
+			if result != tt.expected {
+				t.Errorf("Expected transcript %q, but got %q", tt.expected, result)
+			}
+		})
+	}
+}
+
+func TestRenderRecentEdits(t *testing.T) {
+	now := time.Now()
+	doc := func(path, text string, lastEditedLine int, lastEdit time.Time) docstate.OpenDocument {
+		return docstate.OpenDocument{
+			TextDocumentItem: protocol.TextDocumentItem{
+				URI:  uri.File(path),
+				Text: text,
+			},
+			LastEdit:       lastEdit,
+			LastEditedLine: lastEditedLine,
+		}
+	}
+
+	openDocs := map[uri.URI]docstate.OpenDocument{}
+	for _, d := range []docstate.OpenDocument{
+		doc("/src/old.go", "a\nb", 0, now.Add(-time.Hour)),
+		doc("/src/new.go", "1\n2\n3\n4\n5\n6\n7\n8\n9\n10", 6, now),
+		doc(filepath.Join(getConfigDir(), "chat.md"), "## You\n\nHi", 2, now.Add(time.Minute)),
+	} {
+		openDocs[d.URI] = d
+	}
+
+	expected := `<RecentEdit file="/src/new.go" range="4:10">
+4
+5
+6
+7
+8
+9
+10
+</RecentEdit>
+<RecentEdit file="/src/old.go" range="1:2">
+a
+b
+</RecentEdit>
+`
+
+	result, err := renderRecentEdits(XMLContextRenderer{}, openDocs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result != expected {
+		t.Errorf("Expected recent edits %q, but got %q", expected, result)
+	}
+}
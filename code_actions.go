@@ -5,10 +5,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	cursor "github.com/everestmz/cursor-rpc"
 	aiserverv1 "github.com/everestmz/cursor-rpc/cursor/gen/aiserver/v1"
+	"github.com/everestmz/sage/docstate"
+	"github.com/everestmz/sage/lsp"
 
 	"github.com/rs/zerolog"
 	"go.lsp.dev/protocol"
@@ -20,8 +24,24 @@ var lspCommands = []*CommandDefinition{
 	lspCommandExecCompletion,
 	lspCommandOpenModelsConfig,
 	lspCommandOpenContextConfig,
+	lspCommandOpenPromptsConfig,
 	lspCommandShowCurrentContext,
 	lspCommandShowCurrentModel,
+	lspCommandSwitchContextProfile,
+	lspCommandListContextProfiles,
+	lspCommandExecRewrite,
+	lspCommandExecRewritePreview,
+	lspCommandApplyPreview,
+	lspCommandDiscardPreview,
+	lspCommandUndoGeneration,
+	lspCommandExplainSelection,
+	lspCommandGenerateTests,
+	lspCommandGenerateDocs,
+	lspCommandFixDiagnostic,
+	lspCommandOpenChat,
+	lspCommandSendChat,
+	lspCommandGenerateCommitMessage,
+	lspCommandSuggestNames,
 }
 
 func getPositionOffset(text string) protocol.Position {
@@ -64,7 +84,7 @@ var lspCommandShowCurrentModel = &CommandDefinition{
 			// Token: *params.WorkDoneProgressParams.WorkDoneToken,
 			Value: &protocol.WorkDoneProgressEnd{
 				Kind:    protocol.WorkDoneProgressKindEnd,
-				Message: *models.Default,
+				Message: fmt.Sprintf("%s (context profile: %s)", *models.Default, clientInfo.Config.Context.Active()),
 			},
 		})
 
@@ -80,15 +100,21 @@ var lspCommandShowCurrentContext = &CommandDefinition{
 		return []any{}, nil
 	},
 	Execute: func(params *protocol.ExecuteCommandParams, client LspClient, clientInfo *LanguageServerClientInfo) (*protocol.ApplyWorkspaceEditParams, error) {
-		providers, err := clientInfo.Config.Context.Get()
+		models, err := clientInfo.Config.Models.Get()
 		if err != nil {
 			return nil, err
 		}
 
-		llmContext, err := BuildContext(providers, clientInfo)
+		// Shown as it would be for the default model
+		llmContext, profile, warnings, err := clientInfo.Config.BuildContextWithWarnings(clientInfo, *models.Default)
 		if err != nil {
 			return nil, err
 		}
+		clientInfo.ReportContextWarnings(profile, warnings)
+
+		if len(warnings) > 0 {
+			llmContext = "Left out of the context:\n" + formatContextWarnings(warnings) + "\n\n" + llmContext
+		}
 
 		f, err := os.CreateTemp(os.TempDir(), "sage_context")
 		if err != nil {
@@ -136,6 +162,26 @@ var lspCommandOpenContextConfig = &CommandDefinition{
 	},
 }
 
+var lspCommandOpenPromptsConfig = &CommandDefinition{
+	Title:          "Edit prompts",
+	ShowCodeAction: true,
+	Identifier:     "sage.workspace.prompts.edit",
+	BuildArgs: func(params *protocol.CodeActionParams) ([]any, error) {
+		return []any{}, nil
+	},
+	Execute: func(params *protocol.ExecuteCommandParams, client LspClient, clientInfo *LanguageServerClientInfo) (*protocol.ApplyWorkspaceEditParams, error) {
+		result := &protocol.ShowDocumentResult{}
+		_, err := client.Conn().Call(context.TODO(), string(protocol.MethodShowDocument), protocol.ShowDocumentParams{
+			URI:       uri.File(getWorkspacePromptsPath()),
+			External:  false,
+			TakeFocus: true,
+			Selection: nil,
+		}, result)
+
+		return nil, err
+	},
+}
+
 var lspCommandOpenModelsConfig = &CommandDefinition{
 	Title:          "Edit workspace configuration",
 	ShowCodeAction: true,
@@ -162,8 +208,9 @@ var lspCommandExecCursorCompletion = &CommandDefinition{
 	Identifier:     "sage.completion.cursor.selection",
 	BuildArgs: func(params *protocol.CodeActionParams) ([]any, error) {
 		args := &LlmCompletionArgs{
-			Filename:  params.TextDocument.URI,
-			Selection: params.Range,
+			Filename:    params.TextDocument.URI,
+			Selection:   params.Range,
+			Diagnostics: params.Context.Diagnostics,
 		}
 
 		return []any{args}, nil
@@ -187,17 +234,18 @@ var lspCommandExecCursorCompletion = &CommandDefinition{
 			return nil, err
 		}
 
-		prompt, err := buildPrompt(lsLogger, args, clientInfo)
+		model := "claude-3.5-sonnet"
+
+		prompt, err := buildPrompt(lsLogger, args, clientInfo, model)
 		if err != nil {
 			return nil, err
 		}
 
-		editsManager := NewLlmResponseEditsManager(client, args.Filename, args.Selection.End.Line, args.Selection.End.Character)
+		editsManager := NewLlmResponseEditsManager(client, clientInfo, args.Filename, args.Selection.End)
+		defer editsManager.Close()
 
 		aiClient := cursor.NewAiServiceClient()
 
-		model := "claude-3.5-sonnet"
-
 		resp, err := aiClient.StreamChat(context.TODO(), cursor.NewRequest(cursorCredentials, &aiserverv1.GetChatRequest{
 			ModelDetails: &aiserverv1.ModelDetails{
 				ModelName: &model,
@@ -216,68 +264,58 @@ var lspCommandExecCursorCompletion = &CommandDefinition{
 
 		for resp.Receive() {
 			next := resp.Msg()
-			editsManager.NextEdit(next.Text)
+			err = editsManager.NextEdit(next.Text)
+			if err != nil {
+				return nil, err
+			}
 		}
 
-		return nil, nil
+		return nil, resp.Err()
 	},
 }
 
-func buildPrompt(lsLogger zerolog.Logger, args *LlmCompletionArgs, clientInfo *LanguageServerClientInfo) (string, error) {
-	textDocument, ok := clientInfo.Docs.GetOpenDocument(args.Filename)
-	if !ok {
-		return "", fmt.Errorf("No text document for supposedly open file %s", args.Filename)
-	}
-
-	documentLines := append(strings.Split(textDocument.Text, "\n"), "") // Unixy files end in \n
-	lineRange := documentLines[args.Selection.Start.Line : args.Selection.End.Line+1]
-	lsLogger.Debug().Str("Line range", fmt.Sprint(lineRange)).Msg("Lines Range")
-	endLineIndex := args.Selection.End.Line - args.Selection.Start.Line
-	lsLogger.Debug().Uint32("end idx", endLineIndex).Msg("End idx")
-	lineRange[0] = lineRange[0][args.Selection.Start.Character:]
-	lineRange[endLineIndex] = lineRange[endLineIndex][:args.Selection.End.Character]
-	lsLogger.Debug().Str("Line range", fmt.Sprint(lineRange)).Msg("Lines Range after narrowing")
-
-	documentContext := strings.Join(documentLines[:args.Selection.End.Line], "\n")
-	selectionText := strings.Join(lineRange, "\n")
-
-	contextProviders, err := clientInfo.Config.Context.Get()
+func buildPrompt(lsLogger zerolog.Logger, args *LlmCompletionArgs, clientInfo *LanguageServerClientInfo, model string) (string, error) {
+	data, err := newSelectionPromptData(args, clientInfo, model)
 	if err != nil {
 		return "", err
 	}
+	lsLogger.Debug().Str("selection", data.Selection).Msg("Selection text")
 
-	filesContext, err := BuildContext(contextProviders, clientInfo)
-	if err != nil {
-		return "", err
-	}
-
-	prompt := filesContext
+	return clientInfo.Config.Prompts.Render("completion", data)
+}
 
-	prompt += "<CurrentFile path=\"" + args.Filename.Filename() + "\">\n"
-	prompt += documentContext
-	prompt += "\n</CurrentFile>\n"
+func getSelectionText(text string, selection protocol.Range) string {
+	start := lsp.GetOffset(text, selection.Start)
+	end := lsp.GetOffset(text, selection.End)
+	if end < start {
+		return ""
+	}
 
-	prompt += `<SystemPrompt>
-A user's prompt, in the form of a question, or a description code to write, is shown below. Satisfy the user's prompt or question to the best of your ability. If asked to complete code, DO NOT type out any extra text, or backticks since your response will be appended to the end of the CurrentFile. DO NOT regurgitate the whole file. Simply return the new code, or the modified code.
-</SystemPrompt>
-`
+	return text[start:end]
+}
 
-	prompt += "<UserPrompt>\n"
-	prompt += selectionText
-	prompt += "\n</UserPrompt>\n"
+// How long to wait for the didChange that follows one of our own edits
+const editAckTimeout = 2 * time.Second
 
-	return prompt, nil
-}
+// How many times we'll retry an edit the client rejected because the user
+// changed the document under us
+const maxEditRetries = 5
 
+// LlmResponseEditsManager streams text into a document at an anchor. The
+// anchor follows the user's edits as they come in through didChange, and each
+// edit is versioned so the client rejects it rather than inserting it in the
+// wrong place if the document has moved on since we computed it.
 type LlmResponseEditsManager struct {
-	placeNextEdit protocol.Position
-	fullText      string
-	currentLine   string
-	client        LspClient
-	filename      uri.URI
+	anchor      *docstate.Anchor
+	generation  *Generation
+	fullText    string
+	currentLine string
+	client      LspClient
+	clientInfo  *LanguageServerClientInfo
+	filename    uri.URI
 }
 
-func (m *LlmResponseEditsManager) NextEdit(nextText string) {
+func (m *LlmResponseEditsManager) NextEdit(nextText string) error {
 	m.fullText += nextText
 
 	if strings.Contains(nextText, "\n") {
@@ -296,40 +334,200 @@ func (m *LlmResponseEditsManager) NextEdit(nextText string) {
 		m.currentLine += nextText
 	}
 
-	m.client.ApplyEdit(context.TODO(), &protocol.ApplyWorkspaceEditParams{
-		Label: "llm_line",
-		Edit: protocol.WorkspaceEdit{
+	if nextText == "" {
+		return nil
+	}
+
+	for attempt := 0; attempt < maxEditRetries; attempt++ {
+		position, version, ok := m.clientInfo.Docs.AnchorPosition(m.anchor)
+		if !ok {
+			return fmt.Errorf("%s was closed while generating", m.filename.Filename())
+		}
+
+		applied, err := applyVersionedEdit(m.client, m.clientInfo, "llm_line", m.filename, version, []protocol.TextEdit{
+			{
+				Range: protocol.Range{
+					Start: position,
+					End:   position,
+				},
+				NewText: nextText,
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		// Whether or not our edit made it in, the document has changed (or is about
+		// to), and the anchor won't be right until we've seen the didChange for it
+		ctx, cancel := context.WithTimeout(context.TODO(), editAckTimeout)
+		_, err = m.clientInfo.Docs.WaitForChange(ctx, m.filename, version)
+		cancel()
+
+		if applied {
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("Edit was rejected, and the document did not change: %w", err)
+		}
+	}
+
+	return fmt.Errorf("Edit was rejected %d times, giving up", maxEditRetries)
+}
+
+// Close stops the anchor from tracking changes to the document. The generated
+// text stays recorded in the generation history so it can be undone.
+func (m *LlmResponseEditsManager) Close() {
+	m.clientInfo.Docs.RemoveAnchor(m.anchor)
+
+	if m.fullText == "" {
+		m.clientInfo.Generations.Remove(m.generation)
+	}
+}
+
+func NewLlmResponseEditsManager(client LspClient, clientInfo *LanguageServerClientInfo, filename uri.URI, start protocol.Position) *LlmResponseEditsManager {
+	return &LlmResponseEditsManager{
+		anchor:     clientInfo.Docs.AddAnchor(filename, start, docstate.AnchorGravityRight),
+		generation: clientInfo.Generations.Begin(filename, []GeneratedEdit{{Region: protocol.Range{Start: start, End: start}}}, "sage: generate"),
+		filename:   filename,
+		client:     client,
+		clientInfo: clientInfo,
+	}
+}
+
+// buildWorkspaceEdit pins the edits to a version of the document if the client
+// supports it, so stale edits are rejected instead of applied in the wrong place
+func buildWorkspaceEdit(clientInfo *LanguageServerClientInfo, filename uri.URI, version int32, edits []protocol.TextEdit) protocol.WorkspaceEdit {
+	workspaceCaps := clientInfo.ClientCapabilities.Workspace
+	if workspaceCaps == nil || workspaceCaps.WorkspaceEdit == nil || !workspaceCaps.WorkspaceEdit.DocumentChanges {
+		return protocol.WorkspaceEdit{
 			Changes: map[uri.URI][]protocol.TextEdit{
-				m.filename: []protocol.TextEdit{
-					{
-						Range: protocol.Range{
-							Start: m.placeNextEdit,
-							End:   m.placeNextEdit,
-						},
-						NewText: nextText,
+				filename: edits,
+			},
+		}
+	}
+
+	return protocol.WorkspaceEdit{
+		DocumentChanges: []protocol.TextDocumentEdit{
+			{
+				TextDocument: protocol.OptionalVersionedTextDocumentIdentifier{
+					TextDocumentIdentifier: protocol.TextDocumentIdentifier{
+						URI: filename,
 					},
+					Version: &version,
 				},
+				Edits: edits,
 			},
 		},
-	})
-	offset := getPositionOffset(nextText)
-	m.placeNextEdit.Line += offset.Line
-	m.placeNextEdit.Character += offset.Character
-	if offset.Line > 0 {
-		m.placeNextEdit.Character = offset.Character
+	}
+}
+
+func applyVersionedEdit(client LspClient, clientInfo *LanguageServerClientInfo, label string, filename uri.URI, version int32, edits []protocol.TextEdit) (bool, error) {
+	result := &protocol.ApplyWorkspaceEditResponse{}
+	_, err := client.Conn().Call(context.TODO(), protocol.MethodWorkspaceApplyEdit, &protocol.ApplyWorkspaceEditParams{
+		Label: label,
+		Edit:  buildWorkspaceEdit(clientInfo, filename, version, edits),
+	}, result)
+	if err != nil {
+		return false, err
 	}
 
+	return result.Applied, nil
 }
 
-func NewLlmResponseEditsManager(client LspClient, filename uri.URI, startLine, startChar uint32) *LlmResponseEditsManager {
-	return &LlmResponseEditsManager{
-		placeNextEdit: protocol.Position{
-			Line:      startLine,
-			Character: startChar,
+// applyUnversionedEdit edits a file that isn't open, so there's no version to check against
+func applyUnversionedEdit(client LspClient, label string, filename uri.URI, edits []protocol.TextEdit) (bool, error) {
+	result := &protocol.ApplyWorkspaceEditResponse{}
+	_, err := client.Conn().Call(context.TODO(), protocol.MethodWorkspaceApplyEdit, &protocol.ApplyWorkspaceEditParams{
+		Label: label,
+		Edit: protocol.WorkspaceEdit{
+			Changes: map[uri.URI][]protocol.TextEdit{
+				filename: edits,
+			},
 		},
-		filename: filename,
-		client:   client,
+	}, result)
+	if err != nil {
+		return false, err
 	}
+
+	return result.Applied, nil
+}
+
+// ResourceWorkspaceEdit is a WorkspaceEdit whose document changes can include
+// resource operations like CreateFile, which protocol.WorkspaceEdit can't express
+type ResourceWorkspaceEdit struct {
+	DocumentChanges []any `json:"documentChanges"`
+}
+
+type ResourceWorkspaceEditParams struct {
+	Label string                `json:"label,omitempty"`
+	Edit  ResourceWorkspaceEdit `json:"edit"`
+}
+
+func clientSupportsCreateFile(clientInfo *LanguageServerClientInfo) bool {
+	workspaceCaps := clientInfo.ClientCapabilities.Workspace
+	if workspaceCaps == nil || workspaceCaps.WorkspaceEdit == nil || !workspaceCaps.WorkspaceEdit.DocumentChanges {
+		return false
+	}
+
+	for _, op := range workspaceCaps.WorkspaceEdit.ResourceOperations {
+		if op == string(protocol.CreateResourceOperation) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// createFileWithText creates a new file containing text. Clients that can't
+// create files in a workspace edit get the file written to disk instead.
+func createFileWithText(client LspClient, clientInfo *LanguageServerClientInfo, label string, filename uri.URI, text string) error {
+	if !clientSupportsCreateFile(clientInfo) {
+		err := os.MkdirAll(filepath.Dir(filename.Filename()), 0755)
+		if err != nil {
+			return err
+		}
+
+		return os.WriteFile(filename.Filename(), []byte(text), 0644)
+	}
+
+	result := &protocol.ApplyWorkspaceEditResponse{}
+	_, err := client.Conn().Call(context.TODO(), protocol.MethodWorkspaceApplyEdit, &ResourceWorkspaceEditParams{
+		Label: label,
+		Edit: ResourceWorkspaceEdit{
+			DocumentChanges: []any{
+				protocol.CreateFile{
+					Kind: protocol.CreateResourceOperation,
+					URI:  filename,
+					Options: &protocol.CreateFileOptions{
+						IgnoreIfExists: true,
+					},
+				},
+				protocol.TextDocumentEdit{
+					TextDocument: protocol.OptionalVersionedTextDocumentIdentifier{
+						TextDocumentIdentifier: protocol.TextDocumentIdentifier{
+							URI: filename,
+						},
+					},
+					Edits: []protocol.TextEdit{
+						{
+							Range:   protocol.Range{},
+							NewText: text,
+						},
+					},
+				},
+			},
+		},
+	}, result)
+	if err != nil {
+		return err
+	}
+
+	if !result.Applied {
+		return fmt.Errorf("Client refused to create %s", filename.Filename())
+	}
+
+	return nil
 }
 
 var lspCommandExecCompletion = &CommandDefinition{
@@ -338,8 +536,9 @@ var lspCommandExecCompletion = &CommandDefinition{
 	Identifier:     "sage.completion.ollama.selection",
 	BuildArgs: func(params *protocol.CodeActionParams) ([]any, error) {
 		args := &LlmCompletionArgs{
-			Filename:  params.TextDocument.URI,
-			Selection: params.Range,
+			Filename:    params.TextDocument.URI,
+			Selection:   params.Range,
+			Diagnostics: params.Context.Diagnostics,
 		}
 
 		return []any{args}, nil
@@ -357,31 +556,18 @@ var lspCommandExecCompletion = &CommandDefinition{
 			return nil, err
 		}
 
-		prompt, err := buildPrompt(lsLogger, args, clientInfo)
+		models, err := clientInfo.Config.Models.Get()
 		if err != nil {
 			return nil, err
 		}
 
-		completionCh := make(chan string)
-		errCh := make(chan error)
-
-		var receiveCompletionFunc GenerateResponseFunc = func(cr CompletionResponse) error {
-			lsLogger.Debug().Str("text", cr.Text).Bool("done", cr.Done).Msg("Received text")
-			completionCh <- cr.Text
-			if cr.Done {
-				close(completionCh)
-			}
-
-			return nil
-		}
+		model := *models.Default
 
-		models, err := clientInfo.Config.Models.Get()
+		prompt, err := buildPrompt(lsLogger, args, clientInfo, model)
 		if err != nil {
 			return nil, err
 		}
 
-		model := *models.Default
-
 		lsLogger.Info().Str("model", model).Str("prompt", prompt).Msg("Generating completion")
 
 		client.Progress(context.TODO(), &protocol.ProgressParams{
@@ -393,46 +579,419 @@ var lspCommandExecCompletion = &CommandDefinition{
 			},
 		})
 
-		go func() {
-			err := clientInfo.LLM.StreamCompletion(context.TODO(), model, prompt, receiveCompletionFunc)
+		completion, err := streamCompletionEdits(client, clientInfo, lsLogger, model, prompt, args.Filename, args.Selection.End)
+		if err != nil {
+			return nil, err
+		}
+
+		lsLogger.Debug().Str("completion", completion).Msg("Returning completion")
+		client.Progress(context.TODO(), &protocol.ProgressParams{
+			// Token: *params.WorkDoneProgressParams.WorkDoneToken,
+			Value: &protocol.WorkDoneProgressEnd{
+				Kind:    protocol.WorkDoneProgressKindEnd,
+				Message: "Done!",
+			},
+		})
+
+		return nil, nil
+	},
+}
+
+// streamCompletionEdits streams the model's response into a document at start,
+// as it's generated, and returns the full response
+func streamCompletionEdits(client LspClient, clientInfo *LanguageServerClientInfo, lsLogger zerolog.Logger, model, prompt string, filename uri.URI, start protocol.Position) (string, error) {
+	editsManager := NewLlmResponseEditsManager(client, clientInfo, filename, start)
+	defer editsManager.Close()
+
+	err := streamResponseEdits(editsManager, lsLogger, func(ctx context.Context, handler GenerateResponseFunc) error {
+		return clientInfo.LLM.StreamCompletion(ctx, model, prompt, handler)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return editsManager.fullText, nil
+}
+
+// streamResponseEdits feeds a streamed response into the edits manager as it arrives
+func streamResponseEdits(editsManager *LlmResponseEditsManager, lsLogger zerolog.Logger, stream func(context.Context, GenerateResponseFunc) error) error {
+	completionCh := make(chan string)
+	errCh := make(chan error)
+
+	// Stops the generation if we can't apply its edits
+	generateCtx, cancelGenerate := context.WithCancel(context.TODO())
+	defer cancelGenerate()
+
+	var receiveCompletionFunc GenerateResponseFunc = func(cr CompletionResponse) error {
+		lsLogger.Debug().Str("text", cr.Text).Bool("done", cr.Done).Msg("Received text")
+		select {
+		case completionCh <- cr.Text:
+		case <-generateCtx.Done():
+			return generateCtx.Err()
+		}
+		if cr.Done {
+			close(completionCh)
+		}
+
+		return nil
+	}
+
+	go func() {
+		err := stream(generateCtx, receiveCompletionFunc)
+		if err != nil && generateCtx.Err() == nil {
+			errCh <- err
+		}
+
+		close(errCh)
+	}()
+
+outer:
+	for {
+		select {
+		case nextText, ok := <-completionCh:
+			if !ok {
+				break outer
+			}
+
+			err := editsManager.NextEdit(nextText)
 			if err != nil {
-				errCh <- err
+				return err
+			}
+
+		case err, ok := <-errCh:
+			if !ok {
+				continue
 			}
 
-			close(errCh)
-		}()
+			close(completionCh)
+
+			return err
+		}
+	}
+
+	return nil
+}
+
+func buildRewritePrompt(args *LlmCompletionArgs, clientInfo *LanguageServerClientInfo, model string) (string, *PromptData, error) {
+	data, err := newSelectionPromptData(args, clientInfo, model)
+	if err != nil {
+		return "", nil, err
+	}
+
+	prompt, err := clientInfo.Config.Prompts.Render("rewrite", data)
+	return prompt, data, err
+}
+
+// stripCodeFences removes the markdown code fence models like to wrap code in,
+// even when asked not to
+func stripCodeFences(text string) string {
+	trimmed := strings.TrimSpace(text)
+	if !strings.HasPrefix(trimmed, "```") || !strings.HasSuffix(trimmed, "```") {
+		return text
+	}
+
+	lines := strings.Split(trimmed, "\n")
+	if len(lines) < 2 {
+		return text
+	}
+
+	return strings.Join(lines[1:len(lines)-1], "\n") + "\n"
+}
+
+// getRewriteEdits turns a model's response into edits against the document.
+// The response is either a full replacement for the selection, or a unified
+// diff against the whole document. It also returns the resulting document text.
+func getRewriteEdits(text string, selection protocol.Range, response string) ([]protocol.TextEdit, string, error) {
+	response = stripCodeFences(response)
+
+	if lsp.IsUnifiedDiff(response) {
+		newText, err := lsp.ApplyUnifiedDiff(text, response)
+		if err != nil {
+			return nil, "", err
+		}
+
+		return lsp.ComputeTextEdits(text, newText, protocol.Position{}), newText, nil
+	}
+
+	start := lsp.GetOffset(text, selection.Start)
+	end := lsp.GetOffset(text, selection.End)
+	if end < start {
+		return nil, "", fmt.Errorf("Invalid selection %v", selection)
+	}
+
+	selected := text[start:end]
+	if strings.HasSuffix(selected, "\n") && !strings.HasSuffix(response, "\n") {
+		response += "\n"
+	} else if !strings.HasSuffix(selected, "\n") {
+		response = strings.TrimSuffix(response, "\n")
+	}
+
+	newText := text[:start] + response + text[end:]
+
+	return lsp.ComputeTextEdits(selected, response, selection.Start), newText, nil
+}
+
+type rewriteResult struct {
+	Document protocol.TextDocumentItem
+	Edits    []protocol.TextEdit
+	NewText  string
+}
+
+func generateRewrite(params *protocol.ExecuteCommandParams, client LspClient, clientInfo *LanguageServerClientInfo) (*rewriteResult, error) {
+	lsLogger := globalLsLogger.With().Str("code_action", params.Command).Logger()
+	argBs, err := json.Marshal(params.Arguments[0])
+	if err != nil {
+		return nil, err
+	}
+
+	args := &LlmCompletionArgs{}
+	err = json.Unmarshal(argBs, args)
+	if err != nil {
+		return nil, err
+	}
+
+	models, err := clientInfo.Config.Models.Get()
+	if err != nil {
+		return nil, err
+	}
+
+	model := *models.Default
+
+	prompt, data, err := buildRewritePrompt(args, clientInfo, model)
+	if err != nil {
+		return nil, err
+	}
+
+	lsLogger.Info().Str("model", model).Str("prompt", prompt).Msg("Generating rewrite")
+
+	client.Progress(context.TODO(), &protocol.ProgressParams{
+		Value: &protocol.WorkDoneProgressBegin{
+			Kind:    protocol.WorkDoneProgressKindBegin,
+			Title:   "Sage rewrite",
+			Message: "generating...",
+		},
+	})
+
+	response, err := clientInfo.LLM.GenerateCompletion(context.TODO(), model, prompt)
+	if err != nil {
+		return nil, err
+	}
+
+	client.Progress(context.TODO(), &protocol.ProgressParams{
+		Value: &protocol.WorkDoneProgressEnd{
+			Kind:    protocol.WorkDoneProgressKindEnd,
+			Message: "Done!",
+		},
+	})
+
+	// The selection is only right for the document we built the prompt from,
+	// so the edits are computed against it and pinned to its version
+	doc := data.document
+	edits, newText, err := getRewriteEdits(doc.Text, args.Selection, response)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rewriteResult{
+		Document: doc.TextDocumentItem,
+		Edits:    edits,
+		NewText:  newText,
+	}, nil
+}
+
+var lspCommandExecRewrite = &CommandDefinition{
+	Title:          "Ollama rewrite selection",
+	ShowCodeAction: true,
+	Identifier:     "sage.completion.ollama.rewrite",
+	BuildArgs: func(params *protocol.CodeActionParams) ([]any, error) {
+		args := &LlmCompletionArgs{
+			Filename:    params.TextDocument.URI,
+			Selection:   params.Range,
+			Diagnostics: params.Context.Diagnostics,
+		}
+
+		return []any{args}, nil
+	},
+	Execute: func(params *protocol.ExecuteCommandParams, client LspClient, clientInfo *LanguageServerClientInfo) (*protocol.ApplyWorkspaceEditParams, error) {
+		result, err := generateRewrite(params, client, clientInfo)
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, applyGeneratedEdits(client, clientInfo, "sage: rewrite selection", result.Document.URI, result.Document.Version, result.Edits)
+	},
+}
+
+var lspCommandExecRewritePreview = &CommandDefinition{
+	Title:          "Ollama rewrite selection (preview)",
+	ShowCodeAction: true,
+	Identifier:     "sage.completion.ollama.rewrite.preview",
+	BuildArgs: func(params *protocol.CodeActionParams) ([]any, error) {
+		args := &LlmCompletionArgs{
+			Filename:    params.TextDocument.URI,
+			Selection:   params.Range,
+			Diagnostics: params.Context.Diagnostics,
+		}
+
+		return []any{args}, nil
+	},
+	Execute: func(params *protocol.ExecuteCommandParams, client LspClient, clientInfo *LanguageServerClientInfo) (*protocol.ApplyWorkspaceEditParams, error) {
+		result, err := generateRewrite(params, client, clientInfo)
+		if err != nil {
+			return nil, err
+		}
+
+		previewUri, err := clientInfo.Previews.Add(&PendingEdit{
+			Label:   "sage: rewrite selection",
+			Target:  result.Document.URI,
+			Version: result.Document.Version,
+			Edits:   result.Edits,
+		}, result.Document.Text, result.NewText)
+		if err != nil {
+			return nil, err
+		}
+
+		showResult := &protocol.ShowDocumentResult{}
+		_, err = client.Conn().Call(context.TODO(), string(protocol.MethodShowDocument), protocol.ShowDocumentParams{
+			URI:       previewUri,
+			External:  false,
+			TakeFocus: true,
+			Selection: nil,
+		}, showResult)
+
+		return nil, err
+	},
+}
+
+type PreviewArgs struct {
+	Preview uri.URI
+}
+
+func buildPreviewArgs(params *protocol.CodeActionParams) ([]any, error) {
+	return []any{&PreviewArgs{
+		Preview: params.TextDocument.URI,
+	}}, nil
+}
+
+func isPreviewDocument(params *protocol.CodeActionParams, clientInfo *LanguageServerClientInfo) bool {
+	_, _, ok := clientInfo.Previews.Get(params.TextDocument.URI)
+	return ok
+}
+
+func getPreviewArgs(params *protocol.ExecuteCommandParams) (*PreviewArgs, error) {
+	args := &PreviewArgs{}
+	if len(params.Arguments) == 0 {
+		return args, nil
+	}
+
+	argBs, err := json.Marshal(params.Arguments[0])
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(argBs, args)
+	return args, err
+}
+
+var lspCommandApplyPreview = &CommandDefinition{
+	Title:            "Apply previewed change",
+	ShowCodeAction:   true,
+	Identifier:       "sage.completion.preview.apply",
+	BuildArgs:        buildPreviewArgs,
+	CodeActionFilter: isPreviewDocument,
+	Execute: func(params *protocol.ExecuteCommandParams, client LspClient, clientInfo *LanguageServerClientInfo) (*protocol.ApplyWorkspaceEditParams, error) {
+		args, err := getPreviewArgs(params)
+		if err != nil {
+			return nil, err
+		}
+
+		previewUri, pending, ok := clientInfo.Previews.Get(args.Preview)
+		if !ok {
+			return nil, fmt.Errorf("No pending preview to apply")
+		}
 
-		editsManager := NewLlmResponseEditsManager(client, args.Filename, args.Selection.End.Line, args.Selection.End.Character)
+		clientInfo.Previews.Remove(previewUri)
 
-	outer:
-		for {
-			select {
-			case nextText, ok := <-completionCh:
-				if !ok {
-					break outer
-				}
+		return nil, applyGeneratedEdits(client, clientInfo, pending.Label, pending.Target, pending.Version, pending.Edits)
+	},
+}
 
-				editsManager.NextEdit(nextText)
+var lspCommandDiscardPreview = &CommandDefinition{
+	Title:            "Discard previewed change",
+	ShowCodeAction:   true,
+	Identifier:       "sage.completion.preview.discard",
+	BuildArgs:        buildPreviewArgs,
+	CodeActionFilter: isPreviewDocument,
+	Execute: func(params *protocol.ExecuteCommandParams, client LspClient, clientInfo *LanguageServerClientInfo) (*protocol.ApplyWorkspaceEditParams, error) {
+		args, err := getPreviewArgs(params)
+		if err != nil {
+			return nil, err
+		}
 
-			case err, ok := <-errCh:
-				if !ok {
-					continue
-				}
+		previewUri, _, ok := clientInfo.Previews.Get(args.Preview)
+		if !ok {
+			return nil, fmt.Errorf("No pending preview to discard")
+		}
 
-				close(completionCh)
+		clientInfo.Previews.Remove(previewUri)
 
+		return nil, nil
+	},
+}
+
+type UndoGenerationArgs struct {
+	Filename uri.URI
+	Position *protocol.Position
+}
+
+var lspCommandUndoGeneration = &CommandDefinition{
+	Title:          "Undo generation",
+	ShowCodeAction: true,
+	Identifier:     "sage.completion.undo",
+	CodeActionFilter: func(params *protocol.CodeActionParams, clientInfo *LanguageServerClientInfo) bool {
+		return clientInfo.Generations.Find(params.TextDocument.URI, &params.Range.Start) != nil
+	},
+	BuildArgs: func(params *protocol.CodeActionParams) ([]any, error) {
+		return []any{&UndoGenerationArgs{
+			Filename: params.TextDocument.URI,
+			Position: &params.Range.Start,
+		}}, nil
+	},
+	Execute: func(params *protocol.ExecuteCommandParams, client LspClient, clientInfo *LanguageServerClientInfo) (*protocol.ApplyWorkspaceEditParams, error) {
+		args := &UndoGenerationArgs{}
+		if len(params.Arguments) > 0 {
+			argBs, err := json.Marshal(params.Arguments[0])
+			if err != nil {
+				return nil, err
+			}
+
+			err = json.Unmarshal(argBs, args)
+			if err != nil {
 				return nil, err
 			}
 		}
 
-		lsLogger.Debug().Str("completion", editsManager.fullText).Msg("Returning completion")
-		client.Progress(context.TODO(), &protocol.ProgressParams{
-			// Token: *params.WorkDoneProgressParams.WorkDoneToken,
-			Value: &protocol.WorkDoneProgressEnd{
-				Kind:    protocol.WorkDoneProgressKindEnd,
-				Message: "Done!",
-			},
-		})
+		generation := clientInfo.Generations.Find(args.Filename, args.Position)
+		if generation == nil {
+			return nil, fmt.Errorf("No sage generation to undo")
+		}
+
+		edits, version, ok := clientInfo.Generations.UndoEdits(generation)
+		if !ok {
+			clientInfo.Generations.Remove(generation)
+			return nil, fmt.Errorf("The document for this generation is no longer open")
+		}
+
+		applied, err := applyVersionedEdit(client, clientInfo, "sage: undo "+generation.Label, generation.uri, version, edits)
+		if err != nil {
+			return nil, err
+		}
+
+		if !applied {
+			return nil, fmt.Errorf("%s changed while undoing - please try again", generation.uri.Filename())
+		}
+
+		clientInfo.Generations.Remove(generation)
 
 		return nil, nil
 	},
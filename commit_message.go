@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/everestmz/sage/lsp"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"go.lsp.dev/protocol"
+	"go.lsp.dev/uri"
+)
+
+// ChangedFile is a file that's changed since HEAD
+type ChangedFile struct {
+	Path    string // Relative to the root of the repo
+	OldText string // Empty for new files
+	NewText string // Empty for deleted files
+	Binary  bool
+}
+
+// getHeadFiles returns the files in the HEAD commit by path
+func getHeadFiles(repo *git.Repository) (map[string]*object.File, error) {
+	headFiles := map[string]*object.File{}
+
+	head, err := repo.Head()
+	if errors.Is(err, plumbing.ErrReferenceNotFound) {
+		// No commits yet
+		return headFiles, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	commit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return nil, err
+	}
+
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+
+	err = tree.Files().ForEach(func(f *object.File) error {
+		headFiles[f.Name] = f
+		return nil
+	})
+
+	return headFiles, err
+}
+
+// getStagedFiles compares the index to HEAD, like git diff --cached
+func getStagedFiles(repo *git.Repository) ([]*ChangedFile, error) {
+	headFiles, err := getHeadFiles(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	idx, err := repo.Storer.Index()
+	if err != nil {
+		return nil, err
+	}
+
+	var staged []*ChangedFile
+	inIndex := map[string]bool{}
+	for _, entry := range idx.Entries {
+		inIndex[entry.Name] = true
+
+		// Conflicted entries have a stage, and aren't ready to commit
+		if entry.Stage != 0 || entry.IntentToAdd {
+			continue
+		}
+
+		headFile, inHead := headFiles[entry.Name]
+		if inHead && headFile.Hash == entry.Hash {
+			continue
+		}
+
+		file := &ChangedFile{Path: entry.Name}
+
+		blob, err := repo.BlobObject(entry.Hash)
+		if err != nil {
+			return nil, err
+		}
+
+		newFile := object.NewFile(entry.Name, entry.Mode, blob)
+		file.Binary, err = newFile.IsBinary()
+		if err != nil {
+			return nil, err
+		}
+
+		if inHead && !file.Binary {
+			file.Binary, err = headFile.IsBinary()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if !file.Binary {
+			file.NewText, err = newFile.Contents()
+			if err != nil {
+				return nil, err
+			}
+
+			if inHead {
+				file.OldText, err = headFile.Contents()
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		staged = append(staged, file)
+	}
+
+	for name, headFile := range headFiles {
+		if inIndex[name] {
+			continue
+		}
+
+		file := &ChangedFile{Path: name}
+		file.Binary, err = headFile.IsBinary()
+		if err != nil {
+			return nil, err
+		}
+
+		if !file.Binary {
+			file.OldText, err = headFile.Contents()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		staged = append(staged, file)
+	}
+
+	sort.Slice(staged, func(i, j int) bool {
+		return staged[i].Path < staged[j].Path
+	})
+
+	return staged, nil
+}
+
+// getUncommittedFiles compares the working tree to HEAD, like git diff HEAD.
+// Untracked files are left out.
+func getUncommittedFiles(repo *git.Repository) ([]*ChangedFile, error) {
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return nil, err
+	}
+	repoRoot := worktree.Filesystem.Root()
+
+	status, err := worktree.Status()
+	if err != nil {
+		return nil, err
+	}
+
+	headFiles, err := getHeadFiles(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	var changed []*ChangedFile
+	for path, fileStatus := range status {
+		if fileStatus.Worktree == git.Untracked || (fileStatus.Staging == git.Unmodified && fileStatus.Worktree == git.Unmodified) {
+			continue
+		}
+
+		file := &ChangedFile{Path: path}
+
+		content, err := os.ReadFile(filepath.Join(repoRoot, path))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		file.NewText = string(content)
+		file.Binary = strings.ContainsRune(file.NewText, 0)
+
+		if headFile, inHead := headFiles[path]; inHead && !file.Binary {
+			file.Binary, err = headFile.IsBinary()
+			if err != nil {
+				return nil, err
+			}
+
+			if !file.Binary {
+				file.OldText, err = headFile.Contents()
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		if file.Binary {
+			file.OldText, file.NewText = "", ""
+		}
+
+		changed = append(changed, file)
+	}
+
+	sort.Slice(changed, func(i, j int) bool {
+		return changed[i].Path < changed[j].Path
+	})
+
+	return changed, nil
+}
+
+// Diff renders the file's changes as a git-style unified diff
+func (sf *ChangedFile) Diff() string {
+	header := fmt.Sprintf("diff --git a/%s b/%s\n", sf.Path, sf.Path)
+	if sf.Binary {
+		return header + "Binary files differ\n"
+	}
+
+	oldName, newName := "a/"+sf.Path, "b/"+sf.Path
+	switch {
+	case sf.OldText == "":
+		oldName = "/dev/null"
+	case sf.NewText == "":
+		newName = "/dev/null"
+	}
+
+	return header + lsp.UnifiedDiff(oldName, newName, sf.OldText, sf.NewText, 3)
+}
+
+var newHunkRegex = regexp.MustCompile(`^@@ -\d+(?:,\d+)? \+(\d+)(?:,\d+)? @@`)
+
+// changedLines returns the (zero-based) lines in the new text that a unified
+// diff adds or changes
+func changedLines(diff string) []int {
+	var lines []int
+	line := -1
+	for _, diffLine := range strings.Split(diff, "\n") {
+		if matches := newHunkRegex.FindStringSubmatch(diffLine); matches != nil {
+			start, _ := strconv.Atoi(matches[1])
+			line = start - 1
+			continue
+		}
+		if line < 0 {
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(diffLine, "+"):
+			lines = append(lines, line)
+			line++
+		case strings.HasPrefix(diffLine, " "):
+			line++
+		}
+	}
+
+	return lines
+}
+
+// getChangedDefinitions finds the indexed symbols that the changes touch, and
+// renders their definitions as they are on disk, which is what was indexed
+func getChangedDefinitions(renderer ContextRenderer, db *DB, repoRoot, wd string, staged []*ChangedFile) (string, error) {
+	var definitions []*ContextEntry
+	for _, file := range staged {
+		if file.Binary || file.NewText == "" {
+			continue
+		}
+
+		lines := changedLines(file.Diff())
+		if len(lines) == 0 {
+			continue
+		}
+
+		path, err := filepath.Rel(wd, filepath.Join(repoRoot, file.Path))
+		if err != nil {
+			return "", err
+		}
+
+		symbols, err := db.FindSymbolsInFile(path)
+		if err != nil {
+			return "", err
+		}
+		if len(symbols) == 0 {
+			continue
+		}
+
+		content, err := os.ReadFile(filepath.Join(repoRoot, file.Path))
+		if err != nil {
+			// Staged and then deleted from the working tree
+			continue
+		}
+
+		for _, symbol := range symbols {
+			symbolRange := symbol.Location.Range
+			for _, line := range lines {
+				if uint32(line) >= symbolRange.Start.Line && uint32(line) <= symbolRange.End.Line {
+					location := protocol.Location{URI: uri.File(filepath.Join(repoRoot, file.Path)), Range: symbolRange}
+					definitions = append(definitions, definitionEntry(wd, location, lsp.GetRangeFromFile(string(content), symbolRange)))
+					break
+				}
+			}
+		}
+	}
+
+	return renderer.RenderSection("Definitions", definitions)
+}
+
+// generateCommitMessage describes the changes staged in the repo containing
+// dir. wd is the workspace the index is for.
+func generateCommitMessage(ctx context.Context, llm *LLMClient, config *SagePathConfig, db *DB, model, dir, wd string) (string, error) {
+	repo, err := git.PlainOpenWithOptions(dir, &git.PlainOpenOptions{DetectDotGit: true})
+	if err != nil {
+		return "", err
+	}
+
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return "", err
+	}
+	repoRoot := worktree.Filesystem.Root()
+
+	staged, err := getStagedFiles(repo)
+	if err != nil {
+		return "", err
+	}
+	if len(staged) == 0 {
+		return "", fmt.Errorf("No changes are staged - stage some with git add first")
+	}
+
+	var diff strings.Builder
+	for _, file := range staged {
+		diff.WriteString(file.Diff())
+	}
+
+	models, err := config.Models.Get()
+	if err != nil {
+		return "", err
+	}
+
+	renderer, err := models.GetContextRenderer(model)
+	if err != nil {
+		return "", err
+	}
+
+	definitions, err := getChangedDefinitions(renderer, db, repoRoot, wd, staged)
+	if err != nil {
+		return "", err
+	}
+
+	prompt, err := config.Prompts.Render("commit", &PromptData{
+		Definitions: definitions,
+		Diff:        diff.String(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	response, err := llm.GenerateCompletion(ctx, model, prompt)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(stripCodeFences(response)), nil
+}
+
+// isCommitMessageFile is whether path is the file git opens in the editor for a commit message
+func isCommitMessageFile(path string) bool {
+	return filepath.Base(path) == "COMMIT_EDITMSG"
+}
+
+type GenerateCommitMessageArgs struct {
+	Filename uri.URI
+}
+
+var lspCommandGenerateCommitMessage = &CommandDefinition{
+	Title:          "Generate commit message",
+	ShowCodeAction: true,
+	Identifier:     "sage.commit.message",
+	BuildArgs: func(params *protocol.CodeActionParams) ([]any, error) {
+		args := &GenerateCommitMessageArgs{
+			Filename: params.TextDocument.URI,
+		}
+
+		return []any{args}, nil
+	},
+	CodeActionFilter: func(params *protocol.CodeActionParams, clientInfo *LanguageServerClientInfo) bool {
+		return isCommitMessageFile(params.TextDocument.URI.Filename())
+	},
+	Execute: func(params *protocol.ExecuteCommandParams, client LspClient, clientInfo *LanguageServerClientInfo) (*protocol.ApplyWorkspaceEditParams, error) {
+		lsLogger := globalLsLogger.With().Str("code_action", params.Command).Logger()
+		argBs, err := json.Marshal(params.Arguments[0])
+		if err != nil {
+			return nil, err
+		}
+
+		args := &GenerateCommitMessageArgs{}
+		err = json.Unmarshal(argBs, args)
+		if err != nil {
+			return nil, err
+		}
+
+		models, err := clientInfo.Config.Models.Get()
+		if err != nil {
+			return nil, err
+		}
+
+		model := *models.Default
+
+		lsLogger.Info().Str("model", model).Msg("Generating commit message")
+
+		client.Progress(context.TODO(), &protocol.ProgressParams{
+			Value: &protocol.WorkDoneProgressBegin{
+				Kind:    protocol.WorkDoneProgressKindBegin,
+				Title:   "Sage commit message",
+				Message: "reading staged changes...",
+			},
+		})
+
+		// COMMIT_EDITMSG lives in the .git dir, so this finds the repo it's for
+		message, err := generateCommitMessage(context.TODO(), clientInfo.LLM, clientInfo.Config, clientInfo.db, model, filepath.Dir(args.Filename.Filename()), clientInfo.wd)
+		if err != nil {
+			return nil, err
+		}
+
+		client.Progress(context.TODO(), &protocol.ProgressParams{
+			Value: &protocol.WorkDoneProgressEnd{
+				Kind:    protocol.WorkDoneProgressKindEnd,
+				Message: "Done!",
+			},
+		})
+
+		doc, ok := clientInfo.Docs.GetOpenDocument(args.Filename)
+		if !ok {
+			return nil, fmt.Errorf("%s was closed during generation", args.Filename.Filename())
+		}
+
+		// The message goes above git's comments about what's being committed
+		start := protocol.Position{}
+		return nil, applyGeneratedEdits(client, clientInfo, "sage: commit message", args.Filename, doc.Version, []protocol.TextEdit{
+			{
+				Range:   protocol.Range{Start: start, End: start},
+				NewText: message + "\n",
+			},
+		})
+	},
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+func TestChangedLines(t *testing.T) {
+	tests := []struct {
+		name     string
+		diff     string
+		expected []int
+	}{
+		{
+			name:     "Added lines",
+			diff:     "--- a/x\n+++ b/x\n@@ -1,2 +1,3 @@\n a\n+b\n c\n",
+			expected: []int{1},
+		},
+		{
+			name:     "Changed lines in a later hunk",
+			diff:     "--- a/x\n+++ b/x\n@@ -10,3 +10,3 @@\n a\n-b\n+B\n c\n@@ -20,1 +20,2 @@\n d\n+e\n",
+			expected: []int{10, 20},
+		},
+		{
+			name:     "Only deletions",
+			diff:     "--- a/x\n+++ b/x\n@@ -1,2 +1,1 @@\n a\n-b\n",
+			expected: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := changedLines(tt.diff)
+			if !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("Expected lines %v, but got %v", tt.expected, result)
+			}
+		})
+	}
+}
+
+func TestGetStagedFiles(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	worktree, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeAndAdd := func(name, content string) {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = worktree.Add(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeAndAdd("changed.go", "package main\n")
+	writeAndAdd("unchanged.go", "package main\n")
+	writeAndAdd("deleted.go", "package main\n")
+
+	_, err = worktree.Commit("Initial commit", &git.CommitOptions{
+		Author: &object.Signature{Name: "sage", Email: "sage@example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeAndAdd("changed.go", "package main\n\nfunc main() {}\n")
+	writeAndAdd("added.go", "package added\n")
+	_, err = worktree.Remove("deleted.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes that aren't staged don't count
+	err = os.WriteFile(filepath.Join(dir, "unchanged.go"), []byte("package other\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	staged, err := getStagedFiles(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []*ChangedFile{
+		{Path: "added.go", NewText: "package added\n"},
+		{Path: "changed.go", OldText: "package main\n", NewText: "package main\n\nfunc main() {}\n"},
+		{Path: "deleted.go", OldText: "package main\n"},
+	}
+
+	if !reflect.DeepEqual(staged, expected) {
+		t.Errorf("Expected staged files %+v, but got %+v", expected, staged)
+	}
+}
+
+func TestGetUncommittedFiles(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	worktree, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(name, content string) {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{"staged.go", "changed.go", "unchanged.go", "deleted.go"} {
+		write(name, "package main\n")
+		_, err = worktree.Add(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = worktree.Commit("Initial commit", &git.CommitOptions{
+		Author: &object.Signature{Name: "sage", Email: "sage@example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write("staged.go", "package staged\n")
+	_, err = worktree.Add("staged.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	write("changed.go", "package changed\n")
+	write("untracked.go", "package untracked\n")
+	err = os.Remove(filepath.Join(dir, "deleted.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changed, err := getUncommittedFiles(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []*ChangedFile{
+		{Path: "changed.go", OldText: "package main\n", NewText: "package changed\n"},
+		{Path: "deleted.go", OldText: "package main\n"},
+		{Path: "staged.go", OldText: "package main\n", NewText: "package staged\n"},
+	}
+
+	if !reflect.DeepEqual(changed, expected) {
+		t.Errorf("Expected uncommitted files %+v, but got %+v", expected, changed)
+	}
+}
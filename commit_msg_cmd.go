@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var CommitMsgCmd = &cobra.Command{
+	Use:   "commit-msg",
+	Short: "Write a commit message for the staged changes",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		wd, err := os.Getwd()
+		if err != nil {
+			panic(err)
+		}
+
+		config, err := getConfigForWd()
+		if err != nil {
+			return err
+		}
+
+		llm, err := NewLLMClient()
+		if err != nil {
+			return err
+		}
+
+		db, err := openDB(wd)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		models, err := config.Models.Get()
+		if err != nil {
+			return err
+		}
+
+		message, err := generateCommitMessage(context.TODO(), llm, config, db, *models.Default, wd, wd)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(message)
+		return nil
+	},
+}
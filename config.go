@@ -6,6 +6,7 @@ import (
 	"path/filepath"
 
 	"github.com/everestmz/sage/liveconf"
+	"github.com/everestmz/sage/locality"
 	"github.com/gobwas/glob"
 	"gopkg.in/yaml.v3"
 )
@@ -16,9 +17,30 @@ type SageLanguageConfig struct {
 }
 
 type SageModelsConfig struct {
-	Embedding   *string `yaml:"embedding,omitempty"`
-	Default     *string `yaml:"default,omitempty"`
-	ExplainCode *string `yaml:"explain_code,omitempty"`
+	Embedding        *string `yaml:"embedding,omitempty"`
+	Default          *string `yaml:"default,omitempty"`
+	ExplainCode      *string `yaml:"explain_code,omitempty"`
+	InlineCompletion *string `yaml:"inline_completion,omitempty"`
+	// Roughly how many tokens of context prompts can use, including the current
+	// file and context.txt. Definitions are added until it's used up.
+	ContextTokens *int `yaml:"context_tokens,omitempty"`
+	// How to format context for each model, by model name: xml, markdown or
+	// json. Models that aren't listed get xml.
+	ContextFormats map[string]ContextFormat `yaml:"context_formats,omitempty"`
+}
+
+// GetContextTokens is ContextTokens, or the default if it isn't set
+func (mc SageModelsConfig) GetContextTokens() int {
+	if mc.ContextTokens == nil || *mc.ContextTokens <= 0 {
+		return DefaultContextTokens
+	}
+
+	return *mc.ContextTokens
+}
+
+// GetContextRenderer returns the renderer for the model's context format
+func (mc SageModelsConfig) GetContextRenderer(model string) (ContextRenderer, error) {
+	return GetContextRenderer(mc.ContextFormats[model])
 }
 
 func NewPathConfig(name string) *SagePathConfig {
@@ -32,8 +54,18 @@ type SagePathConfig struct {
 	Path    *string  `yaml:"path"`
 	Include []string `yaml:"include"`
 	Exclude []string `yaml:"exclude"`
-	Models  *liveconf.ConfigWatcher[SageModelsConfig]
-	Context *liveconf.ConfigWatcher[[]*ContextItemProvider]
+	// Append an LLM explanation of the hovered symbol to hovers
+	HoverExplanations bool `yaml:"hover_explanations"`
+	Models            *liveconf.ConfigWatcher[SageModelsConfig]
+	Context           *ContextProfiles
+	Prompts           *PromptTemplates `yaml:"-"`
+	// Custom code actions, reloaded from sage.yaml when it changes
+	Actions *liveconf.ConfigWatcher[[]*CustomActionConfig] `yaml:"-"`
+	// How far to follow definitions when adding them to prompts
+	Locality locality.ExpandOptions `yaml:"locality"`
+	// Fail generations when a context.txt line can't be included, instead of
+	// leaving it out and warning about it
+	StrictContext bool `yaml:"strict_context"`
 
 	compiledIncludes []glob.Glob
 	compiledExcludes []glob.Glob
@@ -44,6 +76,84 @@ func (sc SagePathConfig) Name() string {
 	return sc.name
 }
 
+// BuildContext renders the workspace's context.txt in the format the model
+// wants. If api can report warnings about lines that were left out, it does.
+func (sc *SagePathConfig) BuildContext(api ContextApi, model string) (string, error) {
+	llmContext, _, err := sc.BuildContextEntries(api, model)
+	return llmContext, err
+}
+
+// BuildContextEntries is BuildContext, also returning the entries that were
+// rendered, so what's added to the prompt after them can leave out what they
+// already include
+func (sc *SagePathConfig) BuildContextEntries(api ContextApi, model string) (string, []*ContextEntry, error) {
+	built, err := sc.buildContext(api, model)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if reporter, ok := api.(ContextWarningReporter); ok {
+		reporter.ReportContextWarnings(built.profile, built.warnings)
+	}
+
+	return built.text, built.entries, nil
+}
+
+// BuildContextWithWarnings is BuildContext, returning the warnings and the
+// profile they're for instead of reporting them. There are never any with
+// StrictContext, which fails instead.
+func (sc *SagePathConfig) BuildContextWithWarnings(api ContextApi, model string) (string, string, []*ContextWarning, error) {
+	built, err := sc.buildContext(api, model)
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	return built.text, built.profile, built.warnings, nil
+}
+
+// builtContext is a context profile rendered for a model, and the lines of it
+// that were left out
+type builtContext struct {
+	text     string
+	entries  []*ContextEntry
+	profile  string
+	warnings []*ContextWarning
+}
+
+func (sc *SagePathConfig) buildContext(api ContextApi, model string) (*builtContext, error) {
+	profile, providers, err := sc.Context.Get()
+	if err != nil {
+		return nil, err
+	}
+
+	models, err := sc.Models.Get()
+	if err != nil {
+		return nil, err
+	}
+
+	renderer, err := models.GetContextRenderer(model)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, warnings, err := getContextEntries(providers, api, !sc.StrictContext)
+	if err != nil {
+		return nil, err
+	}
+
+	text, err := renderer.Render(entries)
+	if err != nil {
+		return nil, err
+	}
+
+	return &builtContext{
+		text:     text,
+		entries:  entries,
+		profile:  profile,
+		warnings: warnings,
+	}, nil
+}
+
 func (sc *SagePathConfig) InitDefaults() error {
 	if sc.Path != nil {
 		expandedPath := os.ExpandEnv(*sc.Path)
@@ -71,9 +181,11 @@ func (sc *SagePathConfig) InitDefaults() error {
 
 	modelsConfig := SageModelsConfig{}
 	defaultModelsConfig, err := yaml.Marshal(SageModelsConfig{
-		Default:     &DefaultModel,
-		ExplainCode: &DefaultExplainCodeModel,
-		Embedding:   &DefaultEmbeddingModel,
+		Default:          &DefaultModel,
+		ExplainCode:      &DefaultExplainCodeModel,
+		Embedding:        &DefaultEmbeddingModel,
+		InlineCompletion: &DefaultInlineCompletionModel,
+		ContextTokens:    &DefaultContextTokens,
 	})
 	if err != nil {
 		return err
@@ -83,17 +195,28 @@ func (sc *SagePathConfig) InitDefaults() error {
 		return err
 	}
 
-	providers := []*ContextItemProvider{}
-	sc.Context, err = liveconf.NewConfigWatcher[[]*ContextItemProvider](getWorkspaceContextPath(), "", &providers, func(data []byte, config any) error {
-		providersPtr := config.(*[]*ContextItemProvider)
-		providers, err := ParseContext(string(data))
-		if err != nil {
-			return err
-		}
+	wd, err := os.Getwd()
+	if err != nil {
+		panic(err)
+	}
 
-		*providersPtr = providers
-		return nil
-	})
+	sc.Context, err = NewContextProfiles(getWorkspaceDir(wd))
+	if err != nil {
+		return err
+	}
+
+	sc.Prompts, err = NewPromptTemplates()
+	if err != nil {
+		return err
+	}
+
+	configPath, err := getConfigFilePath()
+	if err != nil {
+		return err
+	}
+
+	actions := []*CustomActionConfig{}
+	sc.Actions, err = liveconf.NewConfigWatcher[[]*CustomActionConfig](configPath, "\n", &actions, loadCustomActions(sc.name))
 	if err != nil {
 		return err
 	}
@@ -115,6 +238,14 @@ func (sc *SagePathConfig) InitDefaults() error {
 		modelsConfig.ExplainCode = &DefaultExplainCodeModel
 	}
 
+	if modelsConfig.InlineCompletion == nil {
+		modelsConfig.InlineCompletion = &DefaultInlineCompletionModel
+	}
+
+	if modelsConfig.ContextTokens == nil {
+		modelsConfig.ContextTokens = &DefaultContextTokens
+	}
+
 	sc.Models.Set(modelsConfig)
 
 	return nil
@@ -142,9 +273,11 @@ func (sc SageConfig) GetConfigForDir(wd string) *SagePathConfig {
 }
 
 var (
-	DefaultModel            = "llama3.1:8b"
-	DefaultEmbeddingModel   = "nomic-embed-text"
-	DefaultExplainCodeModel = "starcoder2:3b"
+	DefaultModel                 = "llama3.1:8b"
+	DefaultEmbeddingModel        = "nomic-embed-text"
+	DefaultExplainCodeModel      = "starcoder2:3b"
+	DefaultInlineCompletionModel = "starcoder2:3b"
+	DefaultContextTokens         = 8192
 )
 
 func getConfigFromFile(path string) (SageConfig, error) {
@@ -202,7 +335,9 @@ func getDbsDir() string {
 	return filepath.Join(getConfigDir(), "dbs")
 }
 
-func getConfigFile() (SageConfig, error) {
+// getConfigFilePath returns the sage.yaml in the working directory if there is
+// one, or the global config file otherwise
+func getConfigFilePath() (string, error) {
 	configDir := getConfigDir()
 
 	wd, err := os.Getwd()
@@ -213,7 +348,7 @@ func getConfigFile() (SageConfig, error) {
 	wdPath := filepath.Join(wd, "sage.yaml")
 	info, err := os.Stat(wdPath)
 	if err == nil && !info.IsDir() {
-		return getConfigFromFile(wdPath)
+		return wdPath, nil
 	}
 
 	configPath := filepath.Join(configDir, "config.yaml")
@@ -221,19 +356,29 @@ func getConfigFile() (SageConfig, error) {
 	if os.IsNotExist(err) {
 		err = os.MkdirAll(configDir, 0755)
 		if err != nil {
-			return nil, err
+			return "", err
 		}
 		err = os.WriteFile(configPath, []byte("\n"), 0755)
 		if err != nil {
-			return nil, err
+			return "", err
 		}
 	} else if err != nil {
+		return "", err
+	}
+
+	return configPath, nil
+}
+
+func getConfigFile() (SageConfig, error) {
+	configPath, err := getConfigFilePath()
+	if err != nil {
 		return nil, err
 	}
 
 	return getConfigFromFile(configPath)
 }
 
+// getWorkspaceContextPath returns the context file for the workspace's active profile
 func getWorkspaceContextPath() string {
 	wd, err := os.Getwd()
 	if err != nil {
@@ -241,9 +386,7 @@ func getWorkspaceContextPath() string {
 	}
 
 	wsDir := getWorkspaceDir(wd)
-	contextFile := filepath.Join(wsDir, "context.txt")
-
-	return contextFile
+	return getContextProfilePath(wsDir, getActiveContextProfile(wsDir))
 }
 
 func getWorkspaceModelsPath() string {
@@ -258,6 +401,43 @@ func getWorkspaceModelsPath() string {
 	return modelsConfig
 }
 
+func getWorkspacePromptsPath() string {
+	wd, err := os.Getwd()
+	if err != nil {
+		panic(err)
+	}
+
+	wsDir := getWorkspaceDir(wd)
+	promptsConfig := filepath.Join(wsDir, "prompts.yaml")
+
+	return promptsConfig
+}
+
+func getWorkspaceChatPath() string {
+	wd, err := os.Getwd()
+	if err != nil {
+		panic(err)
+	}
+
+	wsDir := getWorkspaceDir(wd)
+	chatFile := filepath.Join(wsDir, "chat.md")
+
+	return chatFile
+}
+
+func getGlobalPromptsPath() string {
+	return filepath.Join(getConfigDir(), "prompts.yaml")
+}
+
+// getQueryDirs returns where to look for tree-sitter queries that extend
+// locality's built-in ones, globally and then for the workspace
+func getQueryDirs(wd string) []string {
+	return []string{
+		filepath.Join(getConfigDir(), "queries"),
+		filepath.Join(getWorkspaceDir(wd), "queries"),
+	}
+}
+
 func getConfigForWd() (*SagePathConfig, error) {
 	configs, err := getConfigFile()
 	if err != nil {
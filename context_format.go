@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// ContextFormat is how context items are written into prompts. Models
+// respond better to some formats than others, so it's set per model.
+type ContextFormat string
+
+const (
+	ContextFormatXML      ContextFormat = "xml"
+	ContextFormatMarkdown ContextFormat = "markdown"
+	ContextFormatJSON     ContextFormat = "json"
+)
+
+// ContextEntry is an item, along with the type of context.txt line it came from
+type ContextEntry struct {
+	Type ContextItemType
+	*ContextItem
+}
+
+// ContextRenderer writes context items into the text that goes in prompts
+type ContextRenderer interface {
+	Render(entries []*ContextEntry) (string, error)
+	// RenderSection renders entries grouped under a name, like Definitions.
+	// There's no section at all if there are no entries.
+	RenderSection(name string, entries []*ContextEntry) (string, error)
+}
+
+func GetContextRenderer(format ContextFormat) (ContextRenderer, error) {
+	switch format {
+	case "", ContextFormatXML:
+		return &XMLContextRenderer{}, nil
+	case ContextFormatMarkdown:
+		return &MarkdownContextRenderer{}, nil
+	case ContextFormatJSON:
+		return &JSONContextRenderer{}, nil
+	default:
+		return nil, fmt.Errorf("Unknown context format '%s' - try xml, markdown or json", format)
+	}
+}
+
+// contextItemTagName names what kind of item an entry is, for the formats that need one
+func contextItemTagName(itemType ContextItemType) (string, error) {
+	switch itemType {
+	case ContextItemTypeFile, ContextItemTypeGlob:
+		return "File", nil
+	case ContextItemTypeOpen:
+		return "OpenDocument", nil
+	case ContextItemTypeRecent:
+		return "RecentDocument", nil
+	case ContextItemTypeDiff:
+		return "UncommittedChanges", nil
+	case ContextItemTypeDiagnostics:
+		return "Errors", nil
+	case ContextItemTypeRange:
+		return "FileRange", nil
+	case ContextItemTypeSymbol:
+		return "FileSymbol", nil
+	case ContextItemTypeDefinition:
+		return "Definition", nil
+	case ContextItemTypeRecentEdit:
+		return "RecentEdit", nil
+	default:
+		return "", fmt.Errorf("Invalid item type '%s'", itemType)
+	}
+}
+
+// contextAttribute is a name and value, in the order they're written
+type contextAttribute struct {
+	name  string
+	value string
+}
+
+func contextAttributes(entry *ContextEntry) []contextAttribute {
+	var attributes []contextAttribute
+	if entry.Filename != "" {
+		attributes = append(attributes, contextAttribute{"file", entry.Filename})
+	}
+
+	switch entry.Type {
+	case ContextItemTypeRange, ContextItemTypeDefinition, ContextItemTypeRecentEdit:
+		attributes = append(attributes, contextAttribute{"range", entry.Identifier})
+	case ContextItemTypeSymbol:
+		attributes = append(attributes, contextAttribute{"symbol", entry.Identifier})
+	}
+
+	return attributes
+}
+
+// XMLContextRenderer writes each item as a tag, with its attributes escaped.
+// Content is left as-is, since models read code better without entities in it.
+type XMLContextRenderer struct{}
+
+func (XMLContextRenderer) Render(entries []*ContextEntry) (string, error) {
+	var builder strings.Builder
+	for _, entry := range entries {
+		tagName, err := contextItemTagName(entry.Type)
+		if err != nil {
+			return "", err
+		}
+
+		builder.WriteString("<" + tagName)
+		for _, attribute := range contextAttributes(entry) {
+			builder.WriteString(" " + attribute.name + "=\"")
+			err = xml.EscapeText(&builder, []byte(attribute.value))
+			if err != nil {
+				return "", err
+			}
+			builder.WriteString("\"")
+		}
+		builder.WriteString(">\n")
+		builder.WriteString(entry.Content)
+		builder.WriteString("\n</" + tagName + ">\n")
+	}
+
+	return builder.String(), nil
+}
+
+func (r XMLContextRenderer) RenderSection(name string, entries []*ContextEntry) (string, error) {
+	if len(entries) == 0 {
+		return "", nil
+	}
+
+	rendered, err := r.Render(entries)
+	if err != nil {
+		return "", err
+	}
+
+	return "<" + name + ">\n" + rendered + "</" + name + ">\n", nil
+}
+
+// MarkdownContextRenderer writes each item as a heading and a fenced code block
+type MarkdownContextRenderer struct{}
+
+// Languages for fences, by extension, where they aren't the same
+var markdownLanguages = map[string]string{
+	"py":  "python",
+	"js":  "javascript",
+	"ts":  "typescript",
+	"rb":  "ruby",
+	"rs":  "rust",
+	"sh":  "bash",
+	"yml": "yaml",
+	"md":  "markdown",
+	"h":   "c",
+	"hpp": "cpp",
+	"cc":  "cpp",
+}
+
+func markdownLanguage(entry *ContextEntry) string {
+	switch entry.Type {
+	case ContextItemTypeDiff:
+		return "diff"
+	case ContextItemTypeDiagnostics:
+		return "text"
+	}
+
+	ext := strings.TrimPrefix(filepath.Ext(entry.Filename), ".")
+	if language, ok := markdownLanguages[ext]; ok {
+		return language
+	}
+
+	return ext
+}
+
+func markdownHeading(entry *ContextEntry) string {
+	file := "`" + entry.Filename + "`"
+
+	switch entry.Type {
+	case ContextItemTypeOpen:
+		return "Open document " + file
+	case ContextItemTypeRecent:
+		return "Recently edited " + file
+	case ContextItemTypeDiff:
+		return "Uncommitted changes"
+	case ContextItemTypeDiagnostics:
+		return "Errors in " + file
+	case ContextItemTypeRange:
+		return "Lines " + entry.Identifier + " of " + file
+	case ContextItemTypeSymbol:
+		return "`" + entry.Identifier + "` in " + file
+	case ContextItemTypeDefinition:
+		return "Definition from lines " + entry.Identifier + " of " + file
+	case ContextItemTypeRecentEdit:
+		return "Recently edited lines " + entry.Identifier + " of " + file
+	default:
+		return file
+	}
+}
+
+// markdownFence is a fence longer than any run of backticks in content, so
+// code with its own fences in it doesn't end the block early
+func markdownFence(content string) string {
+	longest, run := 0, 0
+	for _, r := range content {
+		if r == '`' {
+			run++
+			longest = max(longest, run)
+		} else {
+			run = 0
+		}
+	}
+
+	return strings.Repeat("`", max(3, longest+1))
+}
+
+func (MarkdownContextRenderer) Render(entries []*ContextEntry) (string, error) {
+	var builder strings.Builder
+	for _, entry := range entries {
+		// Checked for consistency with the other formats
+		_, err := contextItemTagName(entry.Type)
+		if err != nil {
+			return "", err
+		}
+
+		fence := markdownFence(entry.Content)
+		builder.WriteString("### " + markdownHeading(entry) + "\n\n")
+		builder.WriteString(fence + markdownLanguage(entry) + "\n")
+		builder.WriteString(entry.Content)
+		if !strings.HasSuffix(entry.Content, "\n") {
+			builder.WriteString("\n")
+		}
+		builder.WriteString(fence + "\n\n")
+	}
+
+	return builder.String(), nil
+}
+
+func (r MarkdownContextRenderer) RenderSection(name string, entries []*ContextEntry) (string, error) {
+	if len(entries) == 0 {
+		return "", nil
+	}
+
+	rendered, err := r.Render(entries)
+	if err != nil {
+		return "", err
+	}
+
+	return "## " + name + "\n\n" + rendered, nil
+}
+
+// JSONContextRenderer writes the items as an array of objects
+type JSONContextRenderer struct{}
+
+type jsonContextItem struct {
+	Type    string `json:"type"`
+	File    string `json:"file,omitempty"`
+	Range   string `json:"range,omitempty"`
+	Symbol  string `json:"symbol,omitempty"`
+	Content string `json:"content"`
+}
+
+func jsonContextItems(entries []*ContextEntry) ([]*jsonContextItem, error) {
+	items := []*jsonContextItem{}
+	for _, entry := range entries {
+		tagName, err := contextItemTagName(entry.Type)
+		if err != nil {
+			return nil, err
+		}
+
+		item := &jsonContextItem{
+			Type:    tagName,
+			File:    entry.Filename,
+			Content: entry.Content,
+		}
+		switch entry.Type {
+		case ContextItemTypeRange, ContextItemTypeDefinition, ContextItemTypeRecentEdit:
+			item.Range = entry.Identifier
+		case ContextItemTypeSymbol:
+			item.Symbol = entry.Identifier
+		}
+
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+// encodeJSON indents, and leaves code alone. Code is full of <, > and &, and
+// models read it better unescaped.
+func encodeJSON(value any) (string, error) {
+	var builder strings.Builder
+	encoder := json.NewEncoder(&builder)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(value)
+	if err != nil {
+		return "", err
+	}
+
+	return builder.String(), nil
+}
+
+func (JSONContextRenderer) Render(entries []*ContextEntry) (string, error) {
+	if len(entries) == 0 {
+		return "", nil
+	}
+
+	items, err := jsonContextItems(entries)
+	if err != nil {
+		return "", err
+	}
+
+	return encodeJSON(items)
+}
+
+// RenderSection writes an object with the items under the section's name
+func (JSONContextRenderer) RenderSection(name string, entries []*ContextEntry) (string, error) {
+	if len(entries) == 0 {
+		return "", nil
+	}
+
+	items, err := jsonContextItems(entries)
+	if err != nil {
+		return "", err
+	}
+
+	return encodeJSON(map[string]any{strings.ToLower(name): items})
+}
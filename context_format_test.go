@@ -0,0 +1,180 @@
+package main
+
+import "testing"
+
+func TestContextRenderers(t *testing.T) {
+	entries := []*ContextEntry{
+		{
+			Type:        ContextItemTypeSymbol,
+			ContextItem: &ContextItem{Filename: `pkg/"quoted" & <odd>.go`, Identifier: "Run", Content: "func Run() {}"},
+		},
+		{
+			Type:        ContextItemTypeRange,
+			ContextItem: &ContextItem{Filename: "README.md", Identifier: "1:3", Content: "```sh\nmake\n```\n"},
+		},
+		{
+			Type:        ContextItemTypeDiff,
+			ContextItem: &ContextItem{Content: "+added"},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		format   ContextFormat
+		expected string
+	}{
+		{
+			name:   "XML",
+			format: ContextFormatXML,
+			expected: `<FileSymbol file="pkg/&#34;quoted&#34; &amp; &lt;odd&gt;.go" symbol="Run">
+func Run() {}
+</FileSymbol>
+<FileRange file="README.md" range="1:3">
+` + "```sh\nmake\n```\n" + `
+</FileRange>
+<UncommittedChanges>
++added
+</UncommittedChanges>
+`,
+		},
+		{
+			name:   "Markdown",
+			format: ContextFormatMarkdown,
+			expected: "### `Run` in `pkg/\"quoted\" & <odd>.go`\n\n```go\nfunc Run() {}\n```\n\n" +
+				"### Lines 1:3 of `README.md`\n\n````markdown\n```sh\nmake\n```\n````\n\n" +
+				"### Uncommitted changes\n\n```diff\n+added\n```\n\n",
+		},
+		{
+			name:   "JSON",
+			format: ContextFormatJSON,
+			expected: `[
+  {
+    "type": "FileSymbol",
+    "file": "pkg/\"quoted\" & <odd>.go",
+    "symbol": "Run",
+    "content": "func Run() {}"
+  },
+  {
+    "type": "FileRange",
+    "file": "README.md",
+    "range": "1:3",
+    "content": "` + "```sh\\nmake\\n```\\n" + `"
+  },
+  {
+    "type": "UncommittedChanges",
+    "content": "+added"
+  }
+]
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			renderer, err := GetContextRenderer(tt.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			result, err := renderer.Render(entries)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if result != tt.expected {
+				t.Errorf("Expected context %q, but got %q", tt.expected, result)
+			}
+		})
+	}
+}
+
+func TestGetContextRenderer(t *testing.T) {
+	tests := []struct {
+		name    string
+		models  SageModelsConfig
+		model   string
+		wantErr bool
+	}{
+		{"Unlisted models get XML", SageModelsConfig{}, "llama3.1:8b", false},
+		{"Listed model", SageModelsConfig{ContextFormats: map[string]ContextFormat{"llama3.1:8b": ContextFormatMarkdown}}, "llama3.1:8b", false},
+		{"Unknown format", SageModelsConfig{ContextFormats: map[string]ContextFormat{"llama3.1:8b": "yaml"}}, "llama3.1:8b", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.models.GetContextRenderer(tt.model)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("GetContextRenderer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestContextRenderSection(t *testing.T) {
+	entries := []*ContextEntry{
+		{
+			Type:        ContextItemTypeDefinition,
+			ContextItem: &ContextItem{Filename: `a "b".go`, Identifier: "3:5", Content: "type T int"},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		format   ContextFormat
+		entries  []*ContextEntry
+		expected string
+	}{
+		{
+			name:     "XML",
+			format:   ContextFormatXML,
+			entries:  entries,
+			expected: "<Definitions>\n<Definition file=\"a &#34;b&#34;.go\" range=\"3:5\">\ntype T int\n</Definition>\n</Definitions>\n",
+		},
+		{
+			name:     "Markdown",
+			format:   ContextFormatMarkdown,
+			entries:  entries,
+			expected: "## Definitions\n\n### Definition from lines 3:5 of `a \"b\".go`\n\n```go\ntype T int\n```\n\n",
+		},
+		{
+			name:    "JSON",
+			format:  ContextFormatJSON,
+			entries: entries,
+			expected: `{
+  "definitions": [
+    {
+      "type": "Definition",
+      "file": "a \"b\".go",
+      "range": "3:5",
+      "content": "type T int"
+    }
+  ]
+}
+`,
+		},
+		{
+			name:     "Nothing to render",
+			format:   ContextFormatJSON,
+			entries:  nil,
+			expected: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			renderer, err := GetContextRenderer(tt.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			result, err := renderer.RenderSection("Definitions", tt.entries)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if result != tt.expected {
+				t.Errorf("Expected section %q, but got %q", tt.expected, result)
+			}
+		})
+	}
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"go.lsp.dev/protocol"
+	"go.lsp.dev/uri"
+)
+
+// We're already the language server for everything else, so we help with
+// writing context.txt too: completion, diagnostics, hovers and definitions.
+
+var contextDirectives = []string{"@open", "@recent", "@diff", "@diagnostics"}
+
+func isContextDocument(docUri uri.URI) bool {
+	return docUri.Filename() == getWorkspaceContextPath()
+}
+
+// contextPartAt is the index of the part of a line that character is in, or
+// right at the end of
+func contextPartAt(spans []linePart, character int) (int, bool) {
+	for i, span := range spans {
+		if character >= span.start && character <= span.end {
+			return i, true
+		}
+	}
+
+	return 0, false
+}
+
+// contextProviderPart is the index of the part of the line that the provider
+// at index came from. Files with symbols or ranges get a provider for each.
+func contextProviderPart(provider *ContextItemProvider, index int) int {
+	switch provider.Type() {
+	case ContextItemTypeSymbol, ContextItemTypeRange:
+		return index + 1
+	default:
+		return 0
+	}
+}
+
+func contextDiagnostic(line int, span linePart, severity protocol.DiagnosticSeverity, message string) protocol.Diagnostic {
+	return protocol.Diagnostic{
+		Range: protocol.Range{
+			Start: protocol.Position{Line: uint32(line), Character: uint32(span.start)},
+			End:   protocol.Position{Line: uint32(line), Character: uint32(span.end)},
+		},
+		Severity: severity,
+		Source:   "sage",
+		Message:  message,
+	}
+}
+
+// checkContextDocument finds the lines of context.txt that don't parse, and the
+// files, symbols and ranges in it that can't be found
+func checkContextDocument(text string, api ContextApi) []protocol.Diagnostic {
+	diagnostics := []protocol.Diagnostic{}
+	for lineNumber, line := range strings.Split(text, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+
+		providers, err := parseContextLine(line)
+		if err != nil {
+			// These break the whole file, not just the line
+			diagnostics = append(diagnostics, contextDiagnostic(lineNumber, linePart{end: len(line)}, protocol.DiagnosticSeverityError, err.Error()))
+			continue
+		}
+
+		// It parsed, so this can't fail
+		spans, _ := getLinePartSpans(line)
+
+		for i, provider := range providers {
+			switch provider.Type() {
+			case ContextItemTypeFile, ContextItemTypeSymbol, ContextItemTypeRange:
+			default:
+				// Globs and directives can take a while to expand, and it's
+				// fine for them to be empty
+				continue
+			}
+
+			_, err := provider.GetItems(api)
+			if err != nil {
+				span := spans[contextProviderPart(provider, i)]
+				diagnostics = append(diagnostics, contextDiagnostic(lineNumber, span, protocol.DiagnosticSeverityWarning, "Left out of the context: "+err.Error()))
+			}
+		}
+	}
+
+	return diagnostics
+}
+
+// publishContextDiagnostics points out what's wrong with context.txt. While
+// it's open we check what's in the editor as it changes, and otherwise we show
+// what was left out the last time the context was built.
+func (ci *LanguageServerClientInfo) publishContextDiagnostics() {
+	contextUri := uri.File(getWorkspaceContextPath())
+
+	var diagnostics []protocol.Diagnostic
+	if doc, ok := ci.Docs.GetOpenDocument(contextUri); ok {
+		diagnostics = checkContextDocument(doc.Text, ci)
+	} else {
+		ci.contextWarningsLock.Lock()
+		if ci.contextWarningsProfile == ci.Config.Context.Active() {
+			diagnostics = contextWarningDiagnostics(ci.contextWarnings)
+		} else {
+			// They're for a profile that's been switched away from, maybe by sage ctx
+			diagnostics = []protocol.Diagnostic{}
+		}
+		ci.contextWarningsLock.Unlock()
+	}
+
+	err := ci.client.PublishDiagnostics(context.TODO(), &protocol.PublishDiagnosticsParams{
+		URI:         contextUri,
+		Diagnostics: diagnostics,
+	})
+	if err != nil {
+		globalLsLogger.Error().Err(err).Msg("Error publishing context.txt diagnostics")
+	}
+}
+
+// contextDocumentLine gets the line of context.txt at a position, and where
+// in the line the position is
+func (ci *LanguageServerClientInfo) contextDocumentLine(params protocol.TextDocumentPositionParams) (string, int, bool) {
+	doc, ok := ci.Docs.GetOpenDocument(params.TextDocument.URI)
+	if !ok {
+		return "", 0, false
+	}
+
+	lines := strings.Split(doc.Text, "\n")
+	if int(params.Position.Line) >= len(lines) {
+		return "", 0, false
+	}
+
+	line := strings.TrimSuffix(lines[params.Position.Line], "\r")
+	return line, min(int(params.Position.Character), len(line)), true
+}
+
+// contextCompletions completes paths and directives at the start of a line, and
+// the file's symbols after it
+func (ci *LanguageServerClientInfo) contextCompletions(params *protocol.CompletionParams) ([]protocol.CompletionItem, error) {
+	line, character, ok := ci.contextDocumentLine(params.TextDocumentPositionParams)
+	if !ok {
+		return nil, nil
+	}
+
+	spans, err := getLinePartSpans(line[:character])
+	if err != nil {
+		// In the middle of a quoted part
+		return nil, nil
+	}
+
+	// The part being typed, which the completion replaces
+	current := linePart{start: character, end: character}
+	if len(spans) > 0 && spans[len(spans)-1].end == character {
+		current = spans[len(spans)-1]
+		spans = spans[:len(spans)-1]
+	}
+
+	replace := protocol.Range{
+		Start: protocol.Position{Line: params.Position.Line, Character: uint32(current.start)},
+		End:   protocol.Position{Line: params.Position.Line, Character: uint32(character)},
+	}
+
+	if len(spans) == 0 {
+		if strings.HasPrefix(current.text, "@") {
+			return completeContextDirective(current.text, replace), nil
+		}
+
+		return completeContextPath(ci.wd, current.text, replace)
+	}
+
+	filename := spans[0].text
+	if isContextGlob(filename) || strings.HasPrefix(filename, "@") {
+		return nil, nil
+	}
+
+	symbols, err := ci.db.FindSymbolsInFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	items := []protocol.CompletionItem{}
+	seen := map[string]bool{}
+	for _, symbol := range symbols {
+		if !strings.HasPrefix(symbol.Name, current.text) || seen[symbol.Name] {
+			continue
+		}
+		seen[symbol.Name] = true
+
+		items = append(items, protocol.CompletionItem{
+			Label:    symbol.Name,
+			Kind:     protocol.CompletionItemKindReference,
+			Detail:   symbol.Kind.String(),
+			TextEdit: &protocol.TextEdit{Range: replace, NewText: symbol.Name},
+		})
+	}
+
+	return items, nil
+}
+
+func completeContextDirective(prefix string, replace protocol.Range) []protocol.CompletionItem {
+	items := []protocol.CompletionItem{}
+	for _, directive := range contextDirectives {
+		if !strings.HasPrefix(directive, prefix) {
+			continue
+		}
+
+		items = append(items, protocol.CompletionItem{
+			Label:    directive,
+			Kind:     protocol.CompletionItemKindKeyword,
+			TextEdit: &protocol.TextEdit{Range: replace, NewText: directive},
+		})
+	}
+
+	return items
+}
+
+// completeContextPath completes a path relative to the workspace, one
+// directory at a time
+func completeContextPath(wd, prefix string, replace protocol.Range) ([]protocol.CompletionItem, error) {
+	dir, base := path.Split(prefix)
+
+	entries, err := os.ReadDir(filepath.Join(wd, dir))
+	if os.IsNotExist(err) {
+		// Still typing the directory
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	items := []protocol.CompletionItem{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, base) {
+			continue
+		}
+
+		// Dotfiles only when they're asked for, which keeps .git out of the way
+		if strings.HasPrefix(name, ".") && !strings.HasPrefix(base, ".") {
+			continue
+		}
+
+		item := protocol.CompletionItem{
+			Label: name,
+			Kind:  protocol.CompletionItemKindFile,
+		}
+		if entry.IsDir() {
+			item.Label += "/"
+			item.Kind = protocol.CompletionItemKindFolder
+		}
+
+		item.FilterText = dir + item.Label
+		item.TextEdit = &protocol.TextEdit{Range: replace, NewText: dir + item.Label}
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+// describeContextItems says how much of the context some items take up
+func describeContextItems(items []*ContextItem) string {
+	size, tokens := 0, 0
+	for _, item := range items {
+		size += len(item.Content)
+		tokens += estimateTokens(item.Content)
+	}
+
+	itemsWord := "items"
+	if len(items) == 1 {
+		itemsWord = "item"
+	}
+
+	sizeStr := fmt.Sprintf("%d bytes", size)
+	if size >= 1024 {
+		sizeStr = fmt.Sprintf("%.1f KB", float64(size)/1024)
+	}
+
+	return fmt.Sprintf("%d %s, %s (~%d tokens)", len(items), itemsWord, sizeStr, tokens)
+}
+
+// contextHover shows how big what a line (or the symbol or range under the
+// cursor) resolves to is
+func (ci *LanguageServerClientInfo) contextHover(params *protocol.HoverParams) (*protocol.Hover, error) {
+	line, character, ok := ci.contextDocumentLine(params.TextDocumentPositionParams)
+	if !ok {
+		return nil, nil
+	}
+
+	providers, err := parseContextLine(line)
+	if err != nil || len(providers) == 0 {
+		// Errors are in the diagnostics
+		return nil, nil
+	}
+
+	spans, _ := getLinePartSpans(line)
+	index, ok := contextPartAt(spans, character)
+	if !ok {
+		return nil, nil
+	}
+
+	hovered := providers
+	if index > 0 && contextProviderPart(providers[0], 0) > 0 {
+		hovered = providers[index-1 : index]
+	}
+
+	var items []*ContextItem
+	for _, provider := range hovered {
+		providerItems, err := provider.GetItems(ci)
+		if err != nil {
+			return contextHoverResult(params, spans[index], "Left out of the context: "+err.Error()), nil
+		}
+
+		items = append(items, providerItems...)
+	}
+
+	return contextHoverResult(params, spans[index], describeContextItems(items)), nil
+}
+
+func contextHoverResult(params *protocol.HoverParams, span linePart, text string) *protocol.Hover {
+	return &protocol.Hover{
+		Contents: protocol.MarkupContent{
+			Kind:  protocol.Markdown,
+			Value: text,
+		},
+		Range: &protocol.Range{
+			Start: protocol.Position{Line: params.Position.Line, Character: uint32(span.start)},
+			End:   protocol.Position{Line: params.Position.Line, Character: uint32(span.end)},
+		},
+	}
+}
+
+// contextDefinition jumps to the file, symbol or range under the cursor
+func (ci *LanguageServerClientInfo) contextDefinition(params *protocol.DefinitionParams) ([]protocol.Location, error) {
+	line, character, ok := ci.contextDocumentLine(params.TextDocumentPositionParams)
+	if !ok {
+		return nil, nil
+	}
+
+	providers, err := parseContextLine(line)
+	if err != nil || len(providers) == 0 {
+		return nil, nil
+	}
+
+	spans, _ := getLinePartSpans(line)
+	index, ok := contextPartAt(spans, character)
+	if !ok {
+		return nil, nil
+	}
+
+	filename := spans[0].text
+	if isContextGlob(filename) || strings.HasPrefix(filename, "@") {
+		return nil, nil
+	}
+
+	fileUri := uri.File(filepath.Join(ci.wd, filename))
+	if index == 0 {
+		_, err := ci.GetFile(filename)
+		if err != nil {
+			// Nowhere to go, and the diagnostics say so
+			return nil, nil
+		}
+
+		return []protocol.Location{{URI: fileUri}}, nil
+	}
+
+	part := spans[index].text
+	if strings.Contains(part, ":") {
+		start, end, err := parseRange(part)
+		if err != nil {
+			return nil, nil
+		}
+
+		// Ranges are one-based and inclusive
+		return []protocol.Location{{
+			URI: fileUri,
+			Range: protocol.Range{
+				Start: protocol.Position{Line: uint32(max(start-1, 0))},
+				End:   protocol.Position{Line: uint32(end)},
+			},
+		}}, nil
+	}
+
+	symbol, err := ci.findContextSymbol(filename, part)
+	if err != nil {
+		return nil, nil
+	}
+
+	return []protocol.Location{symbol.Location}, nil
+}
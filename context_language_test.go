@@ -0,0 +1,178 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"go.lsp.dev/protocol"
+)
+
+func TestGetLinePartSpans(t *testing.T) {
+	tests := []struct {
+		name     string
+		line     string
+		expected []linePart
+	}{
+		{
+			name: "Plain parts",
+			line: "file.go  Foo 1:2",
+			expected: []linePart{
+				{text: "file.go", start: 0, end: 7},
+				{text: "Foo", start: 9, end: 12},
+				{text: "1:2", start: 13, end: 16},
+			},
+		},
+		{
+			name: "Quoted part",
+			line: `"my file.go" Foo`,
+			expected: []linePart{
+				{text: "my file.go", start: 0, end: 12},
+				{text: "Foo", start: 13, end: 16},
+			},
+		},
+		{
+			name:     "Just spaces",
+			line:     "   ",
+			expected: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spans, err := getLinePartSpans(tt.line)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(spans, tt.expected) {
+				t.Errorf("Expected spans %+v, but got %+v", tt.expected, spans)
+			}
+		})
+	}
+}
+
+func TestCheckContextDocument(t *testing.T) {
+	mockApi := &MockContextApi{
+		missingFiles:   map[string]bool{"gone.go": true},
+		missingSymbols: map[string]bool{"Gone": true},
+	}
+
+	text := "a.go\ngone.go\n\nb.go Here Gone\nc.go 3:1\n@diff\n   \n"
+	diagnostics := checkContextDocument(text, mockApi)
+
+	diagnostic := func(line, start, end int, severity protocol.DiagnosticSeverity, message string) protocol.Diagnostic {
+		return protocol.Diagnostic{
+			Range: protocol.Range{
+				Start: protocol.Position{Line: uint32(line), Character: uint32(start)},
+				End:   protocol.Position{Line: uint32(line), Character: uint32(end)},
+			},
+			Severity: severity,
+			Source:   "sage",
+			Message:  message,
+		}
+	}
+
+	expected := []protocol.Diagnostic{
+		diagnostic(1, 0, 7, protocol.DiagnosticSeverityWarning, "Left out of the context: open gone.go: no such file or directory"),
+		diagnostic(3, 10, 14, protocol.DiagnosticSeverityWarning, "Left out of the context: Couldn't find symbol Gone in b.go"),
+		diagnostic(4, 0, 8, protocol.DiagnosticSeverityError, "Start cannot be greater than end of range '3:1'"),
+	}
+
+	if !reflect.DeepEqual(diagnostics, expected) {
+		t.Errorf("Expected diagnostics %+v, but got %+v", expected, diagnostics)
+	}
+}
+
+func TestCompleteContextPath(t *testing.T) {
+	wd := t.TempDir()
+	for _, dir := range []string{"pkg", ".git", "docs"} {
+		err := os.Mkdir(filepath.Join(wd, dir), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"main.go", "pkg/parse.go", "pkg/print.go", "pkg/.hidden"} {
+		err := os.WriteFile(filepath.Join(wd, file), nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		prefix   string
+		expected []string
+	}{
+		{
+			name:     "Top level",
+			prefix:   "",
+			expected: []string{"docs/", "main.go", "pkg/"},
+		},
+		{
+			name:     "In a directory",
+			prefix:   "pkg/pr",
+			expected: []string{"pkg/print.go"},
+		},
+		{
+			name:     "Dotfiles when asked for",
+			prefix:   "pkg/.",
+			expected: []string{"pkg/.hidden"},
+		},
+		{
+			name:     "Missing directory",
+			prefix:   "nope/",
+			expected: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items, err := completeContextPath(wd, tt.prefix, protocol.Range{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var completions []string
+			for _, item := range items {
+				completions = append(completions, item.TextEdit.NewText)
+			}
+
+			if !reflect.DeepEqual(completions, tt.expected) {
+				t.Errorf("Expected completions %q, but got %q", tt.expected, completions)
+			}
+		})
+	}
+}
+
+func TestDescribeContextItems(t *testing.T) {
+	tests := []struct {
+		name     string
+		items    []*ContextItem
+		expected string
+	}{
+		{
+			name:     "One item",
+			items:    []*ContextItem{{Content: "package main\n"}},
+			expected: "1 item, 13 bytes (~4 tokens)",
+		},
+		{
+			name: "Kilobytes",
+			items: []*ContextItem{
+				{Content: string(make([]byte, 1024))},
+				{Content: string(make([]byte, 512))},
+			},
+			expected: "2 items, 1.5 KB (~384 tokens)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			description := describeContextItems(tt.items)
+			if description != tt.expected {
+				t.Errorf("Expected description %q, but got %q", tt.expected, description)
+			}
+		})
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/everestmz/sage/liveconf"
+	"go.lsp.dev/protocol"
+	"go.lsp.dev/uri"
+)
+
+// Context profiles are named context files for a workspace, so each task you're
+// working on in it can have its own context. The default profile is the
+// workspace's context.txt, and the rest live in contexts/. Which one is active
+// is kept in the workspace dir, so sage ctx and the language server agree.
+
+const defaultContextProfile = "default"
+
+var contextProfileNameRegex = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+
+func validateContextProfileName(name string) error {
+	if !contextProfileNameRegex.MatchString(name) {
+		return fmt.Errorf("Invalid context profile name '%s' - use letters, numbers, '.', '-' and '_'", name)
+	}
+
+	return nil
+}
+
+func getContextProfilePath(wsDir, name string) string {
+	if name == defaultContextProfile {
+		return filepath.Join(wsDir, "context.txt")
+	}
+
+	return filepath.Join(wsDir, "contexts", name+".txt")
+}
+
+func getActiveContextProfilePath(wsDir string) string {
+	return filepath.Join(wsDir, "context_profile")
+}
+
+// getActiveContextProfile returns the workspace's active profile, or the
+// default if it hasn't switched to one
+func getActiveContextProfile(wsDir string) string {
+	content, err := os.ReadFile(getActiveContextProfilePath(wsDir))
+	if err != nil {
+		return defaultContextProfile
+	}
+
+	name := strings.TrimSpace(string(content))
+	if validateContextProfileName(name) != nil {
+		return defaultContextProfile
+	}
+
+	return name
+}
+
+// setActiveContextProfile switches the workspace to a profile, creating an
+// empty one if it doesn't exist yet
+func setActiveContextProfile(wsDir, name string) error {
+	err := validateContextProfileName(name)
+	if err != nil {
+		return err
+	}
+
+	path := getContextProfilePath(wsDir, name)
+	_, err = os.Stat(path)
+	if os.IsNotExist(err) {
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return err
+		}
+
+		err = os.WriteFile(path, nil, 0644)
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(getActiveContextProfilePath(wsDir), []byte(name+"\n"), 0644)
+}
+
+// listContextProfiles returns the workspace's profiles, default first
+func listContextProfiles(wsDir string) ([]string, error) {
+	profiles := []string{defaultContextProfile}
+
+	entries, err := os.ReadDir(filepath.Join(wsDir, "contexts"))
+	if os.IsNotExist(err) {
+		return profiles, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var named []string
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".txt")
+		if !ok || entry.IsDir() || validateContextProfileName(name) != nil || name == defaultContextProfile {
+			continue
+		}
+
+		named = append(named, name)
+	}
+	sort.Strings(named)
+
+	return append(profiles, named...), nil
+}
+
+// loadContextProviders never fails, so a bad line can't stop the rest of
+// the context from loading. It fails when it's built instead.
+func loadContextProviders(data []byte, config any) error {
+	*config.(*[]*ContextItemProvider) = ParseContextLenient(string(data))
+	return nil
+}
+
+// ContextProfiles loads whichever of a workspace's context profiles is
+// active, reloading each one when it changes
+type ContextProfiles struct {
+	wsDir string
+
+	lock     sync.Mutex
+	watchers map[string]*liveconf.ConfigWatcher[[]*ContextItemProvider]
+}
+
+func NewContextProfiles(wsDir string) (*ContextProfiles, error) {
+	cp := &ContextProfiles{
+		wsDir:    wsDir,
+		watchers: map[string]*liveconf.ConfigWatcher[[]*ContextItemProvider]{},
+	}
+
+	_, _, err := cp.Get()
+	if err != nil {
+		return nil, err
+	}
+
+	return cp, nil
+}
+
+// Active is the name of the active profile. It's read each time, since sage
+// ctx can switch it from outside the language server.
+func (cp *ContextProfiles) Active() string {
+	return getActiveContextProfile(cp.wsDir)
+}
+
+func (cp *ContextProfiles) Path(name string) string {
+	return getContextProfilePath(cp.wsDir, name)
+}
+
+func (cp *ContextProfiles) Switch(name string) error {
+	return setActiveContextProfile(cp.wsDir, name)
+}
+
+func (cp *ContextProfiles) List() ([]string, error) {
+	return listContextProfiles(cp.wsDir)
+}
+
+// Get returns the active profile's name and context. Anything that reports on
+// the context should use this name, since the profile can be switched while
+// it's being built.
+func (cp *ContextProfiles) Get() (string, []*ContextItemProvider, error) {
+	name := cp.Active()
+
+	cp.lock.Lock()
+	watcher, ok := cp.watchers[name]
+	if !ok {
+		providers := []*ContextItemProvider{}
+		var err error
+		watcher, err = liveconf.NewConfigWatcher[[]*ContextItemProvider](cp.Path(name), "", &providers, loadContextProviders)
+		if err != nil {
+			cp.lock.Unlock()
+			return "", nil, err
+		}
+
+		cp.watchers[name] = watcher
+	}
+	cp.lock.Unlock()
+
+	providers, err := watcher.Get()
+	return name, providers, err
+}
+
+// formatContextProfiles lists the profiles, marking the active one
+func formatContextProfiles(profiles []string, active string) string {
+	var lines []string
+	for _, profile := range profiles {
+		if profile == active {
+			lines = append(lines, "* "+profile)
+		} else {
+			lines = append(lines, "  "+profile)
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// switchContextProfile switches profiles, moving context.txt's diagnostics over
+// to the new profile's file
+func (ci *LanguageServerClientInfo) switchContextProfile(name string) error {
+	oldUri := uri.File(getWorkspaceContextPath())
+
+	err := ci.Config.Context.Switch(name)
+	if err != nil {
+		return err
+	}
+
+	// What was left out of the old profile doesn't matter any more
+	ci.contextWarningsLock.Lock()
+	ci.contextWarnings = nil
+	ci.contextWarningsProfile = name
+	ci.contextWarningsLock.Unlock()
+
+	if ci.client == nil {
+		return nil
+	}
+
+	err = ci.client.PublishDiagnostics(context.TODO(), &protocol.PublishDiagnosticsParams{
+		URI:         oldUri,
+		Diagnostics: []protocol.Diagnostic{},
+	})
+	if err != nil {
+		return err
+	}
+
+	ci.publishContextDiagnostics()
+	return nil
+}
+
+type SwitchContextProfileArgs struct {
+	Profile string
+}
+
+var lspCommandSwitchContextProfile = &CommandDefinition{
+	Title:          "Switch context profile",
+	ShowCodeAction: false,
+	Identifier:     "sage.workspace.context.profile.switch",
+	BuildArgs: func(params *protocol.CodeActionParams) ([]any, error) {
+		return []any{}, nil
+	},
+	Execute: func(params *protocol.ExecuteCommandParams, client LspClient, clientInfo *LanguageServerClientInfo) (*protocol.ApplyWorkspaceEditParams, error) {
+		args := &SwitchContextProfileArgs{}
+		if len(params.Arguments) > 0 {
+			argBs, err := json.Marshal(params.Arguments[0])
+			if err != nil {
+				return nil, err
+			}
+
+			err = json.Unmarshal(argBs, args)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if args.Profile == "" {
+			// Let them pick one of the existing profiles
+			profiles, err := clientInfo.Config.Context.List()
+			if err != nil {
+				return nil, err
+			}
+
+			var actions []protocol.MessageActionItem
+			for _, profile := range profiles {
+				actions = append(actions, protocol.MessageActionItem{Title: profile})
+			}
+
+			choice, err := client.ShowMessageRequest(context.TODO(), &protocol.ShowMessageRequestParams{
+				Type:    protocol.MessageTypeInfo,
+				Message: fmt.Sprintf("Switch from context profile '%s' to:", clientInfo.Config.Context.Active()),
+				Actions: actions,
+			})
+			if err != nil {
+				return nil, err
+			}
+			if choice == nil {
+				// Dismissed
+				return nil, nil
+			}
+
+			args.Profile = choice.Title
+		}
+
+		client.Progress(context.TODO(), &protocol.ProgressParams{
+			Value: &protocol.WorkDoneProgressBegin{
+				Kind:    protocol.WorkDoneProgressKindBegin,
+				Title:   "Context profile",
+				Message: "switching profile...",
+			},
+		})
+
+		err := clientInfo.switchContextProfile(args.Profile)
+		if err != nil {
+			return nil, err
+		}
+
+		client.Progress(context.TODO(), &protocol.ProgressParams{
+			Value: &protocol.WorkDoneProgressEnd{
+				Kind:    protocol.WorkDoneProgressKindEnd,
+				Message: args.Profile,
+			},
+		})
+
+		return nil, nil
+	},
+}
+
+var lspCommandListContextProfiles = &CommandDefinition{
+	Title:          "List context profiles",
+	ShowCodeAction: false,
+	Identifier:     "sage.workspace.context.profile.list",
+	BuildArgs: func(params *protocol.CodeActionParams) ([]any, error) {
+		return []any{}, nil
+	},
+	Execute: func(params *protocol.ExecuteCommandParams, client LspClient, clientInfo *LanguageServerClientInfo) (*protocol.ApplyWorkspaceEditParams, error) {
+		profiles, err := clientInfo.Config.Context.List()
+		if err != nil {
+			return nil, err
+		}
+
+		err = client.ShowMessage(context.TODO(), &protocol.ShowMessageParams{
+			Type:    protocol.MessageTypeInfo,
+			Message: "Context profiles:\n" + formatContextProfiles(profiles, clientInfo.Config.Context.Active()),
+		})
+
+		return nil, err
+	},
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/everestmz/sage/docstate"
+	"go.lsp.dev/protocol"
+)
+
+func TestContextProfiles(t *testing.T) {
+	wsDir := t.TempDir()
+
+	err := os.WriteFile(getContextProfilePath(wsDir, defaultContextProfile), []byte("main.go\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	profiles, err := NewContextProfiles(wsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if profiles.Active() != defaultContextProfile {
+		t.Errorf("Expected active profile %q, but got %q", defaultContextProfile, profiles.Active())
+	}
+
+	name, providers, err := profiles.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != defaultContextProfile {
+		t.Errorf("Expected context for profile %q, but got %q", defaultContextProfile, name)
+	}
+	if len(providers) != 1 || providers[0].String() != "main.go" {
+		t.Errorf("Expected the default profile's context, but got %v", providers)
+	}
+
+	for _, name := range []string{"db-migration", "auth-refactor"} {
+		err = profiles.Switch(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if profiles.Active() != "auth-refactor" {
+		t.Errorf("Expected active profile %q, but got %q", "auth-refactor", profiles.Active())
+	}
+
+	// New profiles start out empty
+	name, providers, err = profiles.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "auth-refactor" {
+		t.Errorf("Expected context for profile %q, but got %q", "auth-refactor", name)
+	}
+	if len(providers) != 0 {
+		t.Errorf("Expected an empty context, but got %v", providers)
+	}
+
+	names, err := profiles.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"default", "auth-refactor", "db-migration"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected profiles %q, but got %q", expected, names)
+	}
+
+	expectedList := "  default\n* auth-refactor\n  db-migration"
+	if list := formatContextProfiles(names, profiles.Active()); list != expectedList {
+		t.Errorf("Expected list %q, but got %q", expectedList, list)
+	}
+}
+
+func TestValidateContextProfileName(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile string
+		wantErr bool
+	}{
+		{name: "Plain", profile: "auth-refactor"},
+		{name: "Dots and underscores", profile: "v1.2_fix"},
+		{name: "Empty", profile: "", wantErr: true},
+		{name: "Hidden", profile: ".secret", wantErr: true},
+		{name: "Path", profile: "../context", wantErr: true},
+		{name: "Spaces", profile: "my profile", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateContextProfileName(tt.profile)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Expected error %v for %q, but got %v", tt.wantErr, tt.profile, err)
+			}
+		})
+	}
+}
+
+// warningsClient records the context warnings shown to the user
+type warningsClient struct {
+	protocol.Client
+
+	messages    []string
+	diagnostics [][]protocol.Diagnostic
+}
+
+func (c *warningsClient) ShowMessage(ctx context.Context, params *protocol.ShowMessageParams) error {
+	c.messages = append(c.messages, params.Message)
+	return nil
+}
+
+func (c *warningsClient) PublishDiagnostics(ctx context.Context, params *protocol.PublishDiagnosticsParams) error {
+	c.diagnostics = append(c.diagnostics, params.Diagnostics)
+	return nil
+}
+
+func TestReportContextWarningsAfterSwitching(t *testing.T) {
+	// Publishing finds context.txt through the config dir
+	t.Setenv("HOME", t.TempDir())
+
+	profiles, err := NewContextProfiles(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &warningsClient{}
+	clientInfo := &LanguageServerClientInfo{
+		Config: &SagePathConfig{Context: profiles},
+		Docs:   docstate.NewDocumentState(),
+		client: client,
+	}
+
+	warnings := []*ContextWarning{{Line: 2, Text: "gone.go", Message: "open gone.go: no such file or directory"}}
+
+	// Built from the default profile, but reported after sage ctx switched away from it
+	err = profiles.Switch("auth-refactor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientInfo.ReportContextWarnings(defaultContextProfile, warnings)
+
+	if len(client.messages) != 0 || len(client.diagnostics) != 0 {
+		t.Errorf("Expected the old profile's warnings to be dropped, but got messages %q and diagnostics %v", client.messages, client.diagnostics)
+	}
+
+	clientInfo.ReportContextWarnings("auth-refactor", warnings)
+
+	if len(client.messages) != 1 {
+		t.Errorf("Expected one message about the active profile's warnings, but got %q", client.messages)
+	}
+	if len(client.diagnostics) != 1 || len(client.diagnostics[0]) != 1 {
+		t.Errorf("Expected the active profile's warning as a diagnostic, but got %v", client.diagnostics)
+	}
+}
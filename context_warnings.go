@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"go.lsp.dev/protocol"
+)
+
+// ContextWarningReporter is a ContextApi that can tell the user about
+// context.txt lines that were left out
+type ContextWarningReporter interface {
+	ReportContextWarnings(profile string, warnings []*ContextWarning)
+}
+
+// contextWarningDiagnostics points at each line that was left out. They're
+// published on context.txt, so they show up when the user goes to fix it.
+func contextWarningDiagnostics(warnings []*ContextWarning) []protocol.Diagnostic {
+	diagnostics := []protocol.Diagnostic{}
+	for _, warning := range warnings {
+		diagnostics = append(diagnostics, protocol.Diagnostic{
+			Range: protocol.Range{
+				Start: protocol.Position{Line: uint32(warning.Line)},
+				End:   protocol.Position{Line: uint32(warning.Line) + 1},
+			},
+			Severity: protocol.DiagnosticSeverityWarning,
+			Source:   "sage",
+			Message:  "Left out of the context: " + warning.Message,
+		})
+	}
+
+	return diagnostics
+}
+
+func formatContextWarnings(warnings []*ContextWarning) string {
+	var lines []string
+	for _, warning := range warnings {
+		lines = append(lines, warning.String())
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// ReportContextWarnings tells the user which lines of profile were left out. If
+// the profile's been switched since, they're dropped rather than shown against
+// the new one.
+func (ci *LanguageServerClientInfo) ReportContextWarnings(profile string, warnings []*ContextWarning) {
+	if ci.client == nil {
+		// Outside the language server, like sage ask
+		for _, warning := range warnings {
+			log.Warn().Msg(warning.String())
+		}
+		return
+	}
+
+	// Every generation builds the context, so only pop up a message when
+	// something's changed rather than every time
+	summary := formatContextWarnings(warnings)
+	ci.contextWarningsLock.Lock()
+	if profile != ci.Config.Context.Active() {
+		ci.contextWarningsLock.Unlock()
+		return
+	}
+	changed := profile != ci.contextWarningsProfile || summary != formatContextWarnings(ci.contextWarnings)
+	ci.contextWarnings = warnings
+	ci.contextWarningsProfile = profile
+	ci.contextWarningsLock.Unlock()
+
+	// Publishing nothing clears the diagnostics once the lines are fixed
+	ci.publishContextDiagnostics()
+
+	if !changed || len(warnings) == 0 {
+		return
+	}
+
+	err := ci.client.ShowMessage(context.TODO(), &protocol.ShowMessageParams{
+		Type:    protocol.MessageTypeWarning,
+		Message: fmt.Sprintf("Sage left %d lines of context profile '%s' out of the context:\n%s", len(warnings), profile, summary),
+	})
+	if err != nil {
+		globalLsLogger.Error().Err(err).Msg("Error showing context warnings")
+	}
+}
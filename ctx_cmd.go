@@ -11,16 +11,52 @@ import (
 func init() {
 	flags := CtxCmd.PersistentFlags()
 	flags.BoolP("print", "p", false, "Always just print the filepath even if an editor is present")
+	flags.String("profile", "", "Switch to the named context profile first, creating it if it doesn't exist")
+	flags.BoolP("list", "l", false, "List the workspace's context profiles, marking the active one")
 }
 
 var CtxCmd = &cobra.Command{
 	Use:   "ctx",
 	Short: "Opens the context file for the current directory in $EDITOR if it exists, otherwise prints its filepath",
+	Long:  "Opens the context file for the active context profile. Each workspace has a default profile, and --profile switches to (or creates) another, so different tasks can have different context.",
 	RunE: func(cmd *cobra.Command, args []string) error {
 		flags := cmd.Flags()
 
 		editor := os.Getenv("EDITOR")
 
+		profile, err := flags.GetString("profile")
+		if err != nil {
+			return err
+		}
+
+		list, err := flags.GetBool("list")
+		if err != nil {
+			return err
+		}
+
+		wd, err := os.Getwd()
+		if err != nil {
+			panic(err)
+		}
+		wsDir := getWorkspaceDir(wd)
+
+		if profile != "" {
+			err = setActiveContextProfile(wsDir, profile)
+			if err != nil {
+				return err
+			}
+		}
+
+		if list {
+			profiles, err := listContextProfiles(wsDir)
+			if err != nil {
+				return err
+			}
+
+			fmt.Println(formatContextProfiles(profiles, getActiveContextProfile(wsDir)))
+			return nil
+		}
+
 		path := getWorkspaceContextPath()
 
 		print, err := flags.GetBool("print")
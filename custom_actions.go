@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/everestmz/sage/lsp"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"go.lsp.dev/protocol"
+	"go.lsp.dev/uri"
+	"gopkg.in/yaml.v3"
+)
+
+type CustomActionOutput string
+
+const (
+	// Insert the response after the selection
+	CustomActionOutputInsert CustomActionOutput = "insert"
+	// Replace the selection with the response
+	CustomActionOutputReplace CustomActionOutput = "replace"
+	// Open the response in a new document
+	CustomActionOutputDocument CustomActionOutput = "document"
+	// Show the response as a message
+	CustomActionOutputMessage CustomActionOutput = "message"
+)
+
+// CustomActionConfig is a code action declared under `actions` in sage.yaml:
+//
+//	myproject:
+//	  actions:
+//	    - title: Add error handling
+//	      identifier: myproject.errors
+//	      model: llama3.1:8b
+//	      output: replace
+//	      prompt: |
+//	        Add error handling to this {{.Language}} code: {{.Selection}}
+type CustomActionConfig struct {
+	Title      string             `yaml:"title"`
+	Identifier string             `yaml:"identifier"`
+	Prompt     string             `yaml:"prompt"`
+	Model      string             `yaml:"model,omitempty"` // Defaults to the workspace's default model
+	Output     CustomActionOutput `yaml:"output,omitempty"`
+}
+
+// loadCustomActions returns a loader that picks the actions for one config out
+// of sage.yaml. Actions that are invalid are left out with a warning, so one
+// mistake doesn't take the rest of them (or the rest of the config) down.
+func loadCustomActions(name string) func(data []byte, config any) error {
+	return func(data []byte, config any) error {
+		configs := map[string]struct {
+			Actions []*CustomActionConfig `yaml:"actions"`
+		}{}
+		err := yaml.Unmarshal(data, &configs)
+		if err != nil {
+			return err
+		}
+
+		actions := []*CustomActionConfig{}
+		seen := map[string]bool{}
+		for _, action := range configs[name].Actions {
+			err = action.validate()
+			if err == nil && seen[action.Identifier] {
+				err = fmt.Errorf("Duplicate action identifier '%s'", action.Identifier)
+			}
+			if err != nil {
+				log.Warn().Err(err).Msgf("Skipping custom action in '%s.actions'", name)
+				continue
+			}
+
+			seen[action.Identifier] = true
+			actions = append(actions, action)
+		}
+
+		*config.(*[]*CustomActionConfig) = actions
+		return nil
+	}
+}
+
+func (a *CustomActionConfig) validate() error {
+	if a.Identifier == "" {
+		return fmt.Errorf("Action '%s' has no identifier", a.Title)
+	}
+
+	for _, cmd := range lspCommands {
+		if cmd.Identifier == a.Identifier {
+			return fmt.Errorf("Action identifier '%s' is already used by a built-in command", a.Identifier)
+		}
+	}
+
+	if a.Prompt == "" {
+		return fmt.Errorf("Action '%s' has no prompt", a.Identifier)
+	}
+
+	if a.Title == "" {
+		a.Title = a.Identifier
+	}
+
+	switch a.Output {
+	case "":
+		a.Output = CustomActionOutputInsert
+	case CustomActionOutputInsert, CustomActionOutputReplace, CustomActionOutputDocument, CustomActionOutputMessage:
+	default:
+		return fmt.Errorf("Action '%s' has unknown output '%s'", a.Identifier, a.Output)
+	}
+
+	return nil
+}
+
+func (a *CustomActionConfig) Command() *CommandDefinition {
+	return &CommandDefinition{
+		Title:          a.Title,
+		ShowCodeAction: true,
+		Identifier:     a.Identifier,
+		BuildArgs: func(params *protocol.CodeActionParams) ([]any, error) {
+			args := &LlmCompletionArgs{
+				Filename:    params.TextDocument.URI,
+				Selection:   params.Range,
+				Diagnostics: params.Context.Diagnostics,
+			}
+
+			return []any{args}, nil
+		},
+		Execute: func(params *protocol.ExecuteCommandParams, client LspClient, clientInfo *LanguageServerClientInfo) (*protocol.ApplyWorkspaceEditParams, error) {
+			return nil, a.execute(params, client, clientInfo)
+		},
+	}
+}
+
+func (a *CustomActionConfig) execute(params *protocol.ExecuteCommandParams, client LspClient, clientInfo *LanguageServerClientInfo) error {
+	lsLogger := globalLsLogger.With().Str("code_action", params.Command).Logger()
+	argBs, err := json.Marshal(params.Arguments[0])
+	if err != nil {
+		return err
+	}
+
+	args := &LlmCompletionArgs{}
+	err = json.Unmarshal(argBs, args)
+	if err != nil {
+		return err
+	}
+
+	model := a.Model
+	if model == "" {
+		models, err := clientInfo.Config.Models.Get()
+		if err != nil {
+			return err
+		}
+		model = *models.Default
+	}
+
+	data, err := newSelectionPromptData(args, clientInfo, model)
+	if err != nil {
+		return err
+	}
+
+	prompt, err := renderPrompt(a.Identifier, a.Prompt, data)
+	if err != nil {
+		return err
+	}
+
+	lsLogger.Info().Str("model", model).Str("prompt", prompt).Msg("Running custom action")
+
+	client.Progress(context.TODO(), &protocol.ProgressParams{
+		Value: &protocol.WorkDoneProgressBegin{
+			Kind:    protocol.WorkDoneProgressKindBegin,
+			Title:   "Sage: " + a.Title,
+			Message: "generating...",
+		},
+	})
+
+	response, err := clientInfo.LLM.GenerateCompletion(context.TODO(), model, prompt)
+	if err != nil {
+		return err
+	}
+
+	client.Progress(context.TODO(), &protocol.ProgressParams{
+		Value: &protocol.WorkDoneProgressEnd{
+			Kind:    protocol.WorkDoneProgressKindEnd,
+			Message: "Done!",
+		},
+	})
+
+	switch a.Output {
+	case CustomActionOutputMessage:
+		return client.ShowMessage(context.TODO(), &protocol.ShowMessageParams{
+			Type:    protocol.MessageTypeInfo,
+			Message: response,
+		})
+
+	case CustomActionOutputDocument:
+		dir := filepath.Join(getWorkspaceDir(clientInfo.wd), "actions")
+		err = os.MkdirAll(dir, 0755)
+		if err != nil {
+			return err
+		}
+
+		docPath := filepath.Join(dir, fmt.Sprintf("%s-%s.md", a.Identifier, uuid.NewString()))
+		err = os.WriteFile(docPath, []byte(response), 0644)
+		if err != nil {
+			return err
+		}
+
+		result := &protocol.ShowDocumentResult{}
+		_, err = client.Conn().Call(context.TODO(), string(protocol.MethodShowDocument), protocol.ShowDocumentParams{
+			URI:       uri.File(docPath),
+			External:  false,
+			TakeFocus: true,
+		}, result)
+		return err
+	}
+
+	// The rest edit the document. The selection is only right for the
+	// document we built the prompt from, so work against that and pin its version.
+	doc := data.document
+
+	var edits []protocol.TextEdit
+	switch a.Output {
+	case CustomActionOutputReplace:
+		edits = lsp.ComputeTextEdits(getSelectionText(doc.Text, args.Selection), stripCodeFences(response), args.Selection.Start)
+	case CustomActionOutputInsert:
+		text := stripCodeFences(response)
+		if args.Selection.End.Character != 0 && !strings.HasPrefix(text, "\n") {
+			text = "\n" + text
+		}
+		edits = []protocol.TextEdit{{
+			Range:   protocol.Range{Start: args.Selection.End, End: args.Selection.End},
+			NewText: text,
+		}}
+	}
+
+	return applyGeneratedEdits(client, clientInfo, "sage: "+a.Title, args.Filename, doc.Version, edits)
+}
+
+// Commands returns the built-in commands, followed by the workspace's custom actions
+func (ci *LanguageServerClientInfo) Commands() []*CommandDefinition {
+	actions, err := ci.Config.Actions.Get()
+	if err != nil {
+		// Keep serving the last good set of actions while the file is broken
+		globalLsLogger.Error().Err(err).Msg("Error loading custom actions")
+	}
+
+	commands := append([]*CommandDefinition{}, lspCommands...)
+	for _, action := range actions {
+		commands = append(commands, action.Command())
+	}
+
+	return commands
+}
+
+// commandRegistrations tracks which command identifiers the client knows
+// about, so that actions added to sage.yaml after initialize can be
+// registered, and ones taken out of it unregistered
+type commandRegistrations struct {
+	lock sync.Mutex
+	// The ID each command was registered with. Commands from initialize have
+	// none, since they can't be unregistered.
+	registered map[string]string
+}
+
+func (cr *commandRegistrations) init(identifiers []string) {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+
+	cr.registered = map[string]string{}
+	for _, identifier := range identifiers {
+		cr.registered[identifier] = ""
+	}
+}
+
+func (ci *LanguageServerClientInfo) supportsCommandRegistration() bool {
+	return ci.ClientCapabilities.Workspace != nil && ci.ClientCapabilities.Workspace.ExecuteCommand != nil &&
+		ci.ClientCapabilities.Workspace.ExecuteCommand.DynamicRegistration
+}
+
+// initialCommands are the commands we tell the client about in initialize.
+// If it can register commands, custom actions are left for
+// syncCommandRegistrations, so they can be unregistered if they're removed.
+func (ci *LanguageServerClientInfo) initialCommands() []string {
+	commands := lspCommands
+	if !ci.supportsCommandRegistration() {
+		commands = ci.Commands()
+	}
+
+	var identifiers []string
+	for _, cmd := range commands {
+		identifiers = append(identifiers, cmd.Identifier)
+	}
+
+	return identifiers
+}
+
+// syncCommandRegistrations dynamically registers any commands the client
+// doesn't know about yet, and unregisters the ones that are gone
+func (ci *LanguageServerClientInfo) syncCommandRegistrations(client LspClient) {
+	if !ci.supportsCommandRegistration() {
+		return
+	}
+
+	ci.registrations.lock.Lock()
+	defer ci.registrations.lock.Unlock()
+
+	current := map[string]bool{}
+	var registrations []protocol.Registration
+	var registered []string
+	for _, cmd := range ci.Commands() {
+		current[cmd.Identifier] = true
+		if _, ok := ci.registrations.registered[cmd.Identifier]; ok {
+			continue
+		}
+
+		// One registration each, so they can be unregistered one at a time
+		registrations = append(registrations, protocol.Registration{
+			ID:     uuid.NewString(),
+			Method: protocol.MethodWorkspaceExecuteCommand,
+			RegisterOptions: protocol.ExecuteCommandRegistrationOptions{
+				Commands: []string{cmd.Identifier},
+			},
+		})
+		registered = append(registered, cmd.Identifier)
+	}
+
+	var unregistrations []protocol.Unregistration
+	for identifier, id := range ci.registrations.registered {
+		if !current[identifier] && id != "" {
+			unregistrations = append(unregistrations, protocol.Unregistration{
+				ID:     id,
+				Method: protocol.MethodWorkspaceExecuteCommand,
+			})
+		}
+	}
+
+	if len(unregistrations) > 0 {
+		err := client.UnregisterCapability(context.TODO(), &protocol.UnregistrationParams{
+			Unregisterations: unregistrations,
+		})
+		if err != nil {
+			globalLsLogger.Error().Err(err).Msg("Error unregistering custom actions")
+		} else {
+			for identifier, id := range ci.registrations.registered {
+				if !current[identifier] && id != "" {
+					delete(ci.registrations.registered, identifier)
+				}
+			}
+		}
+	}
+
+	if len(registrations) > 0 {
+		err := client.RegisterCapability(context.TODO(), &protocol.RegistrationParams{
+			Registrations: registrations,
+		})
+		if err != nil {
+			globalLsLogger.Error().Err(err).Msg("Error registering custom actions")
+			return
+		}
+
+		for i, identifier := range registered {
+			ci.registrations.registered[identifier] = registrations[i].ID
+		}
+	}
+}
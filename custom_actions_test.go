@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/everestmz/sage/liveconf"
+	"go.lsp.dev/protocol"
+)
+
+func TestLoadCustomActions(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      string
+		expectedErr bool
+		expected    []CustomActionConfig
+	}{
+		{
+			name: "Actions for this config only",
+			config: `
+myproject:
+  actions:
+    - identifier: myproject.explain
+      prompt: Explain {{.Selection}}
+      output: message
+other:
+  actions:
+    - identifier: other.explain
+      prompt: Explain
+`,
+			expected: []CustomActionConfig{
+				{Title: "myproject.explain", Identifier: "myproject.explain", Prompt: "Explain {{.Selection}}", Output: CustomActionOutputMessage},
+			},
+		},
+		{
+			name: "Output defaults to insert",
+			config: `
+myproject:
+  actions:
+    - title: Add tests
+      identifier: myproject.tests
+      prompt: Write tests
+      model: llama3.1:8b
+`,
+			expected: []CustomActionConfig{
+				{Title: "Add tests", Identifier: "myproject.tests", Prompt: "Write tests", Model: "llama3.1:8b", Output: CustomActionOutputInsert},
+			},
+		},
+		{
+			name:     "No config",
+			config:   "\n",
+			expected: []CustomActionConfig{},
+		},
+		{
+			name: "Invalid actions are left out",
+			config: `
+myproject:
+  actions:
+    - identifier: myproject.noprompt
+    - identifier: myproject.clipboard
+      prompt: Write tests
+      output: clipboard
+    - identifier: sage.completion.undo
+      prompt: Undo
+    - identifier: myproject.tests
+      prompt: Write tests
+`,
+			expected: []CustomActionConfig{
+				{Title: "myproject.tests", Identifier: "myproject.tests", Prompt: "Write tests", Output: CustomActionOutputInsert},
+			},
+		},
+		{
+			name: "Duplicate identifier",
+			config: `
+myproject:
+  actions:
+    - identifier: myproject.tests
+      prompt: Write tests
+    - identifier: myproject.tests
+      prompt: Write more tests
+`,
+			expected: []CustomActionConfig{
+				{Title: "myproject.tests", Identifier: "myproject.tests", Prompt: "Write tests", Output: CustomActionOutputInsert},
+			},
+		},
+		{
+			name:        "Not YAML",
+			config:      "myproject: [",
+			expectedErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actions := []*CustomActionConfig{}
+			err := loadCustomActions("myproject")([]byte(tt.config), &actions)
+			if tt.expectedErr {
+				if err == nil {
+					t.Errorf("Expected an error, but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if len(actions) != len(tt.expected) {
+				t.Fatalf("Expected %d actions, but got %d", len(tt.expected), len(actions))
+			}
+			for i, action := range actions {
+				if *action != tt.expected[i] {
+					t.Errorf("Expected action %+v, but got %+v", tt.expected[i], *action)
+				}
+			}
+		})
+	}
+}
+
+// registrationClient records the commands registered and unregistered with it
+type registrationClient struct {
+	protocol.Client
+
+	ids          map[string]string // Registration ID by command
+	unregistered []string
+}
+
+func (c *registrationClient) RegisterCapability(ctx context.Context, params *protocol.RegistrationParams) error {
+	for _, registration := range params.Registrations {
+		options := registration.RegisterOptions.(protocol.ExecuteCommandRegistrationOptions)
+		for _, command := range options.Commands {
+			c.ids[command] = registration.ID
+		}
+	}
+
+	return nil
+}
+
+func (c *registrationClient) UnregisterCapability(ctx context.Context, params *protocol.UnregistrationParams) error {
+	for _, unregistration := range params.Unregisterations {
+		for command, id := range c.ids {
+			if id == unregistration.ID {
+				c.unregistered = append(c.unregistered, command)
+				delete(c.ids, command)
+			}
+		}
+	}
+
+	return nil
+}
+
+func TestSyncCommandRegistrations(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "sage.yaml")
+	writeConfig := func(config string, modTime time.Time) {
+		err := os.WriteFile(configPath, []byte(config), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// So the change is seen even if it's within the filesystem's mtime resolution
+		err = os.Chtimes(configPath, modTime, modTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now()
+	writeConfig(`
+myproject:
+  actions:
+    - identifier: myproject.tests
+      prompt: Write tests
+    - identifier: myproject.docs
+      prompt: Write docs
+`, now)
+
+	actions := []*CustomActionConfig{}
+	watcher, err := liveconf.NewConfigWatcher[[]*CustomActionConfig](configPath, "\n", &actions, loadCustomActions("myproject"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientInfo := &LanguageServerClientInfo{
+		Config: &SagePathConfig{Actions: watcher},
+		ClientCapabilities: protocol.ClientCapabilities{
+			Workspace: &protocol.WorkspaceClientCapabilities{
+				ExecuteCommand: &protocol.ExecuteCommandClientCapabilities{DynamicRegistration: true},
+			},
+		},
+	}
+	client := &registrationClient{ids: map[string]string{}}
+
+	initial := clientInfo.initialCommands()
+	if len(initial) != len(lspCommands) {
+		t.Errorf("Expected only the %d built-in commands in initialize, but got %d", len(lspCommands), len(initial))
+	}
+	clientInfo.registrations.init(initial)
+
+	registered := func() []string {
+		var commands []string
+		for command := range client.ids {
+			commands = append(commands, command)
+		}
+		sort.Strings(commands)
+		return commands
+	}
+
+	clientInfo.syncCommandRegistrations(LspClient{Client: client})
+	expected := []string{"myproject.docs", "myproject.tests"}
+	if !reflect.DeepEqual(registered(), expected) {
+		t.Errorf("Expected registered commands %q, but got %q", expected, registered())
+	}
+
+	writeConfig(`
+myproject:
+  actions:
+    - identifier: myproject.tests
+      prompt: Write tests
+`, now.Add(time.Minute))
+
+	clientInfo.syncCommandRegistrations(LspClient{Client: client})
+	expected = []string{"myproject.tests"}
+	if !reflect.DeepEqual(registered(), expected) {
+		t.Errorf("Expected registered commands %q, but got %q", expected, registered())
+	}
+	if !reflect.DeepEqual(client.unregistered, []string{"myproject.docs"}) {
+		t.Errorf("Expected myproject.docs to be unregistered, but got %q", client.unregistered)
+	}
+}
@@ -137,6 +137,16 @@ func (db *DB) Init() error {
 		return fmt.Errorf("Error creating symbol table: %w", err)
 	}
 
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS explanation (
+			hash TEXT NOT NULL,
+			model TEXT NOT NULL,
+			explanation TEXT NOT NULL,
+			PRIMARY KEY (hash, model)
+		);`)
+	if err != nil {
+		return fmt.Errorf("Error creating explanation table: %w", err)
+	}
+
 	// TODO: handle different vector dimension sizes
 	// XXX: commenting out until we have use for embeddings
 	// _, err = db.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS symbol_embedding USING vec0(embedding float[768]);`)
@@ -350,3 +360,43 @@ func (db *DB) FindSymbolByPrefix(prefix string) ([]protocol.SymbolInformation, e
 
 	return result, nil
 }
+
+// FindSymbolsInFile returns the indexed symbols in a file, by its path relative to the workspace
+func (db *DB) FindSymbolsInFile(path string) ([]protocol.SymbolInformation, error) {
+	rows, err := db.Query(`SELECT kind, name, path, start_line, start_col, end_line, end_col FROM symbol WHERE path = ? ORDER BY start_line`, path)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []protocol.SymbolInformation{}
+
+	for rows.Next() {
+		info, err := db.scanSymbolRow(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, *info)
+	}
+
+	return result, nil
+}
+
+// GetExplanation returns the cached explanation for a symbol, keyed by the hash
+// of its text and the model that explained it, so changing models regenerates them
+func (db *DB) GetExplanation(hash, model string) (string, bool, error) {
+	var explanation string
+	err := db.QueryRow("SELECT explanation FROM explanation WHERE hash = ? AND model = ?;", hash, model).Scan(&explanation)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+
+	return explanation, true, nil
+}
+
+func (db *DB) InsertExplanation(hash, model, explanation string) error {
+	_, err := db.Exec("INSERT OR REPLACE INTO explanation (hash, model, explanation) VALUES (?, ?, ?);", hash, model, explanation)
+	return err
+}
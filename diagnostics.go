@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"go.lsp.dev/protocol"
+	"go.lsp.dev/uri"
+)
+
+// DiagnosticsCache holds the latest diagnostics the child published for each document
+type DiagnosticsCache struct {
+	lock        sync.Mutex
+	diagnostics map[uri.URI][]protocol.Diagnostic
+}
+
+func NewDiagnosticsCache() *DiagnosticsCache {
+	return &DiagnosticsCache{
+		diagnostics: map[uri.URI][]protocol.Diagnostic{},
+	}
+}
+
+func (dc *DiagnosticsCache) Set(docUri uri.URI, diagnostics []protocol.Diagnostic) {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+
+	if len(diagnostics) == 0 {
+		delete(dc.diagnostics, docUri)
+		return
+	}
+
+	dc.diagnostics[docUri] = diagnostics
+}
+
+func (dc *DiagnosticsCache) Get(docUri uri.URI) []protocol.Diagnostic {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+
+	return append([]protocol.Diagnostic{}, dc.diagnostics[docUri]...)
+}
+
+// All returns the diagnostics for every document that has any
+func (dc *DiagnosticsCache) All() map[uri.URI][]protocol.Diagnostic {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+
+	all := map[uri.URI][]protocol.Diagnostic{}
+	for docUri, diagnostics := range dc.diagnostics {
+		all[docUri] = append([]protocol.Diagnostic{}, diagnostics...)
+	}
+
+	return all
+}
+
+// diagnosticsRecordingClient is what the child talks to. It caches the
+// diagnostics the child publishes on their way through to the editor.
+type diagnosticsRecordingClient struct {
+	protocol.Client
+
+	diagnostics *DiagnosticsCache
+}
+
+func (c *diagnosticsRecordingClient) PublishDiagnostics(ctx context.Context, params *protocol.PublishDiagnosticsParams) error {
+	c.diagnostics.Set(params.URI, params.Diagnostics)
+
+	return c.Client.PublishDiagnostics(ctx, params)
+}
+
+// How many lines either side of a diagnostic the model gets to rewrite when fixing it
+const fixContextLines = 5
+
+type FixDiagnosticArgs struct {
+	Filename   uri.URI
+	Diagnostic protocol.Diagnostic
+}
+
+var lspCommandFixDiagnostic = &CommandDefinition{
+	Title:          "Fix this error",
+	ShowCodeAction: true,
+	Identifier:     "sage.fix.diagnostic",
+	BuildArgs: func(params *protocol.CodeActionParams) ([]any, error) {
+		if len(params.Context.Diagnostics) == 0 {
+			return []any{}, nil
+		}
+
+		// Errors first, since that's what people most want fixed
+		diagnostic := params.Context.Diagnostics[0]
+		for _, d := range params.Context.Diagnostics {
+			if d.Severity == protocol.DiagnosticSeverityError {
+				diagnostic = d
+				break
+			}
+		}
+
+		args := &FixDiagnosticArgs{
+			Filename:   params.TextDocument.URI,
+			Diagnostic: diagnostic,
+		}
+
+		return []any{args}, nil
+	},
+	CodeActionFilter: func(params *protocol.CodeActionParams, clientInfo *LanguageServerClientInfo) bool {
+		return len(params.Context.Diagnostics) > 0
+	},
+	Execute: func(params *protocol.ExecuteCommandParams, client LspClient, clientInfo *LanguageServerClientInfo) (*protocol.ApplyWorkspaceEditParams, error) {
+		lsLogger := globalLsLogger.With().Str("code_action", params.Command).Logger()
+		argBs, err := json.Marshal(params.Arguments[0])
+		if err != nil {
+			return nil, err
+		}
+
+		args := &FixDiagnosticArgs{}
+		err = json.Unmarshal(argBs, args)
+		if err != nil {
+			return nil, err
+		}
+
+		region := getFixRegion(args.Diagnostic.Range)
+
+		// Other diagnostics in the region are likely related, so the model gets those too
+		diagnostics := []protocol.Diagnostic{args.Diagnostic}
+		for _, d := range clientInfo.Diagnostics.Get(args.Filename) {
+			if d.Range != args.Diagnostic.Range && d.Range.Start.Line >= region.Start.Line && d.Range.Start.Line < region.End.Line {
+				diagnostics = append(diagnostics, d)
+			}
+		}
+
+		models, err := clientInfo.Config.Models.Get()
+		if err != nil {
+			return nil, err
+		}
+
+		model := *models.Default
+
+		data, err := newSelectionPromptData(&LlmCompletionArgs{
+			Filename:    args.Filename,
+			Selection:   region,
+			Diagnostics: diagnostics,
+		}, clientInfo, model)
+		if err != nil {
+			return nil, err
+		}
+
+		prompt, err := clientInfo.Config.Prompts.Render("fix", data)
+		if err != nil {
+			return nil, err
+		}
+
+		lsLogger.Info().Str("model", model).Str("prompt", prompt).Msg("Fixing diagnostic")
+
+		client.Progress(context.TODO(), &protocol.ProgressParams{
+			Value: &protocol.WorkDoneProgressBegin{
+				Kind:    protocol.WorkDoneProgressKindBegin,
+				Title:   "Sage fix",
+				Message: args.Diagnostic.Message,
+			},
+		})
+
+		response, err := clientInfo.LLM.GenerateCompletion(context.TODO(), model, prompt)
+		if err != nil {
+			return nil, err
+		}
+
+		client.Progress(context.TODO(), &protocol.ProgressParams{
+			Value: &protocol.WorkDoneProgressEnd{
+				Kind:    protocol.WorkDoneProgressKindEnd,
+				Message: "Done!",
+			},
+		})
+
+		// The region is only right for the document we built the prompt from
+		edits, _, err := getRewriteEdits(data.document.Text, region, response)
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, applyGeneratedEdits(client, clientInfo, "sage: fix "+args.Diagnostic.Message, args.Filename, data.document.Version, edits)
+	},
+}
+
+// getFixRegion returns the whole lines around a diagnostic
+func getFixRegion(diagnosticRange protocol.Range) protocol.Range {
+	startLine := uint32(0)
+	if diagnosticRange.Start.Line > fixContextLines {
+		startLine = diagnosticRange.Start.Line - fixContextLines
+	}
+
+	return protocol.Range{
+		Start: protocol.Position{Line: startLine},
+		// GetOffset clamps this to the end of the file if it's past it
+		End: protocol.Position{Line: diagnosticRange.End.Line + fixContextLines + 1},
+	}
+}
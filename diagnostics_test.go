@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+
+	"go.lsp.dev/protocol"
+)
+
+func TestGetFixRegion(t *testing.T) {
+	tests := []struct {
+		name      string
+		diagnosed protocol.Range
+		expected  protocol.Range
+	}{
+		{
+			name: "Middle of a file",
+			diagnosed: protocol.Range{
+				Start: protocol.Position{Line: 20, Character: 4},
+				End:   protocol.Position{Line: 21, Character: 10},
+			},
+			expected: protocol.Range{
+				Start: protocol.Position{Line: 15},
+				End:   protocol.Position{Line: 27},
+			},
+		},
+		{
+			name: "Near the start of a file",
+			diagnosed: protocol.Range{
+				Start: protocol.Position{Line: 2, Character: 1},
+				End:   protocol.Position{Line: 2, Character: 5},
+			},
+			expected: protocol.Range{
+				Start: protocol.Position{Line: 0},
+				End:   protocol.Position{Line: 8},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := getFixRegion(tt.diagnosed)
+			if result != tt.expected {
+				t.Errorf("Expected region %v, but got %v", tt.expected, result)
+			}
+		})
+	}
+}
+
+func TestDiagnosticsCache(t *testing.T) {
+	cache := NewDiagnosticsCache()
+	docUri := protocol.DocumentURI("file:///tmp/main.go")
+
+	cache.Set(docUri, []protocol.Diagnostic{{Message: "undefined: foo"}})
+	if diagnostics := cache.Get(docUri); len(diagnostics) != 1 || diagnostics[0].Message != "undefined: foo" {
+		t.Errorf("Expected the published diagnostic, but got %v", diagnostics)
+	}
+
+	// Publishing no diagnostics clears them
+	cache.Set(docUri, nil)
+	if diagnostics := cache.Get(docUri); len(diagnostics) != 0 {
+		t.Errorf("Expected no diagnostics, but got %v", diagnostics)
+	}
+	if all := cache.All(); len(all) != 0 {
+		t.Errorf("Expected no documents with diagnostics, but got %v", all)
+	}
+}
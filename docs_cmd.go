@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/everestmz/sage/lsp"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	flags := DocsCmd.PersistentFlags()
+	flags.BoolP("dry-run", "n", false, "Print a diff of the docs that would be added instead of writing them")
+}
+
+var DocsCmd = &cobra.Command{
+	Use:   "docs <path>...",
+	Short: "Generate doc comments for exported definitions that don't have them",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		wd, err := os.Getwd()
+		if err != nil {
+			panic(err)
+		}
+
+		flags := cmd.Flags()
+
+		dryRun, err := flags.GetBool("dry-run")
+		if err != nil {
+			return err
+		}
+
+		config, err := getConfigForWd()
+		if err != nil {
+			return err
+		}
+
+		llm, err := NewLLMClient()
+		if err != nil {
+			return err
+		}
+
+		models, err := config.Models.Get()
+		if err != nil {
+			return err
+		}
+
+		docsFunc := func(path string) error {
+			content, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			text := string(content)
+
+			targets, err := findDocTargets(path, text, nil)
+			if err != nil {
+				return err
+			}
+			if len(targets) == 0 {
+				return nil
+			}
+
+			fmt.Fprintf(os.Stderr, "Documenting %d definitions in %s\n", len(targets), path)
+
+			edits, err := generateDocEdits(context.TODO(), llm, config, *models.Default, path, text, "", targets)
+			if err != nil {
+				return err
+			}
+
+			newText := lsp.ApplyTextEdits(text, edits)
+
+			if dryRun {
+				relativePath, err := filepath.Rel(wd, path)
+				if err != nil {
+					relativePath = path
+				}
+
+				fmt.Print(lsp.UnifiedDiff("a/"+relativePath, "b/"+relativePath, text, newText, 3))
+				return nil
+			}
+
+			return os.WriteFile(path, []byte(newText), 0644)
+		}
+
+		for _, arg := range args {
+			info, err := os.Stat(arg)
+			if err != nil {
+				return err
+			}
+
+			if !info.IsDir() {
+				err = docsFunc(arg)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+			err = filepath.WalkDir(arg, func(path string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if d.IsDir() {
+					return nil
+				}
+
+				if _, ok := docConventions[filepath.Ext(path)]; !ok {
+					return nil
+				}
+
+				absolute, err := filepath.Abs(path)
+				if err != nil {
+					return err
+				}
+
+				shortPath, err := filepath.Rel(wd, absolute)
+				if err != nil {
+					return err
+				}
+
+				for i, exc := range config.compiledExcludes {
+					if exc.Match(shortPath) {
+						log.Debug().Str("path", shortPath).Str("pattern", config.Exclude[i]).Msg("Skipping file because of match with excludes")
+						return nil
+					}
+				}
+
+				return docsFunc(path)
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	},
+}
@@ -1,9 +1,12 @@
 package docstate
 
 import (
+	"context"
+	"fmt"
 	"sync"
 	"time"
 
+	"github.com/everestmz/sage/lsp"
 	"go.lsp.dev/protocol"
 	"go.lsp.dev/uri"
 )
@@ -15,16 +18,38 @@ type OpenDocument struct {
 	LastEditedLine int
 }
 
+type AnchorGravity int
+
+const (
+	// The anchor moves past text inserted exactly at its position
+	AnchorGravityRight AnchorGravity = iota
+	// The anchor stays before text inserted exactly at its position
+	AnchorGravityLeft
+)
+
+// Anchor is a position in an open document that follows the text around it
+// as the document is changed
+type Anchor struct {
+	uri      uri.URI
+	position protocol.Position
+	gravity  AnchorGravity
+}
+
 func NewDocumentState() *DocumentState {
 	return &DocumentState{
 		openDocuments: map[uri.URI]*OpenDocument{},
+		anchors:       map[uri.URI]map[*Anchor]bool{},
+		changed:       make(chan struct{}),
 		docLock:       sync.Mutex{},
 	}
 }
 
 type DocumentState struct {
 	openDocuments map[uri.URI]*OpenDocument
-	docLock       sync.Mutex
+	anchors       map[uri.URI]map[*Anchor]bool
+	// Closed and replaced whenever a document changes
+	changed chan struct{}
+	docLock sync.Mutex
 }
 
 func (ds *DocumentState) OpenDocuments() map[uri.URI]OpenDocument {
@@ -61,6 +86,39 @@ func (ds *DocumentState) OpenDocument(doc *protocol.TextDocumentItem) {
 		LastEdit:       time.Now(),
 		LastEditedLine: 0,
 	}
+	ds.notifyChanged()
+}
+
+// RestoreDocument adds a document as it was somewhere else, like in another
+// process's state, keeping its edit history
+func (ds *DocumentState) RestoreDocument(doc OpenDocument) {
+	ds.docLock.Lock()
+	defer ds.docLock.Unlock()
+
+	ds.openDocuments[doc.URI] = &doc
+	ds.notifyChanged()
+}
+
+// WaitForOpen waits for the client to open a document, e.g. after we've asked it to show one
+func (ds *DocumentState) WaitForOpen(ctx context.Context, uri uri.URI) (OpenDocument, error) {
+	for {
+		ds.docLock.Lock()
+		openDoc, ok := ds.openDocuments[uri]
+		if ok {
+			doc := *openDoc
+			ds.docLock.Unlock()
+			return doc, nil
+		}
+
+		changed := ds.changed
+		ds.docLock.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return OpenDocument{}, ctx.Err()
+		case <-changed:
+		}
+	}
 }
 
 func (ds *DocumentState) CloseDocument(uri uri.URI) {
@@ -68,13 +126,25 @@ func (ds *DocumentState) CloseDocument(uri uri.URI) {
 	defer ds.docLock.Unlock()
 
 	delete(ds.openDocuments, uri)
+	delete(ds.anchors, uri)
+	ds.notifyChanged()
+}
+
+// notifyChanged must be called with docLock held
+func (ds *DocumentState) notifyChanged() {
+	close(ds.changed)
+	ds.changed = make(chan struct{})
 }
 
 func (ds *DocumentState) EditDocument(uri uri.URI, editFunc func(doc *protocol.TextDocumentItem) error) error {
 	ds.docLock.Lock()
 	defer ds.docLock.Unlock()
 
-	openDoc := ds.openDocuments[uri]
+	openDoc, ok := ds.openDocuments[uri]
+	if !ok {
+		return fmt.Errorf("Document %s is not open", uri)
+	}
+
 	protocolDoc := openDoc.TextDocumentItem
 	err := editFunc(&protocolDoc)
 	if err != nil {
@@ -82,6 +152,161 @@ func (ds *DocumentState) EditDocument(uri uri.URI, editFunc func(doc *protocol.T
 	}
 
 	openDoc.TextDocumentItem = protocolDoc
+	openDoc.LastEdit = time.Now()
+	ds.notifyChanged()
 
 	return nil
 }
+
+// ChangeDocument applies the changes from a didChange notification using
+// applyFunc, and moves any anchors in the document to match
+func (ds *DocumentState) ChangeDocument(uri uri.URI, version int32, changes []protocol.TextDocumentContentChangeEvent, applyFunc func(text string, changes []protocol.TextDocumentContentChangeEvent) (string, error)) error {
+	ds.docLock.Lock()
+	defer ds.docLock.Unlock()
+
+	openDoc, ok := ds.openDocuments[uri]
+	if !ok {
+		return fmt.Errorf("Document %s is not open", uri)
+	}
+
+	newText, err := applyFunc(openDoc.Text, changes)
+	if err != nil {
+		return err
+	}
+
+	for anchor := range ds.anchors[uri] {
+		for _, change := range changes {
+			if anchor.gravity == AnchorGravityLeft && anchor.position == change.Range.Start {
+				continue
+			}
+
+			anchor.position = lsp.TransformPosition(anchor.position, change.Range, change.Text)
+		}
+	}
+
+	openDoc.Text = newText
+	openDoc.Version = version
+	openDoc.LastEdit = time.Now()
+	if len(changes) > 0 {
+		openDoc.LastEditedLine = int(changes[len(changes)-1].Range.Start.Line)
+	}
+	ds.notifyChanged()
+
+	return nil
+}
+
+// WaitForChange blocks until the document's version is no longer version,
+// and returns the new state of the document
+func (ds *DocumentState) WaitForChange(ctx context.Context, uri uri.URI, version int32) (OpenDocument, error) {
+	for {
+		ds.docLock.Lock()
+		openDoc, ok := ds.openDocuments[uri]
+		if !ok {
+			ds.docLock.Unlock()
+			return OpenDocument{}, fmt.Errorf("Document %s is not open", uri)
+		}
+
+		if openDoc.Version != version {
+			doc := *openDoc
+			ds.docLock.Unlock()
+			return doc, nil
+		}
+
+		changed := ds.changed
+		ds.docLock.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return OpenDocument{}, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+func (ds *DocumentState) AddAnchor(uri uri.URI, position protocol.Position, gravity AnchorGravity) *Anchor {
+	ds.docLock.Lock()
+	defer ds.docLock.Unlock()
+
+	anchor := &Anchor{
+		uri:      uri,
+		position: position,
+		gravity:  gravity,
+	}
+
+	if ds.anchors[uri] == nil {
+		ds.anchors[uri] = map[*Anchor]bool{}
+	}
+	ds.anchors[uri][anchor] = true
+
+	return anchor
+}
+
+func (ds *DocumentState) RemoveAnchor(anchor *Anchor) {
+	ds.docLock.Lock()
+	defer ds.docLock.Unlock()
+
+	delete(ds.anchors[anchor.uri], anchor)
+}
+
+// AnchorPosition returns the anchor's current position, along with the version
+// of the document that position is valid for
+func (ds *DocumentState) AnchorPosition(anchor *Anchor) (protocol.Position, int32, bool) {
+	ds.docLock.Lock()
+	defer ds.docLock.Unlock()
+
+	openDoc, ok := ds.openDocuments[anchor.uri]
+	if !ok || !ds.anchors[anchor.uri][anchor] {
+		return protocol.Position{}, 0, false
+	}
+
+	return anchor.position, openDoc.Version, true
+}
+
+// AnchorRange returns the range between two anchors in the same document,
+// along with the version of the document that range is valid for
+func (ds *DocumentState) AnchorRange(start, end *Anchor) (protocol.Range, int32, bool) {
+	ds.docLock.Lock()
+	defer ds.docLock.Unlock()
+
+	openDoc, ok := ds.openDocuments[start.uri]
+	if !ok || start.uri != end.uri || !ds.anchors[start.uri][start] || !ds.anchors[end.uri][end] {
+		return protocol.Range{}, 0, false
+	}
+
+	return protocol.Range{
+		Start: start.position,
+		End:   end.position,
+	}, openDoc.Version, true
+}
+
+// AnchorRanges is AnchorRange for several pairs of anchors in the same
+// document, so that all the ranges are valid for the same version
+func (ds *DocumentState) AnchorRanges(pairs [][2]*Anchor) ([]protocol.Range, int32, bool) {
+	ds.docLock.Lock()
+	defer ds.docLock.Unlock()
+
+	if len(pairs) == 0 {
+		return nil, 0, false
+	}
+
+	docUri := pairs[0][0].uri
+	openDoc, ok := ds.openDocuments[docUri]
+	if !ok {
+		return nil, 0, false
+	}
+
+	var ranges []protocol.Range
+	for _, pair := range pairs {
+		start, end := pair[0], pair[1]
+		if start.uri != docUri || end.uri != docUri || !ds.anchors[docUri][start] || !ds.anchors[docUri][end] {
+			return nil, 0, false
+		}
+
+		ranges = append(ranges, protocol.Range{
+			Start: start.position,
+			End:   end.position,
+		})
+	}
+
+	return ranges, openDoc.Version, true
+}
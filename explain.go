@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.lsp.dev/protocol"
+	"go.lsp.dev/uri"
+)
+
+// How long to wait for the client to open the explanation document
+const showDocumentTimeout = 5 * time.Second
+
+var lspCommandExplainSelection = &CommandDefinition{
+	Title:          "Explain selection",
+	ShowCodeAction: true,
+	Identifier:     "sage.explain.selection",
+	BuildArgs: func(params *protocol.CodeActionParams) ([]any, error) {
+		args := &LlmCompletionArgs{
+			Filename:    params.TextDocument.URI,
+			Selection:   params.Range,
+			Diagnostics: params.Context.Diagnostics,
+		}
+
+		return []any{args}, nil
+	},
+	Execute: func(params *protocol.ExecuteCommandParams, client LspClient, clientInfo *LanguageServerClientInfo) (*protocol.ApplyWorkspaceEditParams, error) {
+		lsLogger := globalLsLogger.With().Str("code_action", params.Command).Logger()
+		argBs, err := json.Marshal(params.Arguments[0])
+		if err != nil {
+			return nil, err
+		}
+
+		args := &LlmCompletionArgs{}
+		err = json.Unmarshal(argBs, args)
+		if err != nil {
+			return nil, err
+		}
+
+		models, err := clientInfo.Config.Models.Get()
+		if err != nil {
+			return nil, err
+		}
+
+		model := *models.ExplainCode
+
+		data, err := newSelectionPromptData(args, clientInfo, model)
+		if err != nil {
+			return nil, err
+		}
+
+		prompt, err := clientInfo.Config.Prompts.Render("explain", data)
+		if err != nil {
+			return nil, err
+		}
+
+		// The explanation goes in a scratch document, so the source file is left alone
+		explanationDir := filepath.Join(getWorkspaceDir(clientInfo.wd), "explanations")
+		err = os.MkdirAll(explanationDir, 0755)
+		if err != nil {
+			return nil, err
+		}
+
+		header := fmt.Sprintf("# %s:%d-%d\n\n```%s\n%s\n```\n\n", filepath.Base(data.Filename), args.Selection.Start.Line+1, args.Selection.End.Line+1, data.Language, strings.TrimRight(data.Selection, "\n"))
+		explanationPath := filepath.Join(explanationDir, uuid.NewString()+".md")
+		err = os.WriteFile(explanationPath, []byte(header), 0644)
+		if err != nil {
+			return nil, err
+		}
+		explanationUri := uri.File(explanationPath)
+
+		result := &protocol.ShowDocumentResult{}
+		_, err = client.Conn().Call(context.TODO(), string(protocol.MethodShowDocument), protocol.ShowDocumentParams{
+			URI:       explanationUri,
+			External:  false,
+			TakeFocus: true,
+			Selection: nil,
+		}, result)
+		if err != nil {
+			return nil, err
+		}
+
+		lsLogger.Info().Str("model", model).Str("prompt", prompt).Msg("Explaining selection")
+
+		client.Progress(context.TODO(), &protocol.ProgressParams{
+			Value: &protocol.WorkDoneProgressBegin{
+				Kind:    protocol.WorkDoneProgressKindBegin,
+				Title:   "Sage explain",
+				Message: "connecting...",
+			},
+		})
+
+		ctx, cancel := context.WithTimeout(context.TODO(), showDocumentTimeout)
+		doc, err := clientInfo.Docs.WaitForOpen(ctx, explanationUri)
+		cancel()
+
+		if err == nil {
+			_, err = streamCompletionEdits(client, clientInfo, lsLogger, model, prompt, explanationUri, getPositionOffset(doc.Text))
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			// The client didn't open it for us to stream into, so just write the whole
+			// explanation to disk for whenever it does
+			lsLogger.Info().Err(err).Msg("Explanation document not opened, writing it instead")
+
+			explanation, err := clientInfo.LLM.GenerateCompletion(context.TODO(), model, prompt)
+			if err != nil {
+				return nil, err
+			}
+
+			err = os.WriteFile(explanationPath, []byte(header+explanation), 0644)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		client.Progress(context.TODO(), &protocol.ProgressParams{
+			Value: &protocol.WorkDoneProgressEnd{
+				Kind:    protocol.WorkDoneProgressKindEnd,
+				Message: "Done!",
+			},
+		})
+
+		return nil, nil
+	},
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/everestmz/llmcat/treesym"
+	"go.lsp.dev/protocol"
+	"go.lsp.dev/uri"
+)
+
+type GenerateDocsArgs struct {
+	Filename uri.URI
+	Position protocol.Position
+}
+
+var lspCommandGenerateDocs = &CommandDefinition{
+	Title:          "Generate docs",
+	ShowCodeAction: true,
+	Identifier:     "sage.generate.docs",
+	BuildArgs: func(params *protocol.CodeActionParams) ([]any, error) {
+		args := &GenerateDocsArgs{
+			Filename: params.TextDocument.URI,
+			Position: params.Range.Start,
+		}
+
+		return []any{args}, nil
+	},
+	CodeActionFilter: func(params *protocol.CodeActionParams, clientInfo *LanguageServerClientInfo) bool {
+		_, ok := docConventions[filepath.Ext(params.TextDocument.URI.Filename())]
+		return ok
+	},
+	Execute: func(params *protocol.ExecuteCommandParams, client LspClient, clientInfo *LanguageServerClientInfo) (*protocol.ApplyWorkspaceEditParams, error) {
+		lsLogger := globalLsLogger.With().Str("code_action", params.Command).Logger()
+		argBs, err := json.Marshal(params.Arguments[0])
+		if err != nil {
+			return nil, err
+		}
+
+		args := &GenerateDocsArgs{}
+		err = json.Unmarshal(argBs, args)
+		if err != nil {
+			return nil, err
+		}
+
+		doc, ok := clientInfo.Docs.GetOpenDocument(args.Filename)
+		if !ok {
+			return nil, fmt.Errorf("No text document for supposedly open file %s", args.Filename)
+		}
+
+		// The cursor picks a definition to document. Outside of one, we document
+		// everything exported that isn't already.
+		targets, err := findDocTargets(args.Filename.Filename(), doc.Text, &args.Position)
+		if err != nil {
+			return nil, err
+		}
+		if len(targets) == 0 {
+			return nil, fmt.Errorf("Everything exported in %s is already documented", args.Filename.Filename())
+		}
+
+		models, err := clientInfo.Config.Models.Get()
+		if err != nil {
+			return nil, err
+		}
+
+		model := *models.Default
+
+		filesContext, err := clientInfo.Config.BuildContext(clientInfo, model)
+		if err != nil {
+			return nil, err
+		}
+
+		lsLogger.Info().Str("model", model).Int("definitions", len(targets)).Msg("Generating docs")
+
+		client.Progress(context.TODO(), &protocol.ProgressParams{
+			Value: &protocol.WorkDoneProgressBegin{
+				Kind:    protocol.WorkDoneProgressKindBegin,
+				Title:   "Sage docs",
+				Message: fmt.Sprintf("documenting %d definitions...", len(targets)),
+			},
+		})
+
+		edits, err := generateDocEdits(context.TODO(), clientInfo.LLM, clientInfo.Config, model, args.Filename.Filename(), doc.Text, filesContext, targets)
+		if err != nil {
+			return nil, err
+		}
+
+		client.Progress(context.TODO(), &protocol.ProgressParams{
+			Value: &protocol.WorkDoneProgressEnd{
+				Kind:    protocol.WorkDoneProgressKindEnd,
+				Message: "Done!",
+			},
+		})
+
+		// The edits were made against the version we read, so if the user has
+		// typed since, they'll be rejected rather than land in the wrong place
+		return nil, applyGeneratedEdits(client, clientInfo, "sage: docs", args.Filename, doc.Version, edits)
+	},
+}
+
+// docConvention is how doc comments are written in a language
+type docConvention struct {
+	isExported func(line, name string) bool
+	// Returns the line the doc comment goes on, or -1 if there already is one
+	docLine func(lines []string, defLine int) int
+	format  func(doc, indent string) string
+}
+
+func leadingWhitespace(line string) string {
+	return line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+}
+
+// previousNonEmptyLine returns the trimmed line before line, skipping blank ones
+func previousNonEmptyLine(lines []string, line int) string {
+	for i := line - 1; i >= 0; i-- {
+		if trimmed := strings.TrimSpace(lines[i]); trimmed != "" {
+			return trimmed
+		}
+	}
+
+	return ""
+}
+
+// Doc comments above the definition, made of lines starting with prefix
+func linePrefixDocComments(prefix string) func(doc, indent string) string {
+	return func(doc, indent string) string {
+		var result string
+		for _, line := range strings.Split(doc, "\n") {
+			result += strings.TrimRight(indent+prefix+" "+line, " ") + "\n"
+		}
+		return result
+	}
+}
+
+var goDocConvention = &docConvention{
+	isExported: func(line, name string) bool {
+		r, _ := utf8.DecodeRuneInString(name)
+		return unicode.IsUpper(r)
+	},
+	docLine: func(lines []string, defLine int) int {
+		// Go doc comments have to be directly above the definition
+		if defLine > 0 && strings.HasPrefix(strings.TrimSpace(lines[defLine-1]), "//") {
+			return -1
+		}
+		return defLine
+	},
+	format: linePrefixDocComments("//"),
+}
+
+var jsDocConvention = &docConvention{
+	isExported: func(line, name string) bool {
+		return strings.HasPrefix(strings.TrimSpace(line), "export ")
+	},
+	docLine: func(lines []string, defLine int) int {
+		if strings.HasSuffix(previousNonEmptyLine(lines, defLine), "*/") {
+			return -1
+		}
+		return defLine
+	},
+	format: func(doc, indent string) string {
+		result := indent + "/**\n"
+		for _, line := range strings.Split(doc, "\n") {
+			result += strings.TrimRight(indent+" * "+line, " ") + "\n"
+		}
+		return result + indent + " */\n"
+	},
+}
+
+var pythonDocConvention = &docConvention{
+	isExported: func(line, name string) bool {
+		return !strings.HasPrefix(name, "_")
+	},
+	docLine: func(lines []string, defLine int) int {
+		// Docstrings go after the (possibly multi-line) signature
+		headerEnd := defLine
+		for headerEnd < len(lines)-1 && !strings.HasSuffix(strings.TrimSpace(lines[headerEnd]), ":") {
+			headerEnd++
+		}
+
+		for i := headerEnd + 1; i < len(lines); i++ {
+			trimmed := strings.TrimSpace(lines[i])
+			if trimmed == "" {
+				continue
+			}
+
+			if strings.HasPrefix(trimmed, `"""`) || strings.HasPrefix(trimmed, `'''`) {
+				return -1
+			}
+			break
+		}
+
+		return headerEnd + 1
+	},
+	format: func(doc, indent string) string {
+		docLines := strings.Split(doc, "\n")
+		if len(docLines) == 1 {
+			return indent + `"""` + doc + `"""` + "\n"
+		}
+
+		result := indent + `"""` + docLines[0] + "\n"
+		for _, line := range docLines[1:] {
+			result += strings.TrimRight(indent+line, " ") + "\n"
+		}
+		return result + indent + `"""` + "\n"
+	},
+}
+
+var docConventions = map[string]*docConvention{
+	".go":  goDocConvention,
+	".py":  pythonDocConvention,
+	".js":  jsDocConvention,
+	".jsx": jsDocConvention,
+	".ts":  jsDocConvention,
+	".tsx": jsDocConvention,
+}
+
+// docTarget is a definition that needs a doc comment
+type docTarget struct {
+	Name string
+	Text string
+	// Where the comment goes, and how it's indented
+	Line   int
+	Indent string
+}
+
+// findDocTargets finds the definition at position, or if position is nil or
+// not in a definition, every exported definition without a doc comment
+func findDocTargets(path, text string, position *protocol.Position) ([]*docTarget, error) {
+	convention, ok := docConventions[filepath.Ext(path)]
+	if !ok {
+		return nil, fmt.Errorf("Don't know how to write docs for %s files", filepath.Ext(path))
+	}
+
+	processedFile, err := treesym.GetSymbols(context.TODO(), &treesym.SourceFile{
+		Path: path,
+		Text: text,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	lines := strings.Split(text, "\n")
+
+	var atPosition *treesym.Node
+	var defs []*treesym.Node
+	seen := map[uint32]bool{}
+	for _, def := range processedFile.Symbols.Definitions {
+		if seen[def.StartPoint.Row] {
+			continue
+		}
+		seen[def.StartPoint.Row] = true
+		defs = append(defs, def)
+
+		if position == nil || position.Line < def.StartPoint.Row || position.Line > def.EndPoint.Row {
+			continue
+		}
+		// The innermost definition wins, e.g. a method rather than its class
+		if atPosition == nil || def.StartPoint.Row >= atPosition.StartPoint.Row {
+			atPosition = def
+		}
+	}
+
+	if atPosition != nil {
+		defs = []*treesym.Node{atPosition}
+	}
+
+	var targets []*docTarget
+	for _, def := range defs {
+		defLine := int(def.StartPoint.Row)
+		if defLine >= len(lines) {
+			continue
+		}
+
+		if atPosition == nil && !convention.isExported(lines[defLine], def.Name) {
+			continue
+		}
+
+		docLine := convention.docLine(lines, defLine)
+		if docLine < 0 {
+			if atPosition != nil {
+				return nil, fmt.Errorf("%s is already documented", def.Name)
+			}
+			continue
+		}
+
+		indent := leadingWhitespace(lines[defLine])
+		if docLine > defLine {
+			// Inside the definition, so indented like its body
+			indent += "    "
+			for i := docLine; i < len(lines); i++ {
+				if strings.TrimSpace(lines[i]) != "" {
+					indent = leadingWhitespace(lines[i])
+					break
+				}
+			}
+		}
+
+		targets = append(targets, &docTarget{
+			Name:   def.Name,
+			Text:   def.FullText,
+			Line:   docLine,
+			Indent: indent,
+		})
+	}
+
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].Line < targets[j].Line
+	})
+
+	return targets, nil
+}
+
+// stripCommentMarkers removes comment syntax from a generated doc comment, since
+// we add the right syntax for the language ourselves
+func stripCommentMarkers(doc string) string {
+	doc = strings.TrimSpace(stripCodeFences(doc))
+	for _, quote := range []string{`"""`, `'''`} {
+		doc = strings.TrimSuffix(strings.TrimPrefix(doc, quote), quote)
+	}
+
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(doc), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "/**" || trimmed == "*/" {
+			continue
+		}
+
+		for _, marker := range []string{"///", "//", "/**", "*", "#"} {
+			if strings.HasPrefix(trimmed, marker) {
+				trimmed = strings.TrimSpace(strings.TrimPrefix(trimmed, marker))
+				break
+			}
+		}
+		lines = append(lines, trimmed)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// generateDocEdits generates doc comments for the targets, returning edits
+// that insert them in document order
+func generateDocEdits(ctx context.Context, llm *LLMClient, config *SagePathConfig, model, path, text, filesContext string, targets []*docTarget) ([]protocol.TextEdit, error) {
+	convention := docConventions[filepath.Ext(path)]
+
+	var edits []protocol.TextEdit
+	for _, target := range targets {
+		prompt, err := config.Prompts.Render("docs", &PromptData{
+			Filename:  path,
+			Language:  getLanguageName(uri.File(path), ""),
+			File:      text,
+			Selection: target.Text,
+			Context:   filesContext,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		response, err := llm.GenerateCompletion(ctx, model, prompt)
+		if err != nil {
+			return nil, err
+		}
+
+		doc := stripCommentMarkers(response)
+		if doc == "" {
+			continue
+		}
+
+		position := protocol.Position{Line: uint32(target.Line)}
+		edits = append(edits, protocol.TextEdit{
+			Range:   protocol.Range{Start: position, End: position},
+			NewText: convention.format(doc, target.Indent),
+		})
+	}
+
+	return edits, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"testing"
+
+	"go.lsp.dev/protocol"
+)
+
+func TestFindDocTargets(t *testing.T) {
+	goSource := `package server
+
+// Server serves things
+type Server struct{}
+
+func NewServer() *Server {
+	return &Server{}
+}
+
+func helper() {
+}
+
+func (s *Server) Start() error {
+	return nil
+}
+`
+
+	pythonSource := `def greet(name):
+    return "hi " + name
+
+def _private():
+    pass
+
+def documented():
+    """Already done"""
+    pass
+`
+
+	tests := []struct {
+		name     string
+		path     string
+		text     string
+		position *protocol.Position
+		expected []docTarget
+	}{
+		{
+			name: "Undocumented exported Go definitions",
+			path: "server.go",
+			text: goSource,
+			expected: []docTarget{
+				{Name: "NewServer", Line: 5},
+				{Name: "Start", Line: 12},
+			},
+		},
+		{
+			name:     "Go definition at cursor",
+			path:     "server.go",
+			text:     goSource,
+			position: &protocol.Position{Line: 9, Character: 6},
+			expected: []docTarget{
+				{Name: "helper", Line: 9},
+			},
+		},
+		{
+			name: "Python docstrings go inside the definition",
+			path: "greet.py",
+			text: pythonSource,
+			expected: []docTarget{
+				{Name: "greet", Line: 1, Indent: "    "},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			targets, err := findDocTargets(tt.path, tt.text, tt.position)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if len(targets) != len(tt.expected) {
+				t.Fatalf("Expected %d targets, but got %d", len(tt.expected), len(targets))
+			}
+
+			for i, target := range targets {
+				expected := tt.expected[i]
+				if target.Name != expected.Name || target.Line != expected.Line || target.Indent != expected.Indent {
+					t.Errorf("Expected target %s at line %d indented %q, but got %s at line %d indented %q", expected.Name, expected.Line, expected.Indent, target.Name, target.Line, target.Indent)
+				}
+			}
+		})
+	}
+}
+
+func TestStripCommentMarkers(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"NewServer creates a server.", "NewServer creates a server."},
+		{"// NewServer creates a server.\n// It never fails.", "NewServer creates a server.\nIt never fails."},
+		{"/**\n * Creates a server.\n */", "Creates a server."},
+		{`"""Greets someone."""`, "Greets someone."},
+	}
+
+	for _, tt := range tests {
+		result := stripCommentMarkers(tt.input)
+		if result != tt.expected {
+			t.Errorf("Expected result %q, but got %q", tt.expected, result)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/everestmz/sage/lsp"
+	"go.lsp.dev/protocol"
+	"go.lsp.dev/uri"
+)
+
+// getTestFilePath returns where tests for a source file live, by the
+// conventions of its language
+func getTestFilePath(path string) (string, bool) {
+	dir, name := filepath.Split(path)
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+
+	switch ext {
+	case ".go":
+		if strings.HasSuffix(base, "_test") {
+			return path, true
+		}
+		return filepath.Join(dir, base+"_test.go"), true
+
+	case ".py":
+		if strings.HasPrefix(base, "test_") {
+			return path, true
+		}
+		return filepath.Join(dir, "test_"+name), true
+
+	case ".ts", ".tsx", ".js", ".jsx":
+		if strings.HasSuffix(base, ".spec") || strings.HasSuffix(base, ".test") {
+			return path, true
+		}
+		return filepath.Join(dir, base+".spec"+ext), true
+	}
+
+	return "", false
+}
+
+type GenerateTestsArgs struct {
+	Filename uri.URI
+	Position protocol.Position
+}
+
+var lspCommandGenerateTests = &CommandDefinition{
+	Title:          "Generate tests",
+	ShowCodeAction: true,
+	Identifier:     "sage.generate.tests",
+	BuildArgs: func(params *protocol.CodeActionParams) ([]any, error) {
+		args := &GenerateTestsArgs{
+			Filename: params.TextDocument.URI,
+			Position: params.Range.Start,
+		}
+
+		return []any{args}, nil
+	},
+	CodeActionFilter: func(params *protocol.CodeActionParams, clientInfo *LanguageServerClientInfo) bool {
+		if _, ok := getTestFilePath(params.TextDocument.URI.Filename()); !ok {
+			return false
+		}
+
+		doc, ok := clientInfo.Docs.GetOpenDocument(params.TextDocument.URI)
+		return ok && lsp.GetIdentifierAtPosition(doc.Text, params.Range.Start) != ""
+	},
+	Execute: func(params *protocol.ExecuteCommandParams, client LspClient, clientInfo *LanguageServerClientInfo) (*protocol.ApplyWorkspaceEditParams, error) {
+		lsLogger := globalLsLogger.With().Str("code_action", params.Command).Logger()
+		argBs, err := json.Marshal(params.Arguments[0])
+		if err != nil {
+			return nil, err
+		}
+
+		args := &GenerateTestsArgs{}
+		err = json.Unmarshal(argBs, args)
+		if err != nil {
+			return nil, err
+		}
+
+		doc, ok := clientInfo.Docs.GetOpenDocument(args.Filename)
+		if !ok {
+			return nil, fmt.Errorf("No text document for supposedly open file %s", args.Filename)
+		}
+
+		identifier := lsp.GetIdentifierAtPosition(doc.Text, args.Position)
+		definition, ok, err := findIndexedDefinition(clientInfo.db, clientInfo.Docs, args.Filename, identifier)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("Symbol '%s' is not in the index - try running sage index", identifier)
+		}
+
+		// The tests go next to the definition, which isn't necessarily in this file
+		sourcePath := definition.Location.URI.Filename()
+		testPath, ok := getTestFilePath(sourcePath)
+		if !ok {
+			return nil, fmt.Errorf("Don't know where tests for %s go", sourcePath)
+		}
+		testUri := uri.File(testPath)
+
+		sourceText, err := clientInfo.GetFile(sourcePath)
+		if err != nil {
+			return nil, err
+		}
+
+		testDoc, testDocOpen := clientInfo.Docs.GetOpenDocument(testUri)
+		testText := testDoc.Text
+		testFileExists := testDocOpen
+		if !testDocOpen {
+			content, err := os.ReadFile(testPath)
+			if err == nil {
+				testText = string(content)
+				testFileExists = true
+			} else if !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+
+		models, err := clientInfo.Config.Models.Get()
+		if err != nil {
+			return nil, err
+		}
+
+		model := *models.Default
+
+		filesContext, err := clientInfo.Config.BuildContext(clientInfo, model)
+		if err != nil {
+			return nil, err
+		}
+
+		prompt, err := clientInfo.Config.Prompts.Render("tests", &PromptData{
+			Filename:  sourcePath,
+			Language:  getLanguageName(definition.Location.URI, ""),
+			File:      sourceText,
+			Selection: definition.Text,
+			Context:   filesContext,
+			Examples:  testText,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		lsLogger.Info().Str("model", model).Str("prompt", prompt).Msg("Generating tests")
+
+		client.Progress(context.TODO(), &protocol.ProgressParams{
+			Value: &protocol.WorkDoneProgressBegin{
+				Kind:    protocol.WorkDoneProgressKindBegin,
+				Title:   "Sage tests",
+				Message: "generating tests for " + identifier + "...",
+			},
+		})
+
+		response, err := clientInfo.LLM.GenerateCompletion(context.TODO(), model, prompt)
+		if err != nil {
+			return nil, err
+		}
+
+		client.Progress(context.TODO(), &protocol.ProgressParams{
+			Value: &protocol.WorkDoneProgressEnd{
+				Kind:    protocol.WorkDoneProgressKindEnd,
+				Message: "Done!",
+			},
+		})
+
+		tests := strings.TrimSpace(stripCodeFences(response)) + "\n"
+		label := "sage: tests for " + identifier
+
+		if !testFileExists {
+			err = createFileWithText(client, clientInfo, label, testUri, tests)
+		} else {
+			err = appendToFile(client, clientInfo, label, testUri, tests)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		result := &protocol.ShowDocumentResult{}
+		_, err = client.Conn().Call(context.TODO(), string(protocol.MethodShowDocument), protocol.ShowDocumentParams{
+			URI:       testUri,
+			External:  false,
+			TakeFocus: true,
+			Selection: nil,
+		}, result)
+
+		return nil, err
+	},
+}
+
+// appendToFile adds text to the end of a file, separated from what's already
+// there by a blank line
+func appendToFile(client LspClient, clientInfo *LanguageServerClientInfo, label string, filename uri.URI, text string) error {
+	doc, ok := clientInfo.Docs.GetOpenDocument(filename)
+	currentText := doc.Text
+	if !ok {
+		content, err := os.ReadFile(filename.Filename())
+		if err != nil {
+			return err
+		}
+		currentText = string(content)
+	}
+
+	switch {
+	case currentText == "" || strings.HasSuffix(currentText, "\n\n"):
+	case strings.HasSuffix(currentText, "\n"):
+		text = "\n" + text
+	default:
+		text = "\n\n" + text
+	}
+
+	end := getPositionOffset(currentText)
+	edits := []protocol.TextEdit{
+		{
+			Range:   protocol.Range{Start: end, End: end},
+			NewText: text,
+		},
+	}
+
+	if ok {
+		// Open documents get versioned edits we can undo
+		return applyGeneratedEdits(client, clientInfo, label, filename, doc.Version, edits)
+	}
+
+	applied, err := applyUnversionedEdit(client, label, filename, edits)
+	if err != nil {
+		return err
+	}
+	if !applied {
+		return fmt.Errorf("Client refused to edit %s", filename.Filename())
+	}
+
+	return nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestGetTestFilePath(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected string
+		ok       bool
+	}{
+		{"/src/server.go", "/src/server_test.go", true},
+		{"/src/server_test.go", "/src/server_test.go", true},
+		{"/src/app/views.py", "/src/app/test_views.py", true},
+		{"/src/app/test_views.py", "/src/app/test_views.py", true},
+		{"/src/api.ts", "/src/api.spec.ts", true},
+		{"/src/Button.tsx", "/src/Button.spec.tsx", true},
+		{"/src/api.test.js", "/src/api.test.js", true},
+		{"/src/main.rs", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			result, ok := getTestFilePath(tt.path)
+			if ok != tt.ok || result != tt.expected {
+				t.Errorf("Expected (%q, %v), but got (%q, %v)", tt.expected, tt.ok, result, ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/everestmz/sage/docstate"
+	"github.com/everestmz/sage/lsp"
+	"go.lsp.dev/protocol"
+	"go.lsp.dev/uri"
+)
+
+// Generation is the regions of a document that sage generated, along with the
+// text each of them replaced. The regions are anchored, so they can still be
+// found after the user edits other parts of the document.
+type Generation struct {
+	Label string
+
+	uri     uri.URI
+	regions []*generatedRegion
+}
+
+// generatedRegion is one of the places a generation changed, like one hunk of
+// a rewrite. The user's code between them isn't part of the generation.
+type generatedRegion struct {
+	original string
+	start    *docstate.Anchor
+	end      *docstate.Anchor
+}
+
+// GeneratedEdit is a region of a document that a generation is about to
+// replace, and the text that's in it now
+type GeneratedEdit struct {
+	Region   protocol.Range
+	Original string
+}
+
+type GenerationHistory struct {
+	docs *docstate.DocumentState
+
+	lock        sync.Mutex
+	generations map[uri.URI][]*Generation
+	latest      *Generation
+}
+
+func NewGenerationHistory(docs *docstate.DocumentState) *GenerationHistory {
+	return &GenerationHistory{
+		docs:        docs,
+		generations: map[uri.URI][]*Generation{},
+	}
+}
+
+// Begin records a generation that is about to replace the text in each of
+// the edits' regions
+func (h *GenerationHistory) Begin(docUri uri.URI, edits []GeneratedEdit, label string) *Generation {
+	generation := &Generation{
+		Label: label,
+		uri:   docUri,
+	}
+	for _, edit := range edits {
+		generation.regions = append(generation.regions, &generatedRegion{
+			original: edit.Original,
+			// Text inserted at the start of the region by the generation should be inside it,
+			// and so should text inserted at the end
+			start: h.docs.AddAnchor(docUri, edit.Region.Start, docstate.AnchorGravityLeft),
+			end:   h.docs.AddAnchor(docUri, edit.Region.End, docstate.AnchorGravityRight),
+		})
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.generations[docUri] = append(h.generations[docUri], generation)
+	h.latest = generation
+
+	return generation
+}
+
+// Remove forgets a generation, either because it was undone or because it
+// never made it into the document
+func (h *GenerationHistory) Remove(generation *Generation) {
+	for _, region := range generation.regions {
+		h.docs.RemoveAnchor(region.start)
+		h.docs.RemoveAnchor(region.end)
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	generations := h.generations[generation.uri]
+	for i, g := range generations {
+		if g == generation {
+			h.generations[generation.uri] = append(generations[:i:i], generations[i+1:]...)
+			break
+		}
+	}
+
+	if h.latest == generation {
+		h.latest = nil
+		if remaining := h.generations[generation.uri]; len(remaining) > 0 {
+			h.latest = remaining[len(remaining)-1]
+		}
+	}
+}
+
+func (h *GenerationHistory) DocumentClosed(docUri uri.URI) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.latest != nil && h.latest.uri == docUri {
+		h.latest = nil
+	}
+
+	delete(h.generations, docUri)
+}
+
+// UndoEdits returns the edits that put back what each of the generation's
+// regions replaced, leaving everything between them alone, along with the
+// version of the document they're for
+func (h *GenerationHistory) UndoEdits(generation *Generation) ([]protocol.TextEdit, int32, bool) {
+	var pairs [][2]*docstate.Anchor
+	for _, region := range generation.regions {
+		pairs = append(pairs, [2]*docstate.Anchor{region.start, region.end})
+	}
+
+	ranges, version, ok := h.docs.AnchorRanges(pairs)
+	if !ok {
+		return nil, 0, false
+	}
+
+	var edits []protocol.TextEdit
+	for i, region := range generation.regions {
+		edits = append(edits, protocol.TextEdit{
+			Range:   ranges[i],
+			NewText: region.original,
+		})
+	}
+
+	return edits, version, true
+}
+
+// Find returns the most recent generation in the document containing
+// position. If position is nil, it returns the most recent generation in
+// the document, and if docUri is empty, the most recent one anywhere.
+func (h *GenerationHistory) Find(docUri uri.URI, position *protocol.Position) *Generation {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if docUri == "" {
+		return h.latest
+	}
+
+	generations := h.generations[docUri]
+	for i := len(generations) - 1; i >= 0; i-- {
+		if position == nil {
+			return generations[i]
+		}
+
+		for _, generated := range generations[i].regions {
+			region, _, ok := h.docs.AnchorRange(generated.start, generated.end)
+			if ok && rangeContains(region, *position) {
+				return generations[i]
+			}
+		}
+	}
+
+	return nil
+}
+
+func rangeContains(r protocol.Range, position protocol.Position) bool {
+	afterStart := position.Line > r.Start.Line || (position.Line == r.Start.Line && position.Character >= r.Start.Character)
+	beforeEnd := position.Line < r.End.Line || (position.Line == r.End.Line && position.Character <= r.End.Character)
+
+	return afterStart && beforeEnd
+}
+
+// applyGeneratedEdits applies edits that sage generated against a version of
+// the document, and records them as a single generation so they can be undone
+// together. Each edit gets its own region, so undoing them doesn't touch the
+// code between them.
+func applyGeneratedEdits(client LspClient, clientInfo *LanguageServerClientInfo, label string, filename uri.URI, version int32, edits []protocol.TextEdit) error {
+	if len(edits) == 0 {
+		return nil
+	}
+
+	doc, ok := clientInfo.Docs.GetOpenDocument(filename)
+	if !ok || doc.Version != version {
+		return fmt.Errorf("%s has changed since the edit was generated - please generate it again", filename.Filename())
+	}
+
+	var generated []GeneratedEdit
+	for _, edit := range edits {
+		generated = append(generated, GeneratedEdit{
+			Region:   edit.Range,
+			Original: doc.Text[lsp.GetOffset(doc.Text, edit.Range.Start):lsp.GetOffset(doc.Text, edit.Range.End)],
+		})
+	}
+
+	generation := clientInfo.Generations.Begin(filename, generated, label)
+
+	applied, err := applyVersionedEdit(client, clientInfo, label, filename, version, edits)
+	if err != nil || !applied {
+		clientInfo.Generations.Remove(generation)
+	}
+	if err != nil {
+		return err
+	}
+
+	if !applied {
+		return fmt.Errorf("%s has changed since the edit was generated - please generate it again", filename.Filename())
+	}
+
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/everestmz/sage/docstate"
+	"go.lsp.dev/protocol"
+	"go.lsp.dev/uri"
+)
+
+func TestGenerationUndoEdits(t *testing.T) {
+	docUri := uri.File("/ws/main.go")
+	lineRange := func(line uint32, character uint32) protocol.Range {
+		return protocol.Range{
+			Start: protocol.Position{Line: line},
+			End:   protocol.Position{Line: line, Character: character},
+		}
+	}
+
+	docs := docstate.NewDocumentState()
+	docs.OpenDocument(&protocol.TextDocumentItem{
+		URI:     docUri,
+		Version: 1,
+		Text:    "one\ntwo\nthree\nfour",
+	})
+	history := NewGenerationHistory(docs)
+
+	// Edits are applied last first, so they don't move each other
+	change := func(version int32, changes ...protocol.TextDocumentContentChangeEvent) {
+		err := docs.ChangeDocument(docUri, version, changes, applyChangesToDocument)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A rewrite with two hunks, and the user's code between them
+	generation := history.Begin(docUri, []GeneratedEdit{
+		{Region: lineRange(0, 3), Original: "one"},
+		{Region: lineRange(2, 5), Original: "three"},
+	}, "sage: rewrite selection")
+	change(2,
+		protocol.TextDocumentContentChangeEvent{Range: lineRange(2, 5), Text: "THREE"},
+		protocol.TextDocumentContentChangeEvent{Range: lineRange(0, 3), Text: "ONE"},
+	)
+
+	// The user edits between the hunks after the generation
+	change(3, protocol.TextDocumentContentChangeEvent{Range: lineRange(1, 3), Text: "my two"})
+
+	if found := history.Find(docUri, &protocol.Position{Line: 1, Character: 2}); found != nil {
+		t.Errorf("Expected the user's code not to be part of the generation, but found %q", found.Label)
+	}
+	if found := history.Find(docUri, &protocol.Position{Line: 2, Character: 2}); found != generation {
+		t.Errorf("Expected to find the generation in its second hunk, but got %v", found)
+	}
+
+	edits, version, ok := history.UndoEdits(generation)
+	if !ok {
+		t.Fatal("Expected undo edits for the generation")
+	}
+	if version != 3 {
+		t.Errorf("Expected undo edits for version 3, but got %d", version)
+	}
+
+	var changes []protocol.TextDocumentContentChangeEvent
+	for i := len(edits) - 1; i >= 0; i-- {
+		changes = append(changes, protocol.TextDocumentContentChangeEvent{Range: edits[i].Range, Text: edits[i].NewText})
+	}
+	change(4, changes...)
+
+	doc, _ := docs.GetOpenDocument(docUri)
+	expected := "one\nmy two\nthree\nfour"
+	if doc.Text != expected {
+		t.Errorf("Expected undone text %q, but got %q", expected, doc.Text)
+	}
+}
+
+func TestApplyGeneratedEditsToChangedDocument(t *testing.T) {
+	docUri := uri.File("/ws/main.go")
+	docs := docstate.NewDocumentState()
+	docs.OpenDocument(&protocol.TextDocumentItem{
+		URI:     docUri,
+		Version: 1,
+		Text:    "one\ntwo",
+	})
+
+	// The user added a line above the selection while the rewrite was generating
+	err := docs.ChangeDocument(docUri, 2, []protocol.TextDocumentContentChangeEvent{
+		{Text: "zero\n"},
+	}, applyChangesToDocument)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientInfo := &LanguageServerClientInfo{Docs: docs, Generations: NewGenerationHistory(docs)}
+	err = applyGeneratedEdits(LspClient{}, clientInfo, "sage: rewrite selection", docUri, 1, []protocol.TextEdit{
+		{Range: protocol.Range{End: protocol.Position{Character: 3}}, NewText: "ONE"},
+	})
+	if err == nil {
+		t.Errorf("Expected edits generated against version 1 to be rejected")
+	}
+
+	if generation := clientInfo.Generations.Find(docUri, nil); generation != nil {
+		t.Errorf("Expected no generation to be recorded, but got %q", generation.Label)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/everestmz/sage/docstate"
+	"github.com/everestmz/sage/lsp"
+	"go.lsp.dev/protocol"
+	"go.lsp.dev/uri"
+)
+
+// HoverExplainer explains hovered symbols with the ExplainCode model. Explanations
+// are cached in the index by a hash of the definition's text and the model, so
+// they're only regenerated when the definition or the model changes.
+type HoverExplainer struct {
+	db     *DB
+	llm    *LLMClient
+	config *SagePathConfig
+
+	lock       sync.Mutex
+	generating map[string]bool // By model and hash
+}
+
+func NewHoverExplainer(db *DB, llm *LLMClient, config *SagePathConfig) *HoverExplainer {
+	return &HoverExplainer{
+		db:         db,
+		llm:        llm,
+		config:     config,
+		generating: map[string]bool{},
+	}
+}
+
+// Explain returns the cached explanation for the symbol at position. If there
+// isn't one yet, it starts generating one in the background and returns
+// pending, since we can't hold up the hover (or every other request) for the model.
+func (he *HoverExplainer) Explain(docs *docstate.DocumentState, docUri uri.URI, position protocol.Position) (explanation string, pending bool, err error) {
+	doc, ok := docs.GetOpenDocument(docUri)
+	if !ok {
+		return "", false, nil
+	}
+
+	identifier := lsp.GetIdentifierAtPosition(doc.Text, position)
+	if identifier == "" {
+		return "", false, nil
+	}
+
+	definition, ok, err := findIndexedDefinition(he.db, docs, docUri, identifier)
+	if err != nil || !ok {
+		return "", false, err
+	}
+
+	models, err := he.config.Models.Get()
+	if err != nil {
+		return "", false, err
+	}
+	model := *models.ExplainCode
+
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(definition.Text)))
+	explanation, ok, err = he.db.GetExplanation(hash, model)
+	if err != nil {
+		return "", false, err
+	}
+	if ok {
+		return explanation, false, nil
+	}
+
+	he.lock.Lock()
+	defer he.lock.Unlock()
+
+	key := model + " " + hash
+	if !he.generating[key] {
+		he.generating[key] = true
+		go he.generate(key, hash, model, definition)
+	}
+
+	return "", true, nil
+}
+
+func (he *HoverExplainer) generate(key, hash, model string, definition *IndexedDefinition) {
+	defer func() {
+		he.lock.Lock()
+		defer he.lock.Unlock()
+
+		delete(he.generating, key)
+	}()
+
+	logger := globalLsLogger.With().Str("hash", hash).Str("model", model).Logger()
+
+	prompt, err := he.config.Prompts.Render("hover", &PromptData{
+		Filename:  definition.Location.URI.Filename(),
+		Language:  getLanguageName(definition.Location.URI, ""),
+		Selection: definition.Text,
+	})
+	if err != nil {
+		logger.Error().Err(err).Msg("Error building hover explanation prompt")
+		return
+	}
+
+	explanation, err := he.llm.GenerateCompletion(context.TODO(), model, prompt)
+	if err != nil {
+		logger.Error().Err(err).Msg("Error generating hover explanation")
+		return
+	}
+
+	err = he.db.InsertExplanation(hash, model, strings.TrimSpace(explanation))
+	if err != nil {
+		logger.Error().Err(err).Msg("Error caching hover explanation")
+	}
+}
+
+// appendHoverExplanation adds the explanation to the child's hover result. If
+// the result isn't something we understand, it's returned unchanged.
+func appendHoverExplanation(result any, explanation string) any {
+	hover := &protocol.Hover{
+		Contents: protocol.MarkupContent{
+			Kind: protocol.Markdown,
+		},
+	}
+
+	if result != nil {
+		bs, err := json.Marshal(result)
+		if err != nil {
+			return result
+		}
+
+		// Older servers send MarkedStrings, which we leave alone
+		err = json.Unmarshal(bs, hover)
+		if err != nil || hover.Contents.Kind == "" {
+			return result
+		}
+	}
+
+	if hover.Contents.Value != "" {
+		if hover.Contents.Kind == protocol.Markdown {
+			hover.Contents.Value += "\n\n---\n\n"
+		} else {
+			hover.Contents.Value += "\n\n"
+		}
+	}
+
+	if hover.Contents.Kind == protocol.Markdown {
+		hover.Contents.Value += "**sage:** " + explanation
+	} else {
+		hover.Contents.Value += "sage: " + explanation
+	}
+
+	return hover
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestAppendHoverExplanation(t *testing.T) {
+	tests := []struct {
+		name     string
+		result   string
+		expected string
+	}{
+		{
+			name:     "No hover from child",
+			result:   `null`,
+			expected: `{"contents":{"kind":"markdown","value":"**sage:** Starts it"}}`,
+		},
+		{
+			name:     "Markdown hover",
+			result:   `{"contents":{"kind":"markdown","value":"func Start()"}}`,
+			expected: `{"contents":{"kind":"markdown","value":"func Start()\n\n---\n\n**sage:** Starts it"}}`,
+		},
+		{
+			name:     "Plaintext hover",
+			result:   `{"contents":{"kind":"plaintext","value":"func Start()"}}`,
+			expected: `{"contents":{"kind":"plaintext","value":"func Start()\n\nsage: Starts it"}}`,
+		},
+		{
+			name:     "MarkedString hover is left alone",
+			result:   `{"contents":"func Start()"}`,
+			expected: `{"contents":"func Start()"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var result any
+			err := json.Unmarshal([]byte(tt.result), &result)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			bs, err := json.Marshal(appendHoverExplanation(result, "Starts it"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(bs) != tt.expected {
+				t.Errorf("Expected hover %s, but got %s", tt.expected, string(bs))
+			}
+		})
+	}
+}
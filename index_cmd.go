@@ -325,28 +325,41 @@ func indexFile(wd, path string, content []byte, config *SagePathConfig, llm *LLM
 		if shouldEmbed {
 			symbolText := lsp.GetRangeFromFile(string(content), calculatedInfo.Location.Range)
 
-			prompt := "\n============= INSTRUCTIONS: ================\nDescribe the following code. Be concise, but descriptive. Use domain-specific terms like function names, class names, etc. Make sure you cover as many edge cases and interesting codepaths/features as possible. Above this message is more code from the same file as this symbol. Your response will be indexed for full-text search. DO NOT reproduce the code with comments. Simply write a short but descriptive paragraph about the code:\n"
-
-			prompt += "File: " + path + "\n"
+			models, err := config.Models.Get()
+			if err != nil {
+				return nil, err
+			}
 
 			var explanation string
 
+			// There's no default describe prompt until this is turned back on.
+			// It should include the file and the symbol, not just instructions.
 			// if len(strings.Split(symbolText, "\n")) > 2 {
-			// 	explanation, err = llm.GenerateCompletion(context.TODO(), *config.Models.ExplainCode, textDoc.Text+prompt+symbolText)
+			// 	symbolStart := lsp.GetOffset(string(content), calculatedInfo.Location.Range.Start)
+			// 	symbolEnd := lsp.GetOffset(string(content), calculatedInfo.Location.Range.End)
+			//
+			// 	describePrompt, err := config.Prompts.Render("describe", &PromptData{
+			// 		Filename:   path,
+			// 		Language:   getLanguageName(uri.File(path), ""),
+			// 		File:       string(content),
+			// 		FilePrefix: string(content[:symbolStart]),
+			// 		FileSuffix: string(content[symbolEnd:]),
+			// 		Selection:  symbolText,
+			// 	})
+			// 	if err != nil {
+			// 		return nil, err
+			// 	}
+			//
+			// 	explanation, err = llm.GenerateCompletion(context.TODO(), *models.ExplainCode, describePrompt)
 			// 	if err != nil {
 			// 		return nil, err
 			// 	}
 			// }
 
-			prompt = explanation + "\n" + symbolText
+			prompt := explanation + "\n" + symbolText
 
 			// fmt.Fprintln(os.Stderr, prompt)
 
-			models, err := config.Models.Get()
-			if err != nil {
-				return nil, err
-			}
-
 			embedding, err := llm.GetEmbedding(context.TODO(), *models.Embedding, prompt)
 			if err != nil {
 				return nil, err
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/everestmz/sage/docstate"
+	"go.lsp.dev/protocol"
+	"go.lsp.dev/uri"
+)
+
+// go.lsp.dev/protocol predates LSP 3.18, so the inline completion types live here
+
+const MethodTextDocumentInlineCompletion = "textDocument/inlineCompletion"
+
+type InlineCompletionTriggerKind uint32
+
+const (
+	InlineCompletionTriggerKindInvoked   InlineCompletionTriggerKind = 1
+	InlineCompletionTriggerKindAutomatic InlineCompletionTriggerKind = 2
+)
+
+type InlineCompletionContext struct {
+	TriggerKind InlineCompletionTriggerKind `json:"triggerKind"`
+}
+
+type InlineCompletionParams struct {
+	protocol.TextDocumentPositionParams
+	Context InlineCompletionContext `json:"context"`
+}
+
+type InlineCompletionItem struct {
+	InsertText string          `json:"insertText"`
+	FilterText string          `json:"filterText,omitempty"`
+	Range      *protocol.Range `json:"range,omitempty"`
+}
+
+type InlineCompletionList struct {
+	Items []InlineCompletionItem `json:"items"`
+}
+
+type SageServerCapabilities struct {
+	protocol.ServerCapabilities
+
+	InlineCompletionProvider bool `json:"inlineCompletionProvider,omitempty"`
+}
+
+// SageInitializeResult is the child's InitializeResult plus any capabilities
+// sage adds that the protocol package doesn't know about yet
+type SageInitializeResult struct {
+	Capabilities SageServerCapabilities `json:"capabilities"`
+	ServerInfo   *protocol.ServerInfo   `json:"serverInfo,omitempty"`
+}
+
+const (
+	inlineCompletionDebounce    = 300 * time.Millisecond
+	inlineCompletionMaxTokens   = 64
+	inlineCompletionPrefixLines = 200
+	inlineCompletionSuffixLines = 50
+)
+
+type inlineSuggestion struct {
+	version  int32
+	position protocol.Position
+	text     string
+}
+
+type pendingInlineCompletion struct {
+	version  int32
+	position protocol.Position
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+// inlineCompletionRequest is a textDocument/inlineCompletion request we're
+// still answering. The dispatcher doesn't handle $/cancelRequest, so nothing
+// cancels these but us.
+type inlineCompletionRequest struct {
+	cancel context.CancelFunc
+}
+
+// InlineCompletionEngine generates fill-in-the-middle suggestions for
+// textDocument/inlineCompletion. Edits are debounced, so we start generating
+// once the user pauses, and any generation still running when the document
+// version moves on is cancelled since its suggestion would be stale.
+type InlineCompletionEngine struct {
+	llm    *LLMClient
+	config *SagePathConfig
+	docs   *docstate.DocumentState
+
+	lock sync.Mutex
+	// We only prefetch on didChange once the client has asked us for an
+	// inline completion, so editors without support don't pay for it
+	enabled  bool
+	pending  map[uri.URI]*pendingInlineCompletion
+	requests map[uri.URI]map[*inlineCompletionRequest]bool
+	last     map[uri.URI]*inlineSuggestion
+}
+
+func NewInlineCompletionEngine(llm *LLMClient, config *SagePathConfig, docs *docstate.DocumentState) *InlineCompletionEngine {
+	return &InlineCompletionEngine{
+		llm:      llm,
+		config:   config,
+		docs:     docs,
+		pending:  map[uri.URI]*pendingInlineCompletion{},
+		requests: map[uri.URI]map[*inlineCompletionRequest]bool{},
+		last:     map[uri.URI]*inlineSuggestion{},
+	}
+}
+
+// cancelRequests must be called with e.lock held. It stops the requests for
+// a document, whose suggestions are stale now that it's changed.
+func (e *InlineCompletionEngine) cancelRequests(docUri uri.URI) {
+	for request := range e.requests[docUri] {
+		request.cancel()
+	}
+	delete(e.requests, docUri)
+}
+
+// requestContext is ctx, but cancelled by the next change to the document.
+// Call done once the request has been answered.
+func (e *InlineCompletionEngine) requestContext(ctx context.Context, docUri uri.URI) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	request := &inlineCompletionRequest{cancel: cancel}
+
+	e.lock.Lock()
+	if e.requests[docUri] == nil {
+		e.requests[docUri] = map[*inlineCompletionRequest]bool{}
+	}
+	e.requests[docUri][request] = true
+	e.lock.Unlock()
+
+	return ctx, func() {
+		e.lock.Lock()
+		delete(e.requests[docUri], request)
+		if len(e.requests[docUri]) == 0 {
+			delete(e.requests, docUri)
+		}
+		e.lock.Unlock()
+
+		cancel()
+	}
+}
+
+// DocumentChanged should be called after every didChange has been applied to
+// the document state. It cancels any generation for an older version, whether
+// it's a prefetch or answering a request, and schedules a new one at the cursor
+// once the debounce period has passed.
+func (e *InlineCompletionEngine) DocumentChanged(docUri uri.URI, version int32, cursor protocol.Position) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if pending, ok := e.pending[docUri]; ok {
+		pending.cancel()
+		delete(e.pending, docUri)
+	}
+	e.cancelRequests(docUri)
+
+	if !e.enabled {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pending := &pendingInlineCompletion{
+		version:  version,
+		position: cursor,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	e.pending[docUri] = pending
+
+	go func() {
+		defer close(pending.done)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(inlineCompletionDebounce):
+		}
+
+		_, err := e.generate(ctx, docUri, version, cursor)
+		if err != nil && ctx.Err() == nil {
+			globalLsLogger.Error().Err(err).Str("uri", string(docUri)).Msg("Error prefetching inline completion")
+		}
+	}()
+}
+
+func (e *InlineCompletionEngine) DocumentClosed(docUri uri.URI) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if pending, ok := e.pending[docUri]; ok {
+		pending.cancel()
+		delete(e.pending, docUri)
+	}
+	e.cancelRequests(docUri)
+	delete(e.last, docUri)
+}
+
+// Complete answers a textDocument/inlineCompletion request, preferring the
+// cached or in-flight suggestion for this cursor position over a new generation.
+// If the document changes before it's done, it gives up and suggests nothing.
+func (e *InlineCompletionEngine) Complete(ctx context.Context, params *InlineCompletionParams) ([]InlineCompletionItem, error) {
+	docUri := params.TextDocument.URI
+
+	// Before we look at the document, so no change can slip in between
+	ctx, done := e.requestContext(ctx, docUri)
+	defer done()
+
+	items, err := e.complete(ctx, params)
+	if err != nil && ctx.Err() != nil {
+		// Stale, not broken
+		return []InlineCompletionItem{}, nil
+	}
+
+	return items, err
+}
+
+func (e *InlineCompletionEngine) complete(ctx context.Context, params *InlineCompletionParams) ([]InlineCompletionItem, error) {
+	docUri := params.TextDocument.URI
+	position := params.Position
+
+	doc, ok := e.docs.GetOpenDocument(docUri)
+	if !ok {
+		return nil, nil
+	}
+
+	e.lock.Lock()
+	e.enabled = true
+	if text, ok := e.cachedSuggestion(doc, position); ok {
+		e.lock.Unlock()
+		return suggestionItems(text, position), nil
+	}
+
+	pending, hasPending := e.pending[docUri]
+	e.lock.Unlock()
+
+	if hasPending && pending.version == doc.Version && pending.position == position {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-pending.done:
+		}
+
+		e.lock.Lock()
+		text, ok := e.cachedSuggestion(doc, position)
+		e.lock.Unlock()
+		if ok {
+			return suggestionItems(text, position), nil
+		}
+	} else if params.Context.TriggerKind != InlineCompletionTriggerKindInvoked {
+		// Automatic requests arrive on every keystroke. The next keystroke's
+		// didChange cancels this one, so waiting here lets them fall away cheaply.
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(inlineCompletionDebounce):
+		}
+	}
+
+	text, err := e.generate(ctx, docUri, doc.Version, position)
+	if err != nil {
+		return nil, err
+	}
+
+	return suggestionItems(text, position), nil
+}
+
+// cachedSuggestion must be called with e.lock held. If the user has typed
+// the start of the last suggestion since it was made, the rest of it is
+// still a valid suggestion.
+func (e *InlineCompletionEngine) cachedSuggestion(doc docstate.OpenDocument, position protocol.Position) (string, bool) {
+	last, ok := e.last[doc.URI]
+	if !ok || last.position.Line != position.Line || last.position.Character > position.Character {
+		return "", false
+	}
+
+	if last.version == doc.Version {
+		return last.text, last.position == position
+	}
+
+	lines := strings.Split(doc.Text, "\n")
+	if int(position.Line) >= len(lines) || int(position.Character) > len(lines[position.Line]) {
+		return "", false
+	}
+
+	typed := lines[position.Line][last.position.Character:position.Character]
+	if !strings.HasPrefix(last.text, typed) || len(typed) == len(last.text) {
+		return "", false
+	}
+
+	return last.text[len(typed):], true
+}
+
+func (e *InlineCompletionEngine) generate(ctx context.Context, docUri uri.URI, version int32, position protocol.Position) (string, error) {
+	doc, ok := e.docs.GetOpenDocument(docUri)
+	if !ok || doc.Version != version {
+		return "", nil
+	}
+
+	prefix, suffix, ok := splitAtPosition(doc.Text, position)
+	if !ok {
+		return "", nil
+	}
+
+	models, err := e.config.Models.Get()
+	if err != nil {
+		return "", err
+	}
+
+	model := DefaultInlineCompletionModel
+	if models.InlineCompletion != nil {
+		model = *models.InlineCompletion
+	}
+
+	completion, err := e.llm.GenerateFillInMiddle(ctx, model, prefix, suffix, inlineCompletionMaxTokens)
+	if err != nil {
+		return "", err
+	}
+
+	completion = strings.TrimRight(completion, " \t\n")
+
+	// Only cache the suggestion if nobody typed while we were generating
+	current, ok := e.docs.GetOpenDocument(docUri)
+	if ok && current.Version == version {
+		e.lock.Lock()
+		e.last[docUri] = &inlineSuggestion{
+			version:  version,
+			position: position,
+			text:     completion,
+		}
+		e.lock.Unlock()
+	}
+
+	return completion, nil
+}
+
+func splitAtPosition(text string, position protocol.Position) (prefix, suffix string, ok bool) {
+	lines := strings.Split(text, "\n")
+	if int(position.Line) >= len(lines) {
+		return "", "", false
+	}
+
+	cursorLine := lines[position.Line]
+	character := int(position.Character)
+	if character > len(cursorLine) {
+		character = len(cursorLine)
+	}
+
+	prefixStart := int(position.Line) - inlineCompletionPrefixLines
+	if prefixStart < 0 {
+		prefixStart = 0
+	}
+
+	suffixEnd := int(position.Line) + inlineCompletionSuffixLines
+	if suffixEnd >= len(lines) {
+		suffixEnd = len(lines) - 1
+	}
+
+	prefixLines := append(append([]string{}, lines[prefixStart:position.Line]...), cursorLine[:character])
+	suffixLines := append([]string{cursorLine[character:]}, lines[position.Line+1:suffixEnd+1]...)
+
+	return strings.Join(prefixLines, "\n"), strings.Join(suffixLines, "\n"), true
+}
+
+func suggestionItems(text string, position protocol.Position) []InlineCompletionItem {
+	if text == "" {
+		return []InlineCompletionItem{}
+	}
+
+	return []InlineCompletionItem{
+		{
+			InsertText: text,
+			Range: &protocol.Range{
+				Start: position,
+				End:   position,
+			},
+		},
+	}
+}
+
+// getCursorAfterChanges estimates where the cursor ended up after a set of
+// content changes: at the end of the text inserted by the last one.
+func getCursorAfterChanges(changes []protocol.TextDocumentContentChangeEvent) (protocol.Position, bool) {
+	if len(changes) == 0 {
+		return protocol.Position{}, false
+	}
+
+	change := changes[len(changes)-1]
+	cursor := change.Range.Start
+	offset := getPositionOffset(change.Text)
+	if offset.Line > 0 {
+		cursor.Line += offset.Line
+		cursor.Character = offset.Character
+	} else {
+		cursor.Character += offset.Character
+	}
+
+	return cursor, true
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/everestmz/sage/docstate"
+	"go.lsp.dev/protocol"
+	"go.lsp.dev/uri"
+)
+
+func TestSplitAtPosition(t *testing.T) {
+	tests := []struct {
+		name           string
+		text           string
+		position       protocol.Position
+		expectedPrefix string
+		expectedSuffix string
+		expectedOk     bool
+	}{
+		{
+			name:           "Middle of line",
+			text:           "func main() {\n\tfmt.Pr\n}\n",
+			position:       protocol.Position{Line: 1, Character: 7},
+			expectedPrefix: "func main() {\n\tfmt.Pr",
+			expectedSuffix: "\n}\n",
+			expectedOk:     true,
+		},
+		{
+			name:           "Start of file",
+			text:           "package main\n",
+			position:       protocol.Position{Line: 0, Character: 0},
+			expectedPrefix: "",
+			expectedSuffix: "package main\n",
+			expectedOk:     true,
+		},
+		{
+			name:           "Character past end of line",
+			text:           "abc\ndef",
+			position:       protocol.Position{Line: 0, Character: 10},
+			expectedPrefix: "abc",
+			expectedSuffix: "\ndef",
+			expectedOk:     true,
+		},
+		{
+			name:       "Line out of bounds",
+			text:       "abc",
+			position:   protocol.Position{Line: 3, Character: 0},
+			expectedOk: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prefix, suffix, ok := splitAtPosition(tt.text, tt.position)
+			if ok != tt.expectedOk {
+				t.Fatalf("Expected ok %v, but got %v", tt.expectedOk, ok)
+			}
+
+			if prefix != tt.expectedPrefix {
+				t.Errorf("Expected prefix %q, but got %q", tt.expectedPrefix, prefix)
+			}
+
+			if suffix != tt.expectedSuffix {
+				t.Errorf("Expected suffix %q, but got %q", tt.expectedSuffix, suffix)
+			}
+		})
+	}
+}
+
+func TestGetCursorAfterChanges(t *testing.T) {
+	tests := []struct {
+		name     string
+		changes  []protocol.TextDocumentContentChangeEvent
+		expected protocol.Position
+	}{
+		{
+			name: "Single character insert",
+			changes: []protocol.TextDocumentContentChangeEvent{
+				{
+					Range: protocol.Range{
+						Start: protocol.Position{Line: 2, Character: 4},
+						End:   protocol.Position{Line: 2, Character: 4},
+					},
+					Text: "a",
+				},
+			},
+			expected: protocol.Position{Line: 2, Character: 5},
+		},
+		{
+			name: "Newline insert",
+			changes: []protocol.TextDocumentContentChangeEvent{
+				{
+					Range: protocol.Range{
+						Start: protocol.Position{Line: 2, Character: 4},
+						End:   protocol.Position{Line: 2, Character: 4},
+					},
+					Text: "\n\t",
+				},
+			},
+			expected: protocol.Position{Line: 3, Character: 1},
+		},
+		{
+			name: "Deletion",
+			changes: []protocol.TextDocumentContentChangeEvent{
+				{
+					Range: protocol.Range{
+						Start: protocol.Position{Line: 1, Character: 2},
+						End:   protocol.Position{Line: 1, Character: 6},
+					},
+					Text: "",
+				},
+			},
+			expected: protocol.Position{Line: 1, Character: 2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cursor, ok := getCursorAfterChanges(tt.changes)
+			if !ok {
+				t.Fatalf("Expected a cursor position")
+			}
+
+			if cursor != tt.expected {
+				t.Errorf("Expected cursor %v, but got %v", tt.expected, cursor)
+			}
+		})
+	}
+}
+
+func TestInlineCompletionCancelledByChange(t *testing.T) {
+	docUri := uri.File("/ws/main.go")
+	docs := docstate.NewDocumentState()
+	docs.OpenDocument(&protocol.TextDocumentItem{
+		URI:     docUri,
+		Version: 1,
+		Text:    "func main() {\n\t\n}",
+	})
+
+	// No LLM or config, since it should never get as far as generating
+	engine := NewInlineCompletionEngine(nil, nil, docs)
+
+	type result struct {
+		items []InlineCompletionItem
+		err   error
+	}
+	results := make(chan result)
+	go func() {
+		items, err := engine.Complete(context.Background(), &InlineCompletionParams{
+			TextDocumentPositionParams: protocol.TextDocumentPositionParams{
+				TextDocument: protocol.TextDocumentIdentifier{URI: docUri},
+				Position:     protocol.Position{Line: 1, Character: 1},
+			},
+			Context: InlineCompletionContext{TriggerKind: InlineCompletionTriggerKindAutomatic},
+		})
+		results <- result{items, err}
+	}()
+
+	// Wait for it to start waiting out the debounce
+	for {
+		engine.lock.Lock()
+		started := len(engine.requests[docUri]) > 0
+		engine.lock.Unlock()
+		if started {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The next keystroke. Its prefetch sees the document hasn't caught up and
+	// doesn't generate either.
+	engine.DocumentChanged(docUri, 2, protocol.Position{Line: 1, Character: 2})
+
+	select {
+	case r := <-results:
+		if r.err != nil || len(r.items) != 0 {
+			t.Errorf("Expected no suggestion and no error, but got %v and %v", r.items, r.err)
+		}
+	case <-time.After(inlineCompletionDebounce / 2):
+		t.Fatal("Expected the change to cancel the request before the debounce was up")
+	}
+
+	engine.lock.Lock()
+	defer engine.lock.Unlock()
+	if len(engine.requests) != 0 {
+		t.Errorf("Expected no requests left, but got %d", len(engine.requests))
+	}
+}
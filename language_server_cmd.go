@@ -4,7 +4,9 @@ import (
 	"context"
 	"crypto/sha1"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -13,8 +15,11 @@ import (
 	"time"
 
 	"github.com/everestmz/sage/docstate"
+	"github.com/everestmz/sage/locality"
 	"github.com/everestmz/sage/lsp"
 	"github.com/everestmz/sage/rpc/server"
+	"github.com/go-git/go-git/v5"
+	"github.com/gobwas/glob"
 	"github.com/rs/zerolog"
 	"github.com/spf13/cobra"
 	"go.lsp.dev/jsonrpc2"
@@ -224,7 +229,12 @@ func NewLanguageServerClientInfo(config *SagePathConfig, llm *LLMClient) *Langua
 	server.StartStateServer(docs, getWorkspaceSocketPath(wd))
 
 	return &LanguageServerClientInfo{
-		Docs: docs,
+		Docs:              docs,
+		InlineCompletions: NewInlineCompletionEngine(llm, config, docs),
+		Previews:          NewPreviewStore(filepath.Join(getWorkspaceDir(wd), "previews")),
+		Generations:       NewGenerationHistory(docs),
+		HoverExplanations: NewHoverExplainer(db, llm, config),
+		Diagnostics:       NewDiagnosticsCache(),
 
 		LLM:    llm,
 		Config: config,
@@ -236,50 +246,245 @@ func NewLanguageServerClientInfo(config *SagePathConfig, llm *LLMClient) *Langua
 }
 
 type LanguageServerClientInfo struct {
-	Docs *docstate.DocumentState
-
-	LLM    *LLMClient
-	Config *SagePathConfig
-
-	stateDir string
-	db       *DB
-	wd       string
+	Docs              *docstate.DocumentState
+	InlineCompletions *InlineCompletionEngine
+	Previews          *PreviewStore
+	Generations       *GenerationHistory
+	HoverExplanations *HoverExplainer
+	Diagnostics       *DiagnosticsCache
+
+	LLM                *LLMClient
+	Config             *SagePathConfig
+	Locality           *locality.Locality   // Only set once the child has started
+	Child              *ChildLanguageServer // Only set once the child has started
+	ClientCapabilities protocol.ClientCapabilities
+
+	registrations commandRegistrations
+	stateDir      string
+	db            *DB
+	wd            string
+
+	client protocol.Client // Nil outside the language server
+	// What was left out of the last context we built, so we don't show the
+	// same warnings again, and the profile it was built from
+	contextWarnings        []*ContextWarning
+	contextWarningsProfile string
+	contextWarningsLock    sync.Mutex
 }
 
 func (ci *LanguageServerClientInfo) GetSymbol(filename string, symbol string) (string, error) {
-	symbols, err := ci.db.FindSymbolByPrefix(symbol)
-	if err != nil {
-		return "", err
-	}
-
 	// XXX: there be dragons here! If a file is modified but the new modifications haven't been indexed,
 	// then we're in for trouble, since the ranges will be wrong! Maybe ok if we cache at a higher level.
 	// Maybe we need to build in some reindexing into our LSP - either that, or we need to cache the symbol
 	// text in the DB, but that'd probably grow the size too much.
+	sym, err := ci.findContextSymbol(filename, symbol)
+	if err != nil {
+		return "", err
+	}
 
-	for _, sym := range symbols {
+	fileContent, err := ci.GetFile(filename)
+	if err != nil {
+		return "", err
+	}
+
+	return lsp.GetRangeFromFile(fileContent, sym.Location.Range), nil
+}
+
+// findContextSymbol finds the indexed symbol that a context.txt line refers to
+func (ci *LanguageServerClientInfo) findContextSymbol(filename string, symbol string) (*protocol.SymbolInformation, error) {
+	symbols, err := ci.db.FindSymbolByPrefix(symbol)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, sym := range symbols {
 		if strings.HasSuffix(sym.Location.URI.Filename(), filename) {
-			fileContent, err := ci.GetFile(filename)
-			if err != nil {
-				return "", err
-			}
-			symbolText := lsp.GetRangeFromFile(fileContent, sym.Location.Range)
-			return symbolText, nil
+			return &symbols[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("Symbol '%s' not found for filename '%s' - check naming", symbol, filename)
+}
+
+// IndexedDefinition is a symbol's definition, as found in the index
+type IndexedDefinition struct {
+	protocol.SymbolInformation
+	Text string
+}
+
+// findIndexedDefinition looks an identifier up in the index, preferring a
+// definition in docUri. The definition's text comes from the open document if
+// there is one, since the file on disk may be stale.
+func findIndexedDefinition(db *DB, docs *docstate.DocumentState, docUri uri.URI, identifier string) (*IndexedDefinition, bool, error) {
+	symbols, err := db.FindSymbolByPrefix(identifier)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var symbol *protocol.SymbolInformation
+	for i, sym := range symbols {
+		if sym.Name != identifier {
+			continue
+		}
+
+		if symbol == nil || sym.Location.URI == docUri {
+			symbol = &symbols[i]
+		}
+	}
+
+	if symbol == nil {
+		return nil, false, nil
+	}
+
+	var text string
+	if doc, ok := docs.GetOpenDocument(symbol.Location.URI); ok {
+		text = doc.Text
+	} else {
+		content, err := os.ReadFile(symbol.Location.URI.Filename())
+		if err != nil {
+			return nil, false, err
+		}
+		text = string(content)
+	}
+
+	return &IndexedDefinition{
+		SymbolInformation: *symbol,
+		Text:              lsp.GetRangeFromFile(text, symbol.Location.Range),
+	}, true, nil
+}
+
+func childSupportsDefinitions(child *ChildLanguageServer) bool {
+	if child == nil || child.InitResult == nil {
+		return false
+	}
+
+	provider := child.InitResult.Capabilities.DefinitionProvider
+	return provider != nil && provider != false
+}
+
+// childSupportsCompletion and childSupportsHover are whether the child does
+// them itself, rather than us having said we do so we can for context.txt
+func childSupportsCompletion(child *ChildLanguageServer) bool {
+	return child != nil && child.InitResult != nil && child.InitResult.Capabilities.CompletionProvider != nil
+}
+
+func childSupportsHover(child *ChildLanguageServer) bool {
+	if child == nil || child.InitResult == nil {
+		return false
+	}
+
+	provider := child.InitResult.Capabilities.HoverProvider
+	return provider != nil && provider != false
+}
+
+// indexDefinitionProvider finds definitions in the index, for locality to use
+// when the child can't
+type indexDefinitionProvider struct {
+	db   *DB
+	docs *docstate.DocumentState
+}
+
+func (ip *indexDefinitionProvider) Definition(ctx context.Context, params *protocol.DefinitionParams) ([]protocol.Location, error) {
+	docUri := params.TextDocument.URI
+
+	var text string
+	if doc, ok := ip.docs.GetOpenDocument(docUri); ok {
+		text = doc.Text
+	} else {
+		content, err := os.ReadFile(docUri.Filename())
+		if err != nil {
+			return nil, err
 		}
+		text = string(content)
+	}
+
+	identifier := lsp.GetIdentifierAtPosition(text, params.Position)
+	if identifier == "" {
+		return nil, nil
+	}
+
+	definition, found, err := findIndexedDefinition(ip.db, ip.docs, docUri, identifier)
+	if err != nil || !found {
+		return nil, err
 	}
 
-	return "", fmt.Errorf("Symbol '%s' not found for filename '%s' - check naming", symbol, filename)
+	return []protocol.Location{definition.Location}, nil
 }
 
+// GetFile gets a file relative to the workspace, or by its absolute path, from
+// the editor if it's open there
 func (ci *LanguageServerClientInfo) GetFile(filename string) (string, error) {
-	if openDoc, ok := ci.Docs.GetOpenDocument(uri.File(filename)); ok {
+	path := filename
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(ci.wd, filename)
+	}
+
+	if openDoc, ok := ci.Docs.GetOpenDocument(uri.File(path)); ok {
 		return openDoc.Text, nil
 	}
 
-	fileBytes, err := os.ReadFile(filepath.Join(ci.wd, filename))
+	fileBytes, err := os.ReadFile(path)
 	return string(fileBytes), err
 }
 
+// FindFiles returns the files in the workspace matching pattern, relative to
+// it and in order. * doesn't match across directories, but ** does.
+func (ci *LanguageServerClientInfo) FindFiles(pattern string) ([]string, error) {
+	compiled, err := glob.Compile(pattern, '/')
+	if err != nil {
+		return nil, fmt.Errorf("Invalid glob '%s': %w", pattern, err)
+	}
+
+	// Only walk the part of the tree the pattern can match
+	var root []string
+	for _, part := range strings.Split(pattern, "/") {
+		if strings.ContainsAny(part, "*?[{") {
+			break
+		}
+		root = append(root, part)
+	}
+
+	var files []string
+	err = filepath.WalkDir(filepath.Join(ci.wd, filepath.Join(root...)), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+
+		if d.IsDir() {
+			if d.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		shortPath, err := filepath.Rel(ci.wd, path)
+		if err != nil {
+			return err
+		}
+		shortPath = filepath.ToSlash(shortPath)
+
+		if !compiled.Match(shortPath) {
+			return nil
+		}
+
+		if ci.Config != nil {
+			for _, exc := range ci.Config.compiledExcludes {
+				if exc.Match(shortPath) {
+					return nil
+				}
+			}
+		}
+
+		files = append(files, shortPath)
+		return nil
+	})
+
+	return files, err
+}
+
 func (ci *LanguageServerClientInfo) GetRange(filename string, start, end int) (string, error) {
 	fileContent, err := ci.GetFile(filename)
 	if err != nil {
@@ -305,6 +510,38 @@ func (ci *LanguageServerClientInfo) GetRange(filename string, start, end int) (s
 	return strings.Join(lines[start:end], "\n"), nil
 }
 
+func (ci *LanguageServerClientInfo) OpenDocuments() map[uri.URI]docstate.OpenDocument {
+	return ci.Docs.OpenDocuments()
+}
+
+func (ci *LanguageServerClientInfo) GetDiff() (string, error) {
+	repo, err := git.PlainOpenWithOptions(ci.wd, &git.PlainOpenOptions{DetectDotGit: true})
+	if err != nil {
+		return "", err
+	}
+
+	changed, err := getUncommittedFiles(repo)
+	if err != nil {
+		return "", err
+	}
+
+	var diff strings.Builder
+	for _, file := range changed {
+		diff.WriteString(file.Diff())
+	}
+
+	return diff.String(), nil
+}
+
+func (ci *LanguageServerClientInfo) GetDiagnostics() map[uri.URI][]protocol.Diagnostic {
+	// The CLI doesn't have a child to get diagnostics from
+	if ci.Diagnostics == nil {
+		return map[uri.URI][]protocol.Diagnostic{}
+	}
+
+	return ci.Diagnostics.All()
+}
+
 // func (ci *LanguageServerClientInfo) updateState(uri uri.URI) {
 // 	path := filepath.Join(ci.stateDir, uri.Filename())
 // 	err := os.MkdirAll(filepath.Dir(path), 0755)
@@ -332,8 +569,10 @@ type CommandDefinition struct {
 	Title          string
 	Identifier     string
 	ShowCodeAction bool
-	BuildArgs      func(params *protocol.CodeActionParams) (args []any, err error)
-	Execute        func(params *protocol.ExecuteCommandParams, client LspClient, clientInfo *LanguageServerClientInfo) (*protocol.ApplyWorkspaceEditParams, error)
+	// Optional: only offer the code action when this returns true
+	CodeActionFilter func(params *protocol.CodeActionParams, clientInfo *LanguageServerClientInfo) bool
+	BuildArgs        func(params *protocol.CodeActionParams) (args []any, err error)
+	Execute          func(params *protocol.ExecuteCommandParams, client LspClient, clientInfo *LanguageServerClientInfo) (*protocol.ApplyWorkspaceEditParams, error)
 }
 
 func (cd *CommandDefinition) BuildDefinition(params *protocol.CodeActionParams) (*protocol.Command, error) {
@@ -350,8 +589,9 @@ func (cd *CommandDefinition) BuildDefinition(params *protocol.CodeActionParams)
 }
 
 type LlmCompletionArgs struct {
-	Filename  uri.URI
-	Selection protocol.Range
+	Filename    uri.URI
+	Selection   protocol.Range
+	Diagnostics []protocol.Diagnostic `json:",omitempty"`
 }
 
 func findSymbol(ctx context.Context, db *DB, llm *LLMClient, query string) ([]protocol.SymbolInformation, error) {
@@ -423,12 +663,12 @@ func GetLanguageServerDispatcher(closeChan chan bool, clientConn LspClient, lsCo
 	}
 
 	clientInfo := NewLanguageServerClientInfo(config, llm)
+	clientInfo.client = clientConn.Client
 	var ls *ChildLanguageServer
+	var childDefinitions, childCompletions, childHover bool
 
 	logLock := &sync.Mutex{}
 
-	// var l *locality.Locality
-
 	handler := func(ctx context.Context, reply jsonrpc2.Replier, req jsonrpc2.Request) error {
 		logLock.Lock()
 		defer logLock.Unlock()
@@ -445,11 +685,19 @@ func GetLanguageServerDispatcher(closeChan chan bool, clientConn LspClient, lsCo
 				return err
 			}
 
+			clientInfo.ClientCapabilities = params.Capabilities
+
 			params.ProcessID = int32(os.Getpid())
+
+			// The child's diagnostics pass through us so we can offer fixes for them
+			var childClient protocol.Client = &diagnosticsRecordingClient{
+				Client:      clientConn.Client,
+				diagnostics: clientInfo.Diagnostics,
+			}
 			ls, err = startLsp(&LanguageServerConfig{
 				Command: &lsCommand[0],
 				Args:    lsCommand[1:],
-			}, &clientConn.Client, params)
+			}, &childClient, params)
 			if err != nil {
 				return err
 			}
@@ -464,19 +712,53 @@ func GetLanguageServerDispatcher(closeChan chan bool, clientConn LspClient, lsCo
 				Str("command", ls.Cmd.String()).
 				Msg("Started LSP")
 
+			// Set before we add ours to the child's capabilities
+			childDefinitions = childSupportsDefinitions(ls)
+			childCompletions = childSupportsCompletion(ls)
+			childHover = childSupportsHover(ls)
+
+			var definitions locality.DefinitionProvider = ls
+			if !childDefinitions {
+				definitions = &indexDefinitionProvider{db: clientInfo.db, docs: clientInfo.Docs}
+			}
+
+			clientInfo.Locality = locality.NewWithoutServer(definitions, &locality.DocumentFileProvider{Docs: clientInfo.Docs})
+			clientInfo.Locality.QueryDirs = getQueryDirs(clientInfo.wd)
+			clientInfo.Locality.Expand = clientInfo.Config.Locality
+			clientInfo.Child = ls
+
 			// We need to add our own capabilities in here
 			if ls.InitResult.Capabilities.ExecuteCommandProvider == nil {
 				ls.InitResult.Capabilities.ExecuteCommandProvider = &protocol.ExecuteCommandOptions{}
 			}
 
-			for _, cmd := range lspCommands {
-				ls.InitResult.Capabilities.ExecuteCommandProvider.Commands = append(ls.InitResult.Capabilities.ExecuteCommandProvider.Commands, cmd.Identifier)
-			}
+			sageCommands := clientInfo.initialCommands()
+			clientInfo.registrations.init(sageCommands)
+			ls.InitResult.Capabilities.ExecuteCommandProvider.Commands = append(ls.InitResult.Capabilities.ExecuteCommandProvider.Commands, sageCommands...)
 
 			// We can do symbol search
 			ls.InitResult.Capabilities.WorkspaceSymbolProvider = true
 
-			return reply(ctx, ls.InitResult, nil)
+			// We do these for context.txt, and pass everything else through
+			if ls.InitResult.Capabilities.CompletionProvider == nil {
+				ls.InitResult.Capabilities.CompletionProvider = &protocol.CompletionOptions{
+					TriggerCharacters: []string{"/", "@"},
+				}
+			}
+			if ls.InitResult.Capabilities.HoverProvider == nil {
+				ls.InitResult.Capabilities.HoverProvider = true
+			}
+			if ls.InitResult.Capabilities.DefinitionProvider == nil {
+				ls.InitResult.Capabilities.DefinitionProvider = true
+			}
+
+			return reply(ctx, &SageInitializeResult{
+				Capabilities: SageServerCapabilities{
+					ServerCapabilities:       ls.InitResult.Capabilities,
+					InlineCompletionProvider: true,
+				},
+				ServerInfo: ls.InitResult.ServerInfo,
+			}, nil)
 
 		// case protocol.MethodWorkspaceDidChangeConfiguration:
 		// 	params := &protocol.DidChangeConfigurationParams{}
@@ -492,6 +774,9 @@ func GetLanguageServerDispatcher(closeChan chan bool, clientConn LspClient, lsCo
 			// but we should verify if this breaks pyright since it may
 			// return reply(ctx, nil, nil)
 
+			// Now the client can take registrations for the custom actions
+			go clientInfo.syncCommandRegistrations(clientConn)
+
 		case protocol.MethodTextDocumentDidOpen:
 			params := &protocol.DidOpenTextDocumentParams{}
 			err := json.Unmarshal(req.Params(), params)
@@ -501,6 +786,10 @@ func GetLanguageServerDispatcher(closeChan chan bool, clientConn LspClient, lsCo
 
 			clientInfo.Docs.OpenDocument(&params.TextDocument)
 
+			if isContextDocument(params.TextDocument.URI) {
+				clientInfo.publishContextDiagnostics()
+			}
+
 			return reply(ctx, nil, ls.DidOpen(ctx, params))
 
 		case protocol.MethodTextDocumentDidClose:
@@ -511,6 +800,13 @@ func GetLanguageServerDispatcher(closeChan chan bool, clientConn LspClient, lsCo
 			}
 
 			clientInfo.Docs.CloseDocument(params.TextDocument.URI)
+			clientInfo.InlineCompletions.DocumentClosed(params.TextDocument.URI)
+			clientInfo.Generations.DocumentClosed(params.TextDocument.URI)
+
+			if isContextDocument(params.TextDocument.URI) {
+				// Back to what the last build left out
+				clientInfo.publishContextDiagnostics()
+			}
 
 			return reply(ctx, nil, ls.DidClose(ctx, params))
 
@@ -521,21 +817,28 @@ func GetLanguageServerDispatcher(closeChan chan bool, clientConn LspClient, lsCo
 				return err
 			}
 
-			err = clientInfo.Docs.EditDocument(params.TextDocument.URI, func(doc *protocol.TextDocumentItem) error {
-				newText, err := applyChangesToDocument(doc.Text, params.ContentChanges)
+			err = clientInfo.Docs.ChangeDocument(params.TextDocument.URI, params.TextDocument.Version, params.ContentChanges, func(text string, changes []protocol.TextDocumentContentChangeEvent) (string, error) {
+				newText, err := applyChangesToDocument(text, changes)
 				if err != nil {
 					lsLogger.Error().Err(err).Msg("Error applying edits")
-					return err
+					return "", err
 				}
 
-				doc.Text = newText
 				lsLogger.Info().Str("after_edit", newText).Msg("After edits applied")
-				return nil
+				return newText, nil
 			})
 			if err != nil {
 				return err
 			}
 
+			if cursor, ok := getCursorAfterChanges(params.ContentChanges); ok {
+				clientInfo.InlineCompletions.DocumentChanged(params.TextDocument.URI, params.TextDocument.Version, cursor)
+			}
+
+			if isContextDocument(params.TextDocument.URI) {
+				clientInfo.publishContextDiagnostics()
+			}
+
 			// No reply from us - pass to child lsp
 			return reply(ctx, nil, ls.DidChange(ctx, params))
 
@@ -553,6 +856,30 @@ func GetLanguageServerDispatcher(closeChan chan bool, clientConn LspClient, lsCo
 
 			return reply(ctx, symbols, err)
 
+		case MethodTextDocumentInlineCompletion:
+			params := &InlineCompletionParams{}
+			err := json.Unmarshal(req.Params(), params)
+			if err != nil {
+				return err
+			}
+
+			// Completing waits out the debounce and then generates, and we need
+			// to keep handling didChange while it does, since that cancels it
+			go func() {
+				items, err := clientInfo.InlineCompletions.Complete(ctx, params)
+				if err != nil {
+					if ctx.Err() == nil {
+						lsLogger.Error().Err(err).Msg("Error completing inline")
+					}
+					reply(ctx, nil, err)
+					return
+				}
+
+				reply(ctx, &InlineCompletionList{Items: items}, nil)
+			}()
+
+			return nil
+
 		case protocol.MethodTextDocumentCodeAction:
 			params := &protocol.CodeActionParams{}
 			err := json.Unmarshal(req.Params(), params)
@@ -560,8 +887,16 @@ func GetLanguageServerDispatcher(closeChan chan bool, clientConn LspClient, lsCo
 				return err
 			}
 
+			// Custom actions may have been added to or removed from sage.yaml since
+			// we last looked
+			go clientInfo.syncCommandRegistrations(clientConn)
+
 			resp := []protocol.CodeAction{}
-			for _, cmd := range lspCommands {
+			for _, cmd := range clientInfo.Commands() {
+				if cmd.CodeActionFilter != nil && !cmd.CodeActionFilter(params, clientInfo) {
+					continue
+				}
+
 				args, err := cmd.BuildArgs(params)
 				if err != nil {
 					return err
@@ -581,6 +916,11 @@ func GetLanguageServerDispatcher(closeChan chan bool, clientConn LspClient, lsCo
 				}
 			}
 
+			if isPreviewDocument(params, clientInfo) {
+				// The child has no business with our diffs
+				return reply(ctx, resp, nil)
+			}
+
 			childActions, err := ls.CodeAction(ctx, params)
 			if err != nil {
 				return err
@@ -595,7 +935,7 @@ func GetLanguageServerDispatcher(closeChan chan bool, clientConn LspClient, lsCo
 			}
 
 			var cmd *CommandDefinition
-			for _, def := range lspCommands {
+			for _, def := range clientInfo.Commands() {
 				if def.Identifier == params.Command {
 					cmd = def
 					break
@@ -609,24 +949,75 @@ func GetLanguageServerDispatcher(closeChan chan bool, clientConn LspClient, lsCo
 
 			reply(ctx, []any{}, err)
 
-			edit, err := cmd.Execute(params, clientConn, clientInfo)
+			// Commands can take a while, and we need to keep handling didChange
+			// notifications while they run so that streamed edits land in the right place
+			go func() {
+				ctx := context.WithoutCancel(ctx)
+
+				edit, err := cmd.Execute(params, clientConn, clientInfo)
+				if err != nil {
+					lsLogger.Error().Err(err).Msg("Error executing command")
+					return
+				}
+
+				if edit != nil {
+					ok, err := clientConn.ApplyEdit(ctx, edit)
+					if err != nil {
+						// Error in LSP implementation we should fix
+						if err.Error() != "unmarshaling result: json: cannot unmarshal \"{\\\"applied\\\":true}\" into Go value of type bool" {
+							lsLogger.Error().Err(err).Msg("Error applying edit")
+							return
+						}
+					}
+
+					lsLogger.Debug().Bool("apply_edit_result", ok).Msg("Result of applying edit")
+				}
+			}()
+
+			return nil
+
+		case protocol.MethodTextDocumentCompletion:
+			params := &protocol.CompletionParams{}
+			err := json.Unmarshal(req.Params(), params)
 			if err != nil {
 				return err
 			}
 
-			if edit != nil {
-				ok, err := clientConn.ApplyEdit(ctx, edit)
+			if isContextDocument(params.TextDocument.URI) {
+				items, err := clientInfo.contextCompletions(params)
 				if err != nil {
-					// Error in LSP implementation we should fix
-					if err.Error() != "unmarshaling result: json: cannot unmarshal \"{\\\"applied\\\":true}\" into Go value of type bool" {
-						return err
-					}
+					return reply(ctx, nil, err)
 				}
 
-				lsLogger.Debug().Bool("apply_edit_result", ok).Msg("Result of applying edit")
+				return reply(ctx, &protocol.CompletionList{Items: items}, nil)
 			}
 
-			return err
+			if !childCompletions {
+				// We only said we'd do completions for context.txt
+				return reply(ctx, nil, nil)
+			}
+
+			// no return, pass through
+
+		case protocol.MethodTextDocumentDefinition:
+			params := &protocol.DefinitionParams{}
+			err := json.Unmarshal(req.Params(), params)
+			if err != nil {
+				return err
+			}
+
+			if isContextDocument(params.TextDocument.URI) {
+				locations, err := clientInfo.contextDefinition(params)
+				return reply(ctx, locations, err)
+			}
+
+			if !childDefinitions {
+				// We said we'd do definitions, so the index will have to do
+				locations, err := clientInfo.Locality.Definitions.Definition(ctx, params)
+				return reply(ctx, locations, err)
+			}
+
+			// no return, pass through
 
 		case protocol.MethodTextDocumentHover:
 			params := &protocol.HoverParams{}
@@ -635,6 +1026,37 @@ func GetLanguageServerDispatcher(closeChan chan bool, clientConn LspClient, lsCo
 				return err
 			}
 
+			if isContextDocument(params.TextDocument.URI) {
+				hover, err := clientInfo.contextHover(params)
+				return reply(ctx, hover, err)
+			}
+
+			if clientInfo.Config.HoverExplanations {
+				explanation, pending, err := clientInfo.HoverExplanations.Explain(clientInfo.Docs, params.TextDocument.URI, params.Position)
+				if err != nil {
+					lsLogger.Error().Err(err).Msg("Error explaining hovered symbol")
+				} else if pending {
+					explanation = "_generating an explanation, hover again in a moment_"
+				}
+
+				if explanation != "" {
+					var result any
+					if childHover {
+						result, err = ls.Server.Request(ctx, req.Method(), req.Params())
+						if err != nil {
+							return reply(ctx, nil, err)
+						}
+					}
+
+					return reply(ctx, appendHoverExplanation(result, explanation), nil)
+				}
+			}
+
+			if !childHover {
+				// We only said we'd do hovers for context.txt
+				return reply(ctx, nil, nil)
+			}
+
 			// fileName := params.TextDocument.URI.Filename()
 			// fileContent, err := clientInfo.GetFile(fileName)
 			// if err != nil {
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/everestmz/sage/docstate"
 	"go.lsp.dev/protocol"
+	"go.lsp.dev/uri"
 )
 
 func TestApplyChangesToDocument(t *testing.T) {
@@ -94,3 +98,108 @@ func TestApplyChangesToDocument(t *testing.T) {
 		})
 	}
 }
+
+func TestGetFile(t *testing.T) {
+	wd := t.TempDir()
+	for _, file := range []string{"disk.go", "open.go"} {
+		err := os.WriteFile(filepath.Join(wd, file), []byte("on disk"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	docs := docstate.NewDocumentState()
+	docs.OpenDocument(&protocol.TextDocumentItem{
+		URI:  uri.File(filepath.Join(wd, "open.go")),
+		Text: "in the editor",
+	})
+
+	clientInfo := &LanguageServerClientInfo{Docs: docs, wd: wd}
+
+	tests := []struct {
+		name     string
+		filename string
+		expected string
+	}{
+		{
+			name:     "Relative",
+			filename: "disk.go",
+			expected: "on disk",
+		},
+		{
+			name:     "Absolute",
+			filename: filepath.Join(wd, "disk.go"),
+			expected: "on disk",
+		},
+		{
+			name:     "Relative and open",
+			filename: "open.go",
+			expected: "in the editor",
+		},
+		{
+			name:     "Absolute and open",
+			filename: filepath.Join(wd, "open.go"),
+			expected: "in the editor",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content, err := clientInfo.GetFile(tt.filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if content != tt.expected {
+				t.Errorf("Expected content %q, but got %q", tt.expected, content)
+			}
+		})
+	}
+}
+
+func TestChildSupports(t *testing.T) {
+	child := func(capabilities protocol.ServerCapabilities) *ChildLanguageServer {
+		return &ChildLanguageServer{InitResult: &protocol.InitializeResult{Capabilities: capabilities}}
+	}
+
+	tests := []struct {
+		name               string
+		child              *ChildLanguageServer
+		expectedCompletion bool
+		expectedHover      bool
+	}{
+		{
+			name:  "Neither",
+			child: child(protocol.ServerCapabilities{}),
+		},
+		{
+			name:          "Hover turned off",
+			child:         child(protocol.ServerCapabilities{HoverProvider: false}),
+			expectedHover: false,
+		},
+		{
+			name: "Both",
+			child: child(protocol.ServerCapabilities{
+				CompletionProvider: &protocol.CompletionOptions{},
+				HoverProvider:      true,
+			}),
+			expectedCompletion: true,
+			expectedHover:      true,
+		},
+		{
+			name:  "Not started",
+			child: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if completion := childSupportsCompletion(tt.child); completion != tt.expectedCompletion {
+				t.Errorf("Expected completion support %v, but got %v", tt.expectedCompletion, completion)
+			}
+			if hover := childSupportsHover(tt.child); hover != tt.expectedHover {
+				t.Errorf("Expected hover support %v, but got %v", tt.expectedHover, hover)
+			}
+		})
+	}
+}
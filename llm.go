@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"path/filepath"
+	"strings"
 
 	ollama "github.com/ollama/ollama/api"
 	"github.com/rs/zerolog"
@@ -62,6 +64,45 @@ func (lc *LLMClient) StreamCompletion(ctx context.Context, model, text string, h
 	})
 }
 
+// ChatMessage is one turn of a conversation. Role is "system", "user" or "assistant".
+type ChatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+func (lc *LLMClient) StreamChat(ctx context.Context, model string, messages []ChatMessage, handler GenerateResponseFunc) error {
+	stream := true
+
+	var olMessages []ollama.Message
+	for _, message := range messages {
+		olMessages = append(olMessages, ollama.Message{
+			Role:    message.Role,
+			Content: message.Content,
+		})
+	}
+
+	output := ""
+	defer func(resp *string) {
+		llmLogger.Info().
+			Str("model", model).
+			Interface("messages", messages).
+			Str("response", *resp).
+			Msg("Finished streaming chat")
+	}(&output)
+
+	return lc.ol.Chat(ctx, &ollama.ChatRequest{
+		Model:    model,
+		Messages: olMessages,
+		Stream:   &stream,
+	}, func(cr ollama.ChatResponse) error {
+		output += cr.Message.Content
+		return handler(CompletionResponse{
+			Text: cr.Message.Content,
+			Done: cr.Done,
+		})
+	})
+}
+
 func (lc *LLMClient) GenerateCompletion(ctx context.Context, model, text string) (string, error) {
 	stream := false
 
@@ -85,6 +126,65 @@ func (lc *LLMClient) GenerateCompletion(ctx context.Context, model, text string)
 	return completion, err
 }
 
+// fimFormats maps model name prefixes to the raw fill-in-the-middle prompt
+// format each model family was trained with. The prefix goes in the first %s
+// and the suffix in the second.
+var fimFormats = []struct {
+	modelPrefix string
+	format      string
+}{
+	{"starcoder", "<fim_prefix>%s<fim_suffix>%s<fim_middle>"},
+	{"codellama", "<PRE> %s <SUF>%s <MID>"},
+	{"deepseek-coder", "<｜fim▁begin｜>%s<｜fim▁hole｜>%s<｜fim▁end｜>"},
+	{"qwen2.5-coder", "<|fim_prefix|>%s<|fim_suffix|>%s<|fim_middle|>"},
+	{"codegemma", "<|fim_prefix|>%s<|fim_suffix|>%s<|fim_middle|>"},
+}
+
+func getFimPrompt(model, prefix, suffix string) string {
+	format := fimFormats[0].format
+	for _, f := range fimFormats {
+		if strings.HasPrefix(model, f.modelPrefix) {
+			format = f.format
+			break
+		}
+	}
+
+	return fmt.Sprintf(format, prefix, suffix)
+}
+
+// GenerateFillInMiddle asks the model for the text that belongs between prefix
+// and suffix. The prompt is sent raw, so the model must support FIM tokens.
+func (lc *LLMClient) GenerateFillInMiddle(ctx context.Context, model, prefix, suffix string, maxTokens int) (string, error) {
+	stream := false
+
+	var completion string
+
+	prompt := getFimPrompt(model, prefix, suffix)
+
+	err := lc.ol.Generate(ctx, &ollama.GenerateRequest{
+		Model:  model,
+		Prompt: prompt,
+		Stream: &stream,
+		Raw:    true,
+		Options: map[string]any{
+			"num_predict": maxTokens,
+			"temperature": 0.2,
+			"stop":        []string{"\n\n", "<file_sep>", "<|endoftext|>", "<EOT>"},
+		},
+	}, func(gr ollama.GenerateResponse) error {
+		completion += gr.Response
+		return nil
+	})
+
+	llmLogger.Info().
+		Str("model", model).
+		Str("prompt", prompt).
+		Str("response", completion).
+		Msg("Finished fill-in-middle completion")
+
+	return completion, err
+}
+
 func (lc *LLMClient) GetEmbedding(ctx context.Context, model, text string) ([]float64, error) {
 	resp, err := lc.ol.Embeddings(ctx, &ollama.EmbeddingRequest{
 		Model:  model,
@@ -3,24 +3,59 @@ package main
 import (
 	"bufio"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
+
+	"github.com/everestmz/sage/docstate"
+	"go.lsp.dev/protocol"
+	"go.lsp.dev/uri"
 )
 
 type ContextItemGetterFunc func(ContextApi) (*ContextItem, error)
 
+// ContextItemsGetterFunc gets the items for providers that can expand to any number of them
+type ContextItemsGetterFunc func(ContextApi) ([]*ContextItem, error)
+
 type ContextItemType string
 
 const (
 	ContextItemTypeFile   ContextItemType = "file"
 	ContextItemTypeSymbol ContextItemType = "symbol"
 	ContextItemTypeRange  ContextItemType = "range"
+	// Every file matching a glob, or in a directory
+	ContextItemTypeGlob ContextItemType = "glob"
+
+	// Directives, which follow what you're working on
+	ContextItemTypeOpen        ContextItemType = "open"
+	ContextItemTypeRecent      ContextItemType = "recent"
+	ContextItemTypeDiff        ContextItemType = "diff"
+	ContextItemTypeDiagnostics ContextItemType = "diagnostics"
+
+	// A line that didn't parse
+	ContextItemTypeInvalid ContextItemType = "invalid"
+
+	// A definition that locality found for the selection, rather than a
+	// context.txt line. Its identifier is its range of lines.
+	ContextItemTypeDefinition ContextItemType = "definition"
+	// The lines around the user's last edit in a document, for chat. Its
+	// identifier is its range of lines.
+	ContextItemTypeRecentEdit ContextItemType = "recent_edit"
 )
 
+// How many documents @recent includes if it isn't given a number
+const defaultRecentDocuments = 5
+
 type ContextApi interface {
 	GetSymbol(filename string, symbolName string) (string, error)
 	GetRange(filename string, start, end int) (string, error)
 	GetFile(filename string) (string, error)
+	// FindFiles returns the files in the workspace matching a glob, leaving out excludes
+	FindFiles(pattern string) ([]string, error)
+	OpenDocuments() map[uri.URI]docstate.OpenDocument
+	// GetDiff returns the uncommitted changes in the workspace as a unified diff
+	GetDiff() (string, error)
+	GetDiagnostics() map[uri.URI][]protocol.Diagnostic
 }
 
 type ContextItem struct {
@@ -30,9 +65,11 @@ type ContextItem struct {
 }
 
 type ContextItemProvider struct {
-	parts    []string
-	itemType ContextItemType
-	getter   ContextItemGetterFunc
+	line        int // Zero-based, in context.txt
+	parts       []string
+	itemType    ContextItemType
+	getter      ContextItemGetterFunc
+	itemsGetter ContextItemsGetterFunc
 }
 
 func (cip *ContextItemProvider) Type() ContextItemType {
@@ -47,34 +84,112 @@ func (cip *ContextItemProvider) GetItem(api ContextApi) (*ContextItem, error) {
 	return cip.getter(api)
 }
 
+// GetItems gets every item the provider expands to, which is just the one for
+// anything but globs
+func (cip *ContextItemProvider) GetItems(api ContextApi) ([]*ContextItem, error) {
+	if cip.itemsGetter != nil {
+		return cip.itemsGetter(api)
+	}
+
+	item, err := cip.GetItem(api)
+	if err != nil {
+		return nil, err
+	}
+
+	return []*ContextItem{item}, nil
+}
+
 func ParseContext(contextDefinition string) ([]*ContextItemProvider, error) {
+	return parseContext(contextDefinition, false)
+}
+
+// ParseContextLenient is ParseContext, but lines that don't parse become
+// providers that fail with the parse error. That way one bad line is left out
+// with a warning when the context is built, rather than breaking every generation.
+func ParseContextLenient(contextDefinition string) []*ContextItemProvider {
+	// Can't fail when it's lenient
+	providers, _ := parseContext(contextDefinition, true)
+	return providers
+}
+
+func parseContext(contextDefinition string, lenient bool) ([]*ContextItemProvider, error) {
 	scanner := bufio.NewScanner(strings.NewReader(contextDefinition))
 	scanner.Split(bufio.ScanLines)
 
 	var providers []*ContextItemProvider
 
-	for scanner.Scan() {
+	for lineNumber := 0; scanner.Scan(); lineNumber++ {
 		line := scanner.Text()
 		newProviders, err := parseContextLine(line)
-		if err != nil {
+		if err != nil && lenient {
+			newProviders = []*ContextItemProvider{invalidContextLine(line, err)}
+		} else if err != nil {
 			return nil, fmt.Errorf("Error for line '%s': %w", line, err)
 		}
 
+		for _, provider := range newProviders {
+			provider.line = lineNumber
+		}
+
 		providers = append(providers, newProviders...)
 	}
 
 	return providers, nil
 }
 
+// invalidContextLine is a provider for a line that didn't parse, which fails
+// with why whenever it's used
+func invalidContextLine(line string, err error) *ContextItemProvider {
+	return &ContextItemProvider{
+		parts:    []string{line},
+		itemType: ContextItemTypeInvalid,
+		getter: func(ca ContextApi) (*ContextItem, error) {
+			return nil, err
+		},
+	}
+}
+
+// linePart is a part of a context.txt line, along with where it is in the line
+type linePart struct {
+	text  string
+	start int // Byte offsets, including any quotes
+	end   int
+}
+
 func getLineParts(line string) ([]string, error) {
+	spans, err := getLinePartSpans(line)
+	if err != nil {
+		return nil, err
+	}
+
 	var parts []string
+	for _, span := range spans {
+		parts = append(parts, span.text)
+	}
+
+	return parts, nil
+}
+
+func getLinePartSpans(line string) ([]linePart, error) {
+	var parts []linePart
 
 	var currentPart strings.Builder
+	start := -1
 
 	var inQuotes bool
 	var escaped bool
 
-	for _, char := range line {
+	endPart := func(end int) {
+		parts = append(parts, linePart{text: currentPart.String(), start: start, end: end})
+		currentPart.Reset()
+		start = -1
+	}
+
+	for i, char := range line {
+		if start < 0 && (char != ' ' || inQuotes) {
+			start = i
+		}
+
 		switch {
 		case escaped:
 			currentPart.WriteRune(char)
@@ -85,22 +200,21 @@ func getLineParts(line string) ([]string, error) {
 			inQuotes = !inQuotes
 
 			if !inQuotes {
-				parts = append(parts, currentPart.String())
-				currentPart.Reset()
+				endPart(i + 1)
 			}
 
 		case char == ' ' && !inQuotes:
 			if currentPart.Len() > 0 {
-				parts = append(parts, currentPart.String())
-				currentPart.Reset()
+				endPart(i)
 			}
+			start = -1
 		default:
 			currentPart.WriteRune(char)
 		}
 	}
 
 	if currentPart.Len() > 0 {
-		parts = append(parts, currentPart.String())
+		endPart(len(line))
 	}
 
 	if inQuotes {
@@ -142,11 +256,23 @@ func parseContextLine(line string) ([]*ContextItemProvider, error) {
 	if err != nil {
 		return nil, err
 	}
+	if len(parts) == 0 {
+		// Just spaces
+		return nil, nil
+	}
 
 	var providers []*ContextItemProvider
 
 	filename := parts[0]
 
+	if isContextGlob(filename) {
+		return parseContextGlob(parts)
+	}
+
+	if strings.HasPrefix(filename, "@") {
+		return parseContextDirective(parts)
+	}
+
 	// Our options right now are a whole file, a file range, or a symbol.
 	// Each row can have one filename, but multiple options for symbols or line ranges
 	if len(parts) == 1 {
@@ -218,46 +344,245 @@ func parseContextLine(line string) ([]*ContextItemProvider, error) {
 	return providers, nil
 }
 
-func BuildContext(providers []*ContextItemProvider, api ContextApi) (string, error) {
-	var builder strings.Builder
+// isContextGlob is whether a context.txt filename is a glob or a directory
+// (written with a trailing slash), rather than a single file
+func isContextGlob(filename string) bool {
+	return strings.HasSuffix(filename, "/") || strings.ContainsAny(filename, "*?[{")
+}
 
-	for _, provider := range providers {
-		var tagName string
+// parseContextGlob parses a line for a glob or directory, which expands to
+// every matching file each time the context is built. It can be followed by
+// max=N to cap how many files it expands to.
+func parseContextGlob(parts []string) ([]*ContextItemProvider, error) {
+	pattern := parts[0]
+	if strings.HasSuffix(pattern, "/") {
+		pattern += "**"
+	}
 
-		contextItem, err := provider.GetItem(api)
-		if err != nil {
-			return "", err
+	maxFiles := 0
+	for _, option := range parts[1:] {
+		maxStr, ok := strings.CutPrefix(option, "max=")
+		if !ok {
+			return nil, fmt.Errorf("Globs and directories can't have symbols or ranges, only max=N: '%s'", option)
 		}
 
-		tagParams := map[string]string{
-			"file": contextItem.Filename,
+		var err error
+		maxFiles, err = strconv.Atoi(maxStr)
+		if err != nil || maxFiles <= 0 {
+			return nil, fmt.Errorf("Invalid max files '%s'", maxStr)
 		}
+	}
 
-		switch provider.Type() {
-		case ContextItemTypeFile:
-			tagName = "File"
-		case ContextItemTypeRange:
-			tagName = "FileRange"
-			tagParams["range"] = contextItem.Identifier
-		case ContextItemTypeSymbol:
-			tagName = "FileSymbol"
-			tagParams["symbol"] = contextItem.Identifier
-		default:
-			return "", fmt.Errorf("Invalid item type '%s'", provider.Type())
+	return []*ContextItemProvider{
+		{
+			parts:    parts,
+			itemType: ContextItemTypeGlob,
+			getter: func(ca ContextApi) (*ContextItem, error) {
+				return nil, fmt.Errorf("'%s' expands to many items", parts[0])
+			},
+			itemsGetter: func(ca ContextApi) ([]*ContextItem, error) {
+				filenames, err := ca.FindFiles(pattern)
+				if err != nil {
+					return nil, err
+				}
+
+				if maxFiles > 0 && len(filenames) > maxFiles {
+					filenames = filenames[:maxFiles]
+				}
+
+				var items []*ContextItem
+				for _, filename := range filenames {
+					content, err := ca.GetFile(filename)
+					if err != nil {
+						return nil, err
+					}
+
+					// Binary files are no use to the model
+					if strings.ContainsRune(content, 0) {
+						continue
+					}
+
+					items = append(items, &ContextItem{
+						Filename:   filename,
+						Identifier: "",
+						Content:    content,
+					})
+				}
+
+				return items, nil
+			},
+		},
+	}, nil
+}
+
+// parseContextDirective parses lines like @open or @recent 5, whose items
+// depend on the state of the editor and workspace when the context is built
+func parseContextDirective(parts []string) ([]*ContextItemProvider, error) {
+	directive := parts[0]
+	args := parts[1:]
+
+	provider := &ContextItemProvider{
+		parts: parts,
+		getter: func(ca ContextApi) (*ContextItem, error) {
+			return nil, fmt.Errorf("'%s' expands to many items", directive)
+		},
+	}
+
+	if directive != "@recent" && len(args) > 0 {
+		return nil, fmt.Errorf("%s doesn't take any arguments", directive)
+	}
+
+	switch directive {
+	case "@open":
+		provider.itemType = ContextItemTypeOpen
+		provider.itemsGetter = func(ca ContextApi) ([]*ContextItem, error) {
+			return documentItems(sortedOpenDocuments(ca.OpenDocuments(), func(a, b docstate.OpenDocument) bool {
+				return a.URI < b.URI
+			})), nil
+		}
+
+	case "@recent":
+		if len(args) > 1 {
+			return nil, fmt.Errorf("@recent takes at most one argument, the number of documents")
+		}
+
+		numDocuments := defaultRecentDocuments
+		if len(args) == 1 {
+			var err error
+			numDocuments, err = strconv.Atoi(args[0])
+			if err != nil || numDocuments <= 0 {
+				return nil, fmt.Errorf("Invalid number of documents '%s'", args[0])
+			}
 		}
 
-		builder.WriteString("<" + tagName + "\n")
-		for k, v := range tagParams {
-			_, err = builder.WriteString(fmt.Sprintf("%s=\"%s\"\n", k, v))
+		provider.itemType = ContextItemTypeRecent
+		provider.itemsGetter = func(ca ContextApi) ([]*ContextItem, error) {
+			docs := sortedOpenDocuments(ca.OpenDocuments(), func(a, b docstate.OpenDocument) bool {
+				return a.LastEdit.After(b.LastEdit)
+			})
+			if len(docs) > numDocuments {
+				docs = docs[:numDocuments]
+			}
+
+			return documentItems(docs), nil
+		}
+
+	case "@diff":
+		provider.itemType = ContextItemTypeDiff
+		provider.itemsGetter = func(ca ContextApi) ([]*ContextItem, error) {
+			diff, err := ca.GetDiff()
 			if err != nil {
-				return "", err
+				return nil, err
+			}
+			if diff == "" {
+				return nil, nil
+			}
+
+			return []*ContextItem{{Content: diff}}, nil
+		}
+
+	case "@diagnostics":
+		provider.itemType = ContextItemTypeDiagnostics
+		provider.itemsGetter = func(ca ContextApi) ([]*ContextItem, error) {
+			var items []*ContextItem
+			for docUri, diagnostics := range ca.GetDiagnostics() {
+				var errors []protocol.Diagnostic
+				for _, diagnostic := range diagnostics {
+					// Clients treat diagnostics without a severity as errors
+					if diagnostic.Severity == protocol.DiagnosticSeverityError || diagnostic.Severity == 0 {
+						errors = append(errors, diagnostic)
+					}
+				}
+				if len(errors) == 0 {
+					continue
+				}
+
+				items = append(items, &ContextItem{
+					Filename: docUri.Filename(),
+					Content:  formatDiagnostics(errors),
+				})
 			}
+
+			sort.Slice(items, func(i, j int) bool {
+				return items[i].Filename < items[j].Filename
+			})
+
+			return items, nil
+		}
+
+	default:
+		return nil, fmt.Errorf("Unknown directive '%s' - try @open, @recent, @diff or @diagnostics", directive)
+	}
+
+	return []*ContextItemProvider{provider}, nil
+}
+
+// sortedOpenDocuments returns the open documents in order, leaving out sage's
+// own files like the chat
+func sortedOpenDocuments(openDocs map[uri.URI]docstate.OpenDocument, less func(a, b docstate.OpenDocument) bool) []docstate.OpenDocument {
+	var docs []docstate.OpenDocument
+	for docUri, doc := range openDocs {
+		if isSageFile(docUri.Filename()) {
+			continue
+		}
+		docs = append(docs, doc)
+	}
+
+	sort.Slice(docs, func(i, j int) bool {
+		return less(docs[i], docs[j])
+	})
+
+	return docs
+}
+
+func documentItems(docs []docstate.OpenDocument) []*ContextItem {
+	var items []*ContextItem
+	for _, doc := range docs {
+		items = append(items, &ContextItem{
+			Filename: doc.URI.Filename(),
+			Content:  doc.Text,
+		})
+	}
+
+	return items
+}
+
+// ContextWarning is a context.txt line that was left out of the context,
+// because it couldn't be included
+type ContextWarning struct {
+	Line    int // Zero-based
+	Text    string
+	Message string
+}
+
+func (cw *ContextWarning) String() string {
+	return fmt.Sprintf("context.txt:%d: '%s': %s", cw.Line+1, cw.Text, cw.Message)
+}
+
+func getContextEntries(providers []*ContextItemProvider, api ContextApi, lenient bool) ([]*ContextEntry, []*ContextWarning, error) {
+	var entries []*ContextEntry
+	var warnings []*ContextWarning
+	for _, provider := range providers {
+		contextItems, err := provider.GetItems(api)
+		if err != nil && lenient {
+			warnings = append(warnings, &ContextWarning{
+				Line:    provider.line,
+				Text:    provider.String(),
+				Message: err.Error(),
+			})
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, contextItem := range contextItems {
+			entries = append(entries, &ContextEntry{
+				Type:        provider.Type(),
+				ContextItem: contextItem,
+			})
 		}
-		builder.WriteString(">\n")
-		builder.WriteString(contextItem.Content)
-		builder.WriteString("\n")
-		builder.WriteString("</" + tagName + ">\n")
 	}
 
-	return builder.String(), nil
+	return entries, warnings, nil
 }
@@ -1,8 +1,18 @@
 package main
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/everestmz/sage/docstate"
+	"github.com/gobwas/glob"
+	"go.lsp.dev/protocol"
+	"go.lsp.dev/uri"
 )
 
 func TestParseContext(t *testing.T) {
@@ -96,6 +106,73 @@ func TestParseContext(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name:  "Glob",
+			input: "internal/db/*.go",
+			want: []*ContextItemProvider{
+				{
+					parts:    []string{"internal/db/*.go"},
+					itemType: ContextItemTypeGlob,
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name:  "Directory with max files",
+			input: "pkg/api/ max=10",
+			want: []*ContextItemProvider{
+				{
+					parts:    []string{"pkg/api/", "max=10"},
+					itemType: ContextItemTypeGlob,
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name:    "Glob with symbol",
+			input:   "pkg/api/ MyFunction",
+			want:    nil,
+			wantErr: true,
+		},
+		{
+			name:    "Invalid max files",
+			input:   "pkg/api/ max=0",
+			want:    nil,
+			wantErr: true,
+		},
+		{
+			name:  "Recent documents",
+			input: "@recent 3\n@diff",
+			want: []*ContextItemProvider{
+				{
+					parts:    []string{"@recent", "3"},
+					itemType: ContextItemTypeRecent,
+				},
+				{
+					parts:    []string{"@diff"},
+					itemType: ContextItemTypeDiff,
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name:    "Invalid number of recent documents",
+			input:   "@recent none",
+			want:    nil,
+			wantErr: true,
+		},
+		{
+			name:    "Directive with arguments",
+			input:   "@open 3",
+			want:    nil,
+			wantErr: true,
+		},
+		{
+			name:    "Unknown directive",
+			input:   "@everything",
+			want:    nil,
+			wantErr: true,
+		},
 		{
 			name:    "Unclosed quote",
 			input:   `"my file.go MyFunction`,
@@ -200,10 +277,259 @@ func TestContextItemProvider_GetItem(t *testing.T) {
 	}
 }
 
+// renderTestContext renders the entries getContextEntries finds as XML
+func renderTestContext(providers []*ContextItemProvider, api ContextApi, lenient bool) (string, []*ContextWarning, error) {
+	entries, warnings, err := getContextEntries(providers, api, lenient)
+	if err != nil {
+		return "", nil, err
+	}
+
+	rendered, err := XMLContextRenderer{}.Render(entries)
+	return rendered, warnings, err
+}
+
+func TestBuildContextGlob(t *testing.T) {
+	providers, err := ParseContext("pkg/*.go max=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, _, err := renderTestContext(providers, &MockContextApi{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "<File file=\"a.go\">\nfile content\n</File>\n<File file=\"b.go\">\nfile content\n</File>\n"
+	if result != expected {
+		t.Errorf("Expected context %q, but got %q", expected, result)
+	}
+}
+
+func TestBuildContextDirectives(t *testing.T) {
+	now := time.Now()
+	doc := func(path string, lastEdit time.Time) docstate.OpenDocument {
+		return docstate.OpenDocument{
+			TextDocumentItem: protocol.TextDocumentItem{
+				URI:  uri.File(path),
+				Text: "package " + strings.TrimSuffix(filepath.Base(path), ".go"),
+			},
+			LastEdit: lastEdit,
+		}
+	}
+
+	mockApi := &MockContextApi{
+		openDocs: map[uri.URI]docstate.OpenDocument{},
+		diff:     "diff --git a/a.go b/a.go\n",
+		diagnostics: map[uri.URI][]protocol.Diagnostic{
+			uri.File("/src/a.go"): {
+				{Severity: protocol.DiagnosticSeverityWarning, Message: "unused"},
+				{Severity: protocol.DiagnosticSeverityError, Message: "undefined: x", Range: protocol.Range{Start: protocol.Position{Line: 2}}},
+			},
+			uri.File("/src/b.go"): {
+				{Severity: protocol.DiagnosticSeverityHint, Message: "simplify"},
+			},
+		},
+	}
+	for _, d := range []docstate.OpenDocument{
+		doc("/src/a.go", now.Add(-time.Hour)),
+		doc("/src/b.go", now),
+		doc("/src/c.go", now.Add(-time.Minute)),
+		doc(filepath.Join(getConfigDir(), "chat.md"), now.Add(time.Minute)),
+	} {
+		mockApi.openDocs[d.URI] = d
+	}
+
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{
+			name:     "Open documents",
+			input:    "@open",
+			expected: "<OpenDocument file=\"/src/a.go\">\npackage a\n</OpenDocument>\n<OpenDocument file=\"/src/b.go\">\npackage b\n</OpenDocument>\n<OpenDocument file=\"/src/c.go\">\npackage c\n</OpenDocument>\n",
+		},
+		{
+			name:     "Most recently edited documents",
+			input:    "@recent 2",
+			expected: "<RecentDocument file=\"/src/b.go\">\npackage b\n</RecentDocument>\n<RecentDocument file=\"/src/c.go\">\npackage c\n</RecentDocument>\n",
+		},
+		{
+			name:     "Uncommitted changes",
+			input:    "@diff",
+			expected: "<UncommittedChanges>\ndiff --git a/a.go b/a.go\n\n</UncommittedChanges>\n",
+		},
+		{
+			name:     "Errors only",
+			input:    "@diagnostics",
+			expected: "<Errors file=\"/src/a.go\">\nline 3: undefined: x\n</Errors>\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			providers, err := ParseContext(tt.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			result, _, err := renderTestContext(providers, mockApi, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if result != tt.expected {
+				t.Errorf("Expected context %q, but got %q", tt.expected, result)
+			}
+		})
+	}
+}
+
+func TestBuildContextLenient(t *testing.T) {
+	mockApi := &MockContextApi{
+		missingSymbols: map[string]bool{"Gone": true},
+	}
+
+	providers, err := ParseContext("a.go\n\nb.go Gone\nc.go Here\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = renderTestContext(providers, mockApi, false)
+	if err == nil {
+		t.Error("Expected an error building the context strictly, but got none")
+	}
+
+	result, warnings, err := renderTestContext(providers, mockApi, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "<File file=\"a.go\">\nfile content\n</File>\n<FileSymbol file=\"c.go\" symbol=\"Here\">\nfunction content\n</FileSymbol>\n"
+	if result != expected {
+		t.Errorf("Expected context %q, but got %q", expected, result)
+	}
+
+	if len(warnings) != 1 {
+		t.Fatalf("Expected 1 warning, but got %d", len(warnings))
+	}
+
+	expectedWarning := "context.txt:3: 'b.go Gone': Couldn't find symbol Gone in b.go"
+	if warnings[0].String() != expectedWarning {
+		t.Errorf("Expected warning %q, but got %q", expectedWarning, warnings[0].String())
+	}
+}
+
+func TestBuildContextLenientParseErrors(t *testing.T) {
+	providers := ParseContextLenient("a.go\nfoo.go 10:5\n\"unclosed\n@recnt\nb.go\n")
+
+	_, _, err := renderTestContext(providers, &MockContextApi{}, false)
+	if err == nil {
+		t.Error("Expected an error building the context strictly, but got none")
+	}
+
+	result, warnings, err := renderTestContext(providers, &MockContextApi{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "<File file=\"a.go\">\nfile content\n</File>\n<File file=\"b.go\">\nfile content\n</File>\n"
+	if result != expected {
+		t.Errorf("Expected context %q, but got %q", expected, result)
+	}
+
+	var got []string
+	for _, warning := range warnings {
+		got = append(got, warning.String())
+	}
+
+	expectedWarnings := []string{
+		"context.txt:2: 'foo.go 10:5': Start cannot be greater than end of range '10:5'",
+		"context.txt:3: '\"unclosed': Found quote with no matching closing quote",
+		"context.txt:4: '@recnt': Unknown directive '@recnt' - try @open, @recent, @diff or @diagnostics",
+	}
+	if !reflect.DeepEqual(got, expectedWarnings) {
+		t.Errorf("Expected warnings %q, but got %q", expectedWarnings, got)
+	}
+}
+
+func TestFindFiles(t *testing.T) {
+	wd := t.TempDir()
+	for _, path := range []string{"pkg/api/a.go", "pkg/api/nested/b.go", "pkg/api/c_test.go", "pkg/other.go", ".git/config"} {
+		err := os.MkdirAll(filepath.Join(wd, filepath.Dir(path)), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filepath.Join(wd, path), []byte("package api\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config := NewPathConfig("test")
+	config.Exclude = []string{"**_test.go"}
+	for _, pattern := range config.Exclude {
+		config.compiledExcludes = append(config.compiledExcludes, glob.MustCompile(pattern))
+	}
+
+	ci := &LanguageServerClientInfo{Config: config, wd: wd}
+
+	tests := []struct {
+		name     string
+		pattern  string
+		expected []string
+	}{
+		{
+			name:     "Star doesn't cross directories",
+			pattern:  "pkg/api/*.go",
+			expected: []string{"pkg/api/a.go"},
+		},
+		{
+			name:     "Directory",
+			pattern:  "pkg/api/**",
+			expected: []string{"pkg/api/a.go", "pkg/api/nested/b.go"},
+		},
+		{
+			name:     "Whole workspace skips .git",
+			pattern:  "**",
+			expected: []string{"pkg/api/a.go", "pkg/api/nested/b.go", "pkg/other.go"},
+		},
+		{
+			name:     "Missing directory",
+			pattern:  "missing/*.go",
+			expected: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := ci.FindFiles(tt.pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("Expected files %v, but got %v", tt.expected, result)
+			}
+		})
+	}
+}
+
 // MockContextApi is a mock implementation of ContextApi for testing
-type MockContextApi struct{}
+type MockContextApi struct {
+	openDocs    map[uri.URI]docstate.OpenDocument
+	diff        string
+	diagnostics map[uri.URI][]protocol.Diagnostic
+	// Symbols that GetSymbol can't find
+	missingSymbols map[string]bool
+	// Files that GetFile can't find
+	missingFiles map[string]bool
+}
 
 func (m *MockContextApi) GetSymbol(filename, symbolName string) (string, error) {
+	if m.missingSymbols[symbolName] {
+		return "", fmt.Errorf("Couldn't find symbol %s in %s", symbolName, filename)
+	}
+
 	return "function content", nil
 }
 
@@ -212,5 +538,25 @@ func (m *MockContextApi) GetRange(filename string, start, end int) (string, erro
 }
 
 func (m *MockContextApi) GetFile(filename string) (string, error) {
+	if m.missingFiles[filename] {
+		return "", fmt.Errorf("open %s: no such file or directory", filename)
+	}
+
 	return "file content", nil
 }
+
+func (m *MockContextApi) FindFiles(pattern string) ([]string, error) {
+	return []string{"a.go", "b.go", "c.go"}, nil
+}
+
+func (m *MockContextApi) OpenDocuments() map[uri.URI]docstate.OpenDocument {
+	return m.openDocs
+}
+
+func (m *MockContextApi) GetDiff() (string, error) {
+	return m.diff, nil
+}
+
+func (m *MockContextApi) GetDiagnostics() map[uri.URI][]protocol.Diagnostic {
+	return m.diagnostics
+}
@@ -0,0 +1,151 @@
+package locality
+
+import (
+	"context"
+	"sort"
+
+	"go.lsp.dev/protocol"
+	"go.lsp.dev/uri"
+)
+
+// ExpandOptions is how far GetContext follows definitions. The first hop is
+// the definitions of what the file references, and every hop after that is
+// the definitions of what's referenced in the previous hop's definitions.
+type ExpandOptions struct {
+	// How many hops to follow. 1, the default, is only what the file references.
+	Depth int `yaml:"depth" json:"depth"`
+	// The most definitions added in each hop after the first. The ones
+	// referenced most often win.
+	MaxDefinitionsPerHop int `yaml:"max_definitions_per_hop" json:"max_definitions_per_hop"`
+	// The most bytes of definitions added in each hop after the first
+	MaxHopSize int `yaml:"max_hop_size" json:"max_hop_size"`
+}
+
+const (
+	defaultExpandDepth          = 1
+	defaultMaxDefinitionsPerHop = 10
+	defaultMaxHopSize           = 16 * 1024
+)
+
+func (eo ExpandOptions) withDefaults() ExpandOptions {
+	if eo.Depth <= 0 {
+		eo.Depth = defaultExpandDepth
+	}
+	if eo.MaxDefinitionsPerHop <= 0 {
+		eo.MaxDefinitionsPerHop = defaultMaxDefinitionsPerHop
+	}
+	if eo.MaxHopSize <= 0 {
+		eo.MaxHopSize = defaultMaxHopSize
+	}
+
+	return eo
+}
+
+type expandCandidate struct {
+	def        *definition
+	references int
+}
+
+// expand finds the definitions of what's referenced in the previous hop's
+// definitions, adds the best of them to codeCtx, and returns them for the next hop
+func (l *Locality) expand(codeCtx *Context, resolved map[string]*definition, previous []*definition, hop int, options ExpandOptions) ([]*definition, error) {
+	candidates := map[string]*expandCandidate{}
+	for _, def := range previous {
+		if def.node == nil {
+			continue
+		}
+
+		queries, err := l.GetQueries(def.language)
+		if err != nil {
+			// Nothing to look for in this one
+			continue
+		}
+
+		references, err := findNodeReferences(def.language, queries, def.node, def.source)
+		if err != nil {
+			return nil, err
+		}
+
+		// The same name usually means the same thing within one definition, so
+		// each is only looked up once
+		lookedUp := map[string][]protocol.Location{}
+		for _, reference := range references {
+			content := reference.Node.Content(def.source)
+			locations, ok := lookedUp[content]
+			if !ok {
+				locations, err = l.Definitions.Definition(context.TODO(), &protocol.DefinitionParams{
+					TextDocumentPositionParams: protocol.TextDocumentPositionParams{
+						TextDocument: protocol.TextDocumentIdentifier{
+							URI: uri.File(def.filename),
+						},
+						Position: protocol.Position{
+							Line:      reference.Node.StartPoint().Row,
+							Character: reference.Node.StartPoint().Column,
+						},
+					},
+				})
+				if err != nil {
+					locations = nil
+				}
+				lookedUp[content] = locations
+			}
+
+			for _, location := range locations {
+				found, err := l.resolveDefinition(resolved, location)
+				if err != nil {
+					// Unlike the first hop, these are only nice to have
+					continue
+				}
+
+				id := found.id
+				codeCtx.References[id]++
+
+				if _, visited := codeCtx.Definitions[id]; visited {
+					continue
+				}
+
+				candidate, ok := candidates[id]
+				if !ok {
+					candidate = &expandCandidate{def: found}
+					candidates[id] = candidate
+				}
+				candidate.references++
+			}
+		}
+	}
+
+	var ranked []*expandCandidate
+	for _, candidate := range candidates {
+		ranked = append(ranked, candidate)
+	}
+
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].references != ranked[j].references {
+			return ranked[i].references > ranked[j].references
+		}
+		return ranked[i].def.id < ranked[j].def.id
+	})
+
+	var added []*definition
+	size := 0
+	for _, candidate := range ranked {
+		if len(added) >= options.MaxDefinitionsPerHop {
+			break
+		}
+
+		def := candidate.def
+
+		// A smaller one further down might still fit
+		if size+len(def.text) > options.MaxHopSize {
+			continue
+		}
+		size += len(def.text)
+
+		codeCtx.Definitions[def.id] = def.text
+		codeCtx.Hops[def.id] = hop
+		codeCtx.Locations[def.id] = def.location
+		added = append(added, def)
+	}
+
+	return added, nil
+}
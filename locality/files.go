@@ -0,0 +1,116 @@
+package locality
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/everestmz/sage/docstate"
+	"go.lsp.dev/uri"
+
+	sitter "github.com/smacker/go-tree-sitter"
+)
+
+// File is the text of a file that a definition is in
+type File struct {
+	Text string
+	// Changes whenever the text does, so parse trees can be reused until then
+	Version string
+}
+
+// FileProvider gets the files that definitions are in
+type FileProvider interface {
+	GetFile(filename string) (*File, error)
+}
+
+// DiskFileProvider reads files from disk, versioning them by when they were modified
+type DiskFileProvider struct{}
+
+func (DiskFileProvider) GetFile(filename string) (*File, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return &File{
+		Text:    string(content),
+		Version: fmt.Sprintf("disk:%d:%d", info.ModTime().UnixNano(), info.Size()),
+	}, nil
+}
+
+// DocumentFileProvider prefers documents open in the editor, which can have
+// unsaved changes, to what's on disk
+type DocumentFileProvider struct {
+	Docs *docstate.DocumentState
+}
+
+func (dp *DocumentFileProvider) GetFile(filename string) (*File, error) {
+	if doc, ok := dp.Docs.GetOpenDocument(uri.File(filename)); ok {
+		return &File{
+			Text:    doc.Text,
+			Version: fmt.Sprintf("doc:%d", doc.Version),
+		}, nil
+	}
+
+	return DiskFileProvider{}.GetFile(filename)
+}
+
+// How many files' parse trees we hold on to
+const maxCachedTrees = 100
+
+type cachedTree struct {
+	version string
+	tree    *sitter.Tree
+}
+
+// treeCache holds the latest parse tree for each file, so files with lots of
+// definitions in them aren't parsed over and over
+type treeCache struct {
+	lock  sync.Mutex
+	trees map[string]*cachedTree
+}
+
+func newTreeCache() *treeCache {
+	return &treeCache{
+		trees: map[string]*cachedTree{},
+	}
+}
+
+func (tc *treeCache) get(filename string, file *File, language Language) (*sitter.Tree, error) {
+	tc.lock.Lock()
+	cached, ok := tc.trees[filename]
+	tc.lock.Unlock()
+
+	if ok && cached.version == file.Version {
+		return cached.tree, nil
+	}
+
+	tree, err := GetParser(language.TS()).ParseCtx(context.TODO(), nil, []byte(file.Text))
+	if err != nil {
+		return nil, err
+	}
+
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+
+	if _, ok := tc.trees[filename]; !ok && len(tc.trees) >= maxCachedTrees {
+		// Which one goes doesn't matter much, they're cheap enough to parse again
+		for evict := range tc.trees {
+			delete(tc.trees, evict)
+			break
+		}
+	}
+
+	tc.trees[filename] = &cachedTree{
+		version: file.Version,
+		tree:    tree,
+	}
+
+	return tree, nil
+}
@@ -2,14 +2,19 @@ package locality
 
 import (
 	"context"
+	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/coder/websocket"
+	"github.com/everestmz/sage/lsp"
 	"github.com/google/uuid"
 	"github.com/rs/zerolog/log"
 	"go.lsp.dev/protocol"
@@ -23,22 +28,11 @@ import (
 	"github.com/smacker/go-tree-sitter/typescript/typescript"
 )
 
-var languageQueries = map[Language]string{
-	"go": `(call_expression
-	function: (selector_expression
-		field: (field_identifier) @field_function))
-
-(call_expression
-    function: (identifier) @function)
-
-(composite_literal
-    type: (qualified_type
-      package: (package_identifier)
-      name: (type_identifier) @struct_name))
-
-(selector_expression
-    field: (field_identifier) @field_name)`,
-}
+// The built-in queries, one file per language named after it. Anything they
+// capture is looked up with the LSP's go-to-definition.
+//
+//go:embed queries/*.scm
+var builtinQueries embed.FS
 
 type Language string
 
@@ -61,6 +55,27 @@ func (l Language) TS() *sitter.Language {
 	}
 }
 
+// queriesName is the name of the language's query files, since some
+// languages share a grammar
+func (l Language) queriesName() string {
+	switch l {
+	case "jsx":
+		return "tsx"
+	default:
+		return string(l)
+	}
+}
+
+// Supported is whether we have a grammar for the language
+func (l Language) Supported() bool {
+	switch l {
+	case "go", "py", "ts", "tsx", "jsx", "js":
+		return true
+	default:
+		return false
+	}
+}
+
 func GetLanguage(fileName string) Language {
 	return Language(strings.TrimPrefix(filepath.Ext(fileName), "."))
 }
@@ -72,11 +87,16 @@ func GetParser(language *sitter.Language) *sitter.Parser {
 	return parser
 }
 
-func New(lsp protocol.Server) *Locality {
-	l := &Locality{
-		Lsp:       lsp,
-		listeners: map[string]chan string{},
-	}
+// DefinitionProvider finds where the symbol at a position is defined, like
+// an LSP's go-to-definition
+type DefinitionProvider interface {
+	Definition(ctx context.Context, params *protocol.DefinitionParams) ([]protocol.Location, error)
+}
+
+// New returns a Locality that looks definitions up with definitions, and
+// reads them from files. If files is nil, they're read from disk.
+func New(definitions DefinitionProvider, files FileProvider) *Locality {
+	l := NewWithoutServer(definitions, files)
 
 	go func() {
 		err := l.Serve()
@@ -88,9 +108,30 @@ func New(lsp protocol.Server) *Locality {
 	return l
 }
 
-type Locality struct {
-	Lsp protocol.Server
+// NewWithoutServer is New, without the websocket server used for visualising context
+func NewWithoutServer(definitions DefinitionProvider, files FileProvider) *Locality {
+	if files == nil {
+		files = DiskFileProvider{}
+	}
 
+	return &Locality{
+		Definitions: definitions,
+		Files:       files,
+		trees:       newTreeCache(),
+		listeners:   map[string]chan string{},
+	}
+}
+
+type Locality struct {
+	Definitions DefinitionProvider
+	Files       FileProvider
+	// Directories with more queries for each language, like go.scm, which
+	// extend the built-in ones
+	QueryDirs []string
+	// How far to follow definitions of what's used in other definitions
+	Expand ExpandOptions
+
+	trees     *treeCache
 	listeners map[string]chan string
 }
 
@@ -100,6 +141,12 @@ type Context struct {
 	File        string                 `json:"file"`
 	Line        int                    `json:"line"`
 	Queries     string                 `json:"queries"`
+	// How many hops from the file each definition was found, starting at 1
+	Hops map[string]int `json:"hops"`
+	// How many times each definition is referenced, by the file and the other definitions
+	References map[string]int `json:"references"`
+	// Where each definition is
+	Locations map[string]protocol.Location `json:"locations"`
 }
 
 func (l *Locality) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -154,109 +201,189 @@ type CodeNode struct {
 }
 
 func (l *Locality) GetContext(fileName, content string, line int) (*Context, error) {
-	language := GetLanguage(fileName)
+	return l.getContext(fileName, content, line, func(node *sitter.Node) bool {
+		return true
+	})
+}
+
+// GetSelectionContext only looks up definitions for code in the selected lines
+func (l *Locality) GetSelectionContext(fileName, content string, selection protocol.Range) (*Context, error) {
+	return l.getContext(fileName, content, int(selection.Start.Line), func(node *sitter.Node) bool {
+		return node.StartPoint().Row >= selection.Start.Line && node.EndPoint().Row <= selection.End.Line
+	})
+}
+
+// GetQueries returns the built-in queries for a language, followed by any
+// from QueryDirs
+func (l *Locality) GetQueries(language Language) (string, error) {
+	builtin, err := builtinQueries.ReadFile("queries/" + language.queriesName() + ".scm")
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", fmt.Errorf("No language queries for %s", language)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	queries := []string{string(builtin)}
+	for _, dir := range l.QueryDirs {
+		extra, err := os.ReadFile(filepath.Join(dir, language.queriesName()+".scm"))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		queries = append(queries, string(extra))
+	}
+
+	return strings.Join(queries, "\n"), nil
+}
+
+// Reference is something in a file we want the definition of
+type Reference struct {
+	Capture string // The name it was captured as in the queries
+	Node    *sitter.Node
+}
+
+// FindReferences runs the queries over source, returning what they capture in
+// the order it appears
+func FindReferences(language Language, queries string, source []byte) ([]*Reference, error) {
 	parser := GetParser(language.TS())
-	source := []byte(content)
 
 	tree, err := parser.ParseCtx(context.TODO(), nil, source)
 	if err != nil {
 		return nil, err
 	}
 
-	queries, ok := languageQueries[language]
-	if !ok {
-		return nil, fmt.Errorf("No language queries for %s", language)
-	}
+	return findNodeReferences(language, queries, tree.RootNode(), source)
+}
 
+// findNodeReferences is FindReferences, within a node that's already been parsed
+func findNodeReferences(language Language, queries string, node *sitter.Node, source []byte) ([]*Reference, error) {
 	q, err := sitter.NewQuery([]byte(queries), language.TS())
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("Invalid queries for %s: %w", language, err)
 	}
 
 	qc := sitter.NewQueryCursor()
-	qc.Exec(q, tree.RootNode())
+	qc.Exec(q, node)
+
+	var references []*Reference
+	for {
+		m, ok := qc.NextMatch()
+		if !ok {
+			break
+		}
+
+		m = qc.FilterPredicates(m, source)
+		for _, c := range m.Captures {
+			references = append(references, &Reference{
+				Capture: q.CaptureNameForId(c.Index),
+				Node:    c.Node,
+			})
+		}
+	}
+
+	sort.SliceStable(references, func(i, j int) bool {
+		return references[i].Node.StartByte() < references[j].Node.StartByte()
+	})
+
+	return references, nil
+}
+
+func (l *Locality) getContext(fileName, content string, line int, include func(node *sitter.Node) bool) (*Context, error) {
+	language := GetLanguage(fileName)
+
+	// Check this first, since TS panics for languages we don't know about
+	queries, err := l.GetQueries(language)
+	if err != nil {
+		return nil, err
+	}
+
+	source := []byte(content)
+
+	references, err := FindReferences(language, queries, source)
+	if err != nil {
+		return nil, err
+	}
 
 	codeCtx := &Context{
 		Captures:    map[string][]*CodeNode{},
 		Definitions: map[string]string{},
+		Hops:        map[string]int{},
+		References:  map[string]int{},
+		Locations:   map[string]protocol.Location{},
 		File:        content,
 		Line:        line,
 		Queries:     queries,
 	}
 
-	for {
-		m, ok := qc.NextMatch()
-		if !ok {
-			break
+	resolved := map[string]*definition{}
+	var found []*definition
+	for _, c := range references {
+		if !include(c.Node) {
+			continue
 		}
 
-		m = qc.FilterPredicates(m, source)
-		for _, c := range m.Captures {
-			// XXX: We also may want to jump to typedef sometimes, not just def
-			locations, err := l.Lsp.Definition(context.TODO(), &protocol.DefinitionParams{
-				TextDocumentPositionParams: protocol.TextDocumentPositionParams{
-					TextDocument: protocol.TextDocumentIdentifier{
-						URI: uri.File(fileName),
-					},
-					Position: protocol.Position{
-						Line:      c.Node.StartPoint().Row,
-						Character: c.Node.StartPoint().Column,
-					},
+		// XXX: We also may want to jump to typedef sometimes, not just def
+		locations, err := l.Definitions.Definition(context.TODO(), &protocol.DefinitionParams{
+			TextDocumentPositionParams: protocol.TextDocumentPositionParams{
+				TextDocument: protocol.TextDocumentIdentifier{
+					URI: uri.File(fileName),
 				},
-			})
+				Position: protocol.Position{
+					Line:      c.Node.StartPoint().Row,
+					Character: c.Node.StartPoint().Column,
+				},
+			},
+		})
+		if err != nil {
+			// XXX: for now, just ignore errors
+			continue
+		}
+
+		for _, location := range locations {
+			definition, err := l.resolveDefinition(resolved, location)
 			if err != nil {
-				// XXX: for now, just ignore errors
-				continue
+				return nil, err
 			}
 
-			for _, location := range locations {
-				uniqueId := fmt.Sprintf("%s %d:%d-%d:%d", location.URI.Filename(), location.Range.Start.Line, location.Range.Start.Character, location.Range.End.Line, location.Range.End.Character)
-
-				codeCtx.Captures[uniqueId] = append(codeCtx.Captures[uniqueId], &CodeNode{
-					ID:      uniqueId,
-					Content: c.Node.Content(source),
-					Start: Position{
-						Line:   c.Node.StartPoint().Row,
-						Column: c.Node.StartPoint().Column,
-					},
-					End: Position{
-						Line:   c.Node.EndPoint().Row,
-						Column: c.Node.EndPoint().Column,
-					},
-					Type: c.Node.Type(),
-				})
-
-				// XXX: HACK: we shouldn't be reading files in this library, we should take some way of being
-				// provided a file. Can do later.
-				fileContents, err := os.ReadFile(location.URI.Filename())
-				if err != nil {
-					return nil, err
-				}
-				// lsp.GetRangeFromFile(string(fileContents), location.Range)
-
-				definitionFileTree, err := parser.ParseCtx(context.TODO(), nil, fileContents)
-				if err != nil {
-					return nil, err
-				}
-
-				definitionNode := definitionFileTree.RootNode().NamedDescendantForPointRange(
-					sitter.Point{
-						Row:    location.Range.Start.Line,
-						Column: location.Range.Start.Character,
-					},
-					sitter.Point{
-						Row:    location.Range.End.Line,
-						Column: location.Range.End.Character,
-					},
-				)
-
-				for definitionNode.Parent() != nil && definitionNode.Parent().Parent() != nil {
-					definitionNode = definitionNode.Parent()
-				}
-
-				codeCtx.Definitions[uniqueId] = definitionNode.Content(fileContents)
+			// Keyed by the node we include, since different names in it (like a
+			// struct's fields) go to the same definition
+			uniqueId := definition.id
+			codeCtx.References[uniqueId]++
+
+			codeCtx.Captures[uniqueId] = append(codeCtx.Captures[uniqueId], &CodeNode{
+				ID:      uniqueId,
+				Content: c.Node.Content(source),
+				Start: Position{
+					Line:   c.Node.StartPoint().Row,
+					Column: c.Node.StartPoint().Column,
+				},
+				End: Position{
+					Line:   c.Node.EndPoint().Row,
+					Column: c.Node.EndPoint().Column,
+				},
+				Type: c.Node.Type(),
+			})
 
+			if _, ok := codeCtx.Definitions[uniqueId]; ok {
+				continue
 			}
+
+			codeCtx.Definitions[uniqueId] = definition.text
+			codeCtx.Hops[uniqueId] = 1
+			codeCtx.Locations[uniqueId] = definition.location
+			found = append(found, definition)
+		}
+	}
+
+	options := l.Expand.withDefaults()
+	for hop := 2; hop <= options.Depth && len(found) > 0; hop++ {
+		found, err = l.expand(codeCtx, resolved, found, hop, options)
+		if err != nil {
+			return nil, err
 		}
 	}
 
@@ -269,3 +396,102 @@ func (l *Locality) GetContext(fileName, content string, line int) (*Context, err
 
 	return codeCtx, nil
 }
+
+func locationId(location protocol.Location) string {
+	return fmt.Sprintf("%s %d:%d-%d:%d", location.URI.Filename(), location.Range.Start.Line, location.Range.Start.Character, location.Range.End.Line, location.Range.End.Character)
+}
+
+// definition is the code a definition location points to
+type definition struct {
+	// Which node this is, so definitions within it end up as the same one
+	id       string
+	filename string
+	language Language
+	source   []byte
+	node     *sitter.Node // Nil if we don't have a grammar for the file
+	text     string
+	// Where the node is, or the definition location without a grammar
+	location protocol.Location
+}
+
+// resolveDefinition is getDefinition, remembering what each location
+// resolved to in resolved, since many references go to the same place
+func (l *Locality) resolveDefinition(resolved map[string]*definition, location protocol.Location) (*definition, error) {
+	id := locationId(location)
+	if def, ok := resolved[id]; ok {
+		return def, nil
+	}
+
+	def, err := l.getDefinition(location)
+	if err != nil {
+		return nil, err
+	}
+
+	resolved[id] = def
+	return def, nil
+}
+
+// getDefinition returns the top-level node enclosing a definition, like the
+// whole function or type, parsed with the grammar for the file it's in
+func (l *Locality) getDefinition(location protocol.Location) (*definition, error) {
+	filename := location.URI.Filename()
+	file, err := l.Files.GetFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	def := &definition{
+		id:       locationId(location),
+		filename: filename,
+		language: GetLanguage(filename),
+		source:   []byte(file.Text),
+		location: location,
+	}
+
+	if !def.language.Supported() {
+		// We can't find the enclosing node without a grammar, so this is the best we can do
+		start := lsp.GetOffset(file.Text, location.Range.Start)
+		end := max(lsp.GetOffset(file.Text, location.Range.End), start)
+		def.text = file.Text[start:end]
+		return def, nil
+	}
+
+	tree, err := l.trees.get(filename, file, def.language)
+	if err != nil {
+		return nil, err
+	}
+
+	definitionNode := tree.RootNode().NamedDescendantForPointRange(
+		sitter.Point{
+			Row:    location.Range.Start.Line,
+			Column: location.Range.Start.Character,
+		},
+		sitter.Point{
+			Row:    location.Range.End.Line,
+			Column: location.Range.End.Character,
+		},
+	)
+
+	for definitionNode.Parent() != nil && definitionNode.Parent().Parent() != nil {
+		definitionNode = definitionNode.Parent()
+	}
+
+	def.id = fmt.Sprintf("%s %d-%d", filename, definitionNode.StartByte(), definitionNode.EndByte())
+	def.node = definitionNode
+	def.text = definitionNode.Content(def.source)
+	def.location = protocol.Location{
+		URI: location.URI,
+		Range: protocol.Range{
+			Start: protocol.Position{
+				Line:      definitionNode.StartPoint().Row,
+				Character: definitionNode.StartPoint().Column,
+			},
+			End: protocol.Position{
+				Line:      definitionNode.EndPoint().Row,
+				Character: definitionNode.EndPoint().Column,
+			},
+		},
+	}
+
+	return def, nil
+}
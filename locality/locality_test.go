@@ -0,0 +1,355 @@
+package locality
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/everestmz/sage/docstate"
+	"github.com/everestmz/sage/lsp"
+	"go.lsp.dev/protocol"
+	"go.lsp.dev/uri"
+)
+
+var update = flag.Bool("update", false, "Update the golden files in testdata")
+
+// renderReferences writes one reference per line, as line:column @capture content
+func renderReferences(references []*Reference, source []byte) string {
+	var lines []string
+	for _, reference := range references {
+		start := reference.Node.StartPoint()
+		lines = append(lines, fmt.Sprintf("%d:%d @%s %s", start.Row+1, start.Column+1, reference.Capture, reference.Node.Content(source)))
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func TestQueries(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+	}{
+		{"Go", "sample.go"},
+		{"Python", "sample.py"},
+		{"JavaScript", "sample.js"},
+		{"TypeScript", "sample.ts"},
+		{"TSX", "sample.tsx"},
+	}
+
+	l := NewWithoutServer(nil, nil)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join("testdata", tt.filename)
+			source, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			language := GetLanguage(tt.filename)
+			queries, err := l.GetQueries(language)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			references, err := FindReferences(language, queries, source)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			result := renderReferences(references, source)
+
+			goldenPath := path + ".golden"
+			if *update {
+				err = os.WriteFile(goldenPath, []byte(result), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			expected, err := os.ReadFile(goldenPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if result != string(expected) {
+				t.Errorf("Expected references %q, but got %q", string(expected), result)
+			}
+		})
+	}
+}
+
+func TestGetQueriesFromDirs(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "go.scm"), []byte("(type_identifier) @type_name\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := NewWithoutServer(nil, nil)
+	l.QueryDirs = []string{dir, filepath.Join(dir, "missing")}
+
+	tests := []struct {
+		name     string
+		language Language
+		contains string
+		wantErr  bool
+	}{
+		{"Extended", "go", "@type_name", false},
+		{"Built-in only", "py", "@class_name", false},
+		{"JSX uses the TSX queries", "jsx", "@component", false},
+		{"Unknown language", "rb", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queries, err := l.GetQueries(tt.language)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetQueries() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if !strings.Contains(queries, tt.contains) {
+				t.Errorf("Expected queries to contain %q, but got %q", tt.contains, queries)
+			}
+		})
+	}
+}
+
+// mockDefinitions finds definitions by the identifier at the position
+type mockDefinitions struct {
+	files       mockFiles
+	definitions map[string]protocol.Location
+}
+
+func (md *mockDefinitions) Definition(ctx context.Context, params *protocol.DefinitionParams) ([]protocol.Location, error) {
+	identifier := lsp.GetIdentifierAtPosition(md.files[params.TextDocument.URI.Filename()], params.Position)
+	location, ok := md.definitions[identifier]
+	if !ok {
+		return nil, nil
+	}
+
+	return []protocol.Location{location}, nil
+}
+
+func mockLocation(filename string, line, start, end uint32) protocol.Location {
+	return protocol.Location{
+		URI: uri.File(filename),
+		Range: protocol.Range{
+			Start: protocol.Position{Line: line, Character: start},
+			End:   protocol.Position{Line: line, Character: end},
+		},
+	}
+}
+
+type mockFiles map[string]string
+
+func (mf mockFiles) GetFile(filename string) (*File, error) {
+	text, ok := mf[filename]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+
+	return &File{Text: text, Version: "1"}, nil
+}
+
+func TestGetContext(t *testing.T) {
+	files := mockFiles{
+		"/src/main.go":     "package main\n\nfunc main() {\n\tgreet(\"world\")\n\trender()\n\tshout()\n}\n",
+		"/defs/greet.py":   "import sys\ndef greet(name):\n    print(name)\n\nx = 1\n",
+		"/defs/render.txt": "unparseable\nrender()\nmore\n",
+	}
+
+	definitions := &mockDefinitions{
+		files: files,
+		definitions: map[string]protocol.Location{
+			"greet":  mockLocation("/defs/greet.py", 1, 4, 9),
+			"render": mockLocation("/defs/render.txt", 1, 0, 8),
+			// Somewhere else in greet
+			"shout": mockLocation("/defs/greet.py", 2, 4, 9),
+		},
+	}
+
+	l := NewWithoutServer(definitions, files)
+	result, err := l.GetContext("/src/main.go", files["/src/main.go"], 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		// Parsed as Python, even though the current file is Go
+		"/defs/greet.py 11-43": "def greet(name):\n    print(name)",
+		// No grammar, so just the range
+		"/defs/render.txt 1:0-1:8": "render()",
+	}
+
+	if !reflect.DeepEqual(result.Definitions, expected) {
+		t.Errorf("Expected definitions %q, but got %q", expected, result.Definitions)
+	}
+
+	// Both references are to greet, so it's only included once
+	if references := result.References["/defs/greet.py 11-43"]; references != 2 {
+		t.Errorf("Expected 2 references to greet, but got %d", references)
+	}
+}
+
+func TestGetContextExpand(t *testing.T) {
+	files := mockFiles{
+		"/src/main.go": "package main\n\nfunc main() {\n\tload()\n}\n",
+		"/defs/defs.go": `package defs
+
+func load() {
+	parse(read())
+	parse(nil)
+}
+
+func parse(b []byte) {
+	helper(b, len(b), cap(b))
+}
+
+func read() []byte {
+	return nil
+}
+
+func helper() {
+	load()
+}
+`,
+	}
+
+	definitions := &mockDefinitions{
+		files: files,
+		definitions: map[string]protocol.Location{
+			"load":   mockLocation("/defs/defs.go", 2, 5, 9),
+			"parse":  mockLocation("/defs/defs.go", 7, 5, 10),
+			"read":   mockLocation("/defs/defs.go", 11, 5, 9),
+			"helper": mockLocation("/defs/defs.go", 15, 5, 11),
+		},
+	}
+
+	load := "/defs/defs.go 14-56"
+	parse := "/defs/defs.go 58-109"
+	read := "/defs/defs.go 111-145"
+	helper := "/defs/defs.go 147-172"
+
+	tests := []struct {
+		name     string
+		options  ExpandOptions
+		expected map[string]int
+	}{
+		{
+			name:     "One hop by default",
+			options:  ExpandOptions{},
+			expected: map[string]int{load: 1},
+		},
+		{
+			name:     "Most referenced first",
+			options:  ExpandOptions{Depth: 2, MaxDefinitionsPerHop: 1},
+			expected: map[string]int{load: 1, parse: 2},
+		},
+		{
+			name:     "Whatever fits in the hop",
+			options:  ExpandOptions{Depth: 2, MaxHopSize: 40},
+			expected: map[string]int{load: 1, read: 2},
+		},
+		{
+			name:     "Visits each definition once",
+			options:  ExpandOptions{Depth: 5},
+			expected: map[string]int{load: 1, parse: 2, read: 2, helper: 3},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewWithoutServer(definitions, files)
+			l.Expand = tt.options
+
+			result, err := l.GetContext("/src/main.go", files["/src/main.go"], 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(result.Hops, tt.expected) {
+				t.Errorf("Expected hops %v, but got %v", tt.expected, result.Hops)
+			}
+
+			for id := range tt.expected {
+				if _, ok := result.Definitions[id]; !ok {
+					t.Errorf("Expected a definition for %s", id)
+				}
+			}
+		})
+	}
+}
+
+func TestDocumentFileProvider(t *testing.T) {
+	dir := t.TempDir()
+	openPath := filepath.Join(dir, "open.go")
+	closedPath := filepath.Join(dir, "closed.go")
+	for _, path := range []string{openPath, closedPath} {
+		err := os.WriteFile(path, []byte("package saved\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	docs := docstate.NewDocumentState()
+	docs.OpenDocument(&protocol.TextDocumentItem{
+		URI:     uri.File(openPath),
+		Version: 3,
+		Text:    "package unsaved\n",
+	})
+
+	provider := &DocumentFileProvider{Docs: docs}
+
+	tests := []struct {
+		name     string
+		filename string
+		expected string
+	}{
+		{"Open documents have unsaved changes", openPath, "package unsaved\n"},
+		{"Closed files come from disk", closedPath, "package saved\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file, err := provider.GetFile(tt.filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if file.Text != tt.expected {
+				t.Errorf("Expected text %q, but got %q", tt.expected, file.Text)
+			}
+		})
+	}
+}
+
+func TestTreeCache(t *testing.T) {
+	cache := newTreeCache()
+
+	first, err := cache.get("a.go", &File{Text: "package a\n", Version: "1"}, "go")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	same, err := cache.get("a.go", &File{Text: "package a\n", Version: "1"}, "go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if same != first {
+		t.Errorf("Expected the same version to reuse the tree")
+	}
+
+	changed, err := cache.get("a.go", &File{Text: "package b\n", Version: "2"}, "go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed == first {
+		t.Errorf("Expected a new version to be parsed again")
+	}
+}
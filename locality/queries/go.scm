@@ -0,0 +1,14 @@
+(call_expression
+	function: (selector_expression
+		field: (field_identifier) @field_function))
+
+(call_expression
+    function: (identifier) @function)
+
+(composite_literal
+    type: (qualified_type
+      package: (package_identifier)
+      name: (type_identifier) @struct_name))
+
+(selector_expression
+    field: (field_identifier) @field_name)
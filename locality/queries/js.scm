@@ -0,0 +1,34 @@
+(call_expression
+    function: (identifier) @function)
+
+(call_expression
+    function: (member_expression
+      property: (property_identifier) @field_function))
+
+(new_expression
+    constructor: (identifier) @class_name)
+
+(new_expression
+    constructor: (member_expression
+      property: (property_identifier) @class_name))
+
+(member_expression
+    property: (property_identifier) @field_name)
+
+(class_heritage
+    (identifier) @class_name)
+
+(import_clause
+    (identifier) @import)
+
+(import_specifier
+    name: (identifier) @import)
+
+(namespace_import
+    (identifier) @import)
+
+(jsx_opening_element
+    name: (identifier) @component)
+
+(jsx_self_closing_element
+    name: (identifier) @component)
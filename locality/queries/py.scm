@@ -0,0 +1,33 @@
+; Calls to lowercase names are functions, and to capitalised ones are usually
+; classes being instantiated
+((call
+    function: (identifier) @function)
+  (#match? @function "^[^A-Z]"))
+
+((call
+    function: (identifier) @class_name)
+  (#match? @class_name "^[A-Z]"))
+
+(class_definition
+    superclasses: (argument_list (identifier) @class_name))
+
+(call
+    function: (attribute
+      attribute: (identifier) @field_function))
+
+(attribute
+    attribute: (identifier) @field_name)
+
+(import_statement
+    name: (dotted_name (identifier) @import .))
+
+(import_statement
+    name: (aliased_import
+      name: (dotted_name (identifier) @import .)))
+
+(import_from_statement
+    name: (dotted_name (identifier) @import .))
+
+(import_from_statement
+    name: (aliased_import
+      name: (dotted_name (identifier) @import .)))
@@ -0,0 +1,44 @@
+(call_expression
+    function: (identifier) @function)
+
+(call_expression
+    function: (member_expression
+      property: (property_identifier) @field_function))
+
+(new_expression
+    constructor: (identifier) @class_name)
+
+(new_expression
+    constructor: (member_expression
+      property: (property_identifier) @class_name))
+
+(member_expression
+    property: (property_identifier) @field_name)
+
+; Only where types are used, not where they're declared
+(type_annotation
+    (type_identifier) @type_name)
+
+(type_annotation
+    (array_type (type_identifier) @type_name))
+
+(generic_type
+    name: (type_identifier) @type_name)
+
+(type_arguments
+    (type_identifier) @type_name)
+
+(extends_clause
+    value: (identifier) @class_name)
+
+(implements_clause
+    (type_identifier) @type_name)
+
+(import_clause
+    (identifier) @import)
+
+(import_specifier
+    name: (identifier) @import)
+
+(namespace_import
+    (identifier) @import)
@@ -0,0 +1,23 @@
+package sample
+
+import (
+	"fmt"
+	"net/http"
+)
+
+type Server struct {
+	client *http.Client
+}
+
+func NewServer() *Server {
+	return &Server{client: &http.Client{}}
+}
+
+func (s *Server) Get(url string) error {
+	resp, err := s.client.Get(url)
+	if err != nil {
+		return fmt.Errorf("get %s: %w", url, err)
+	}
+
+	return check(resp.StatusCode)
+}
@@ -0,0 +1,10 @@
+import React from "react";
+import { useState } from "react";
+import * as api from "./api";
+
+export function Counter({ start }) {
+  const [count, setCount] = useState(start);
+  const client = new api.Client();
+
+  return <Button onClick={() => setCount(count + 1)} label={client.name} />;
+}
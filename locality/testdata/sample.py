@@ -0,0 +1,15 @@
+import os
+import xml.etree.ElementTree as ET
+from collections import OrderedDict
+from pathlib import Path as P
+
+
+class Cache(Base):
+    def __init__(self, root):
+        self.root = P(root)
+        self.entries = OrderedDict()
+
+    def load(self, name):
+        path = os.path.join(self.root, name)
+        tree = ET.parse(path)
+        return normalise(tree.getroot())
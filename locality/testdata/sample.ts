@@ -0,0 +1,20 @@
+import { EventEmitter } from "events";
+import * as path from "path";
+
+interface Options {
+  root: string;
+}
+
+export class Watcher extends EventEmitter {
+  constructor(private options: Options) {
+    super();
+  }
+
+  resolve(file: string): string {
+    const resolved = path.join(this.options.root, file);
+    this.emit("resolve", resolved);
+    return normalise(resolved);
+  }
+}
+
+const watcher = new Watcher({ root: "." });
@@ -0,0 +1,18 @@
+import React from "react";
+import { Item } from "./item";
+
+type Props = {
+  items: Item[];
+};
+
+export function List({ items }: Props) {
+  const sorted = items.slice().sort(compare);
+
+  return (
+    <Stack>
+      {sorted.map((item) => (
+        <Row key={item.id} item={item} />
+      ))}
+    </Stack>
+  );
+}
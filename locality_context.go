@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/everestmz/sage/locality"
+	"go.lsp.dev/protocol"
+)
+
+// selectionDefinitions renders the definitions of what's referenced around the
+// selection, in whatever's left of the model's token budget after the context
+// and the file. It's empty if locality isn't running.
+func selectionDefinitions(args *LlmCompletionArgs, clientInfo *LanguageServerClientInfo, model, text, filesContext string, contextEntries []*ContextEntry) (string, error) {
+	if clientInfo.Locality == nil {
+		return "", nil
+	}
+
+	models, err := clientInfo.Config.Models.Get()
+	if err != nil {
+		return "", err
+	}
+
+	region := getLocalityRegion(args.Selection)
+	localityContext, err := clientInfo.Locality.GetSelectionContext(args.Filename.Filename(), text, region)
+	if err != nil {
+		// Not every language has locality queries, and the prompt works without them
+		globalLsLogger.Debug().Err(err).Msg("Error getting locality context")
+		return "", nil
+	}
+
+	renderer, err := models.GetContextRenderer(model)
+	if err != nil {
+		return "", err
+	}
+
+	budget := models.GetContextTokens() - estimateTokens(filesContext) - estimateTokens(text)
+	return renderDefinitions(renderer, clientInfo.wd, localityContext, args.Selection, contextEntries, budget)
+}
+
+// How many lines either side of the selection we include definitions for
+// the references in
+const localityContextLines = 10
+
+func getLocalityRegion(selection protocol.Range) protocol.Range {
+	startLine := uint32(0)
+	if selection.Start.Line > localityContextLines {
+		startLine = selection.Start.Line - localityContextLines
+	}
+
+	return protocol.Range{
+		Start: protocol.Position{Line: startLine},
+		End:   protocol.Position{Line: selection.End.Line + localityContextLines},
+	}
+}
+
+// estimateTokens is a rough count of the tokens in text. Models differ, but
+// about four characters a token is close enough to keep prompts in budget.
+func estimateTokens(text string) int {
+	return (len(text) + 3) / 4
+}
+
+// renderDefinitions formats the definitions locality found. Those the
+// selection references come first, closest first, then each further hop, most
+// referenced first. Definitions that context.txt already includes are left
+// out, and we stop once the next one would go over the token budget.
+func renderDefinitions(renderer ContextRenderer, wd string, localityContext *locality.Context, selection protocol.Range, existingContext []*ContextEntry, budget int) (string, error) {
+	// How far the closest reference to each definition is from the selection
+	distances := map[string]uint32{}
+	hops := map[string]int{}
+	var ids []string
+	for id := range localityContext.Definitions {
+		ids = append(ids, id)
+
+		hops[id] = max(localityContext.Hops[id], 1)
+		for i, node := range localityContext.Captures[id] {
+			distance := uint32(0)
+			if node.End.Line < selection.Start.Line {
+				distance = selection.Start.Line - node.End.Line
+			} else if node.Start.Line > selection.End.Line {
+				distance = node.Start.Line - selection.End.Line
+			}
+
+			if i == 0 || distance < distances[id] {
+				distances[id] = distance
+			}
+		}
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := ids[i], ids[j]
+		if hops[a] != hops[b] {
+			return hops[a] < hops[b]
+		}
+		if distances[a] != distances[b] {
+			return distances[a] < distances[b]
+		}
+		if localityContext.References[a] != localityContext.References[b] {
+			return localityContext.References[a] > localityContext.References[b]
+		}
+		return a < b
+	})
+
+	var entries []*ContextEntry
+	for _, id := range ids {
+		definition := localityContext.Definitions[id]
+		location := localityContext.Locations[id]
+		if contextIncludesDefinition(existingContext, wd, location, definition) {
+			continue
+		}
+
+		entry := definitionEntry(wd, location, definition)
+		rendered, err := renderer.Render([]*ContextEntry{entry})
+		if err != nil {
+			return "", err
+		}
+
+		tokens := estimateTokens(rendered)
+		if tokens > budget {
+			break
+		}
+		budget -= tokens
+
+		entries = append(entries, entry)
+	}
+
+	return renderer.RenderSection("Definitions", entries)
+}
+
+// contextIncludesDefinition is whether the context already has the definition
+// at location in it: the whole of its file, a range around it, or a symbol in
+// its file that it's part of
+func contextIncludesDefinition(entries []*ContextEntry, wd string, location protocol.Location, definition string) bool {
+	definitionFile := location.URI.Filename()
+	for _, entry := range entries {
+		filename := entry.Filename
+		if filename == "" {
+			// Diffs and diagnostics
+			continue
+		}
+		if !filepath.IsAbs(filename) {
+			filename = filepath.Join(wd, filename)
+		}
+		if filename != definitionFile {
+			continue
+		}
+
+		switch entry.Type {
+		case ContextItemTypeFile, ContextItemTypeGlob, ContextItemTypeOpen, ContextItemTypeRecent:
+			return true
+		case ContextItemTypeRange:
+			// Ranges are one-based and inclusive
+			start, end, err := parseRange(entry.Identifier)
+			if err == nil && start <= int(location.Range.Start.Line)+1 && end >= int(location.Range.End.Line)+1 {
+				return true
+			}
+		case ContextItemTypeSymbol:
+			if strings.Contains(entry.Content, strings.TrimSpace(definition)) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// definitionEntry is a context entry for the definition at location, with
+// the file relative to the workspace like context.txt's are
+func definitionEntry(wd string, location protocol.Location, definition string) *ContextEntry {
+	filename := location.URI.Filename()
+	if rel, err := filepath.Rel(wd, filename); err == nil && !strings.HasPrefix(rel, "..") {
+		filename = rel
+	}
+
+	return &ContextEntry{
+		Type: ContextItemTypeDefinition,
+		ContextItem: &ContextItem{
+			Filename:   filename,
+			Identifier: fmt.Sprintf("%d:%d", location.Range.Start.Line+1, location.Range.End.Line+1),
+			Content:    definition,
+		},
+	}
+}
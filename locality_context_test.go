@@ -0,0 +1,187 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/everestmz/sage/locality"
+	"go.lsp.dev/protocol"
+	"go.lsp.dev/uri"
+)
+
+func TestRenderDefinitions(t *testing.T) {
+	node := func(line uint32) *locality.CodeNode {
+		return &locality.CodeNode{
+			Start: locality.Position{Line: line},
+			End:   locality.Position{Line: line},
+		}
+	}
+
+	location := func(file string, start, end uint32) protocol.Location {
+		return protocol.Location{
+			URI: uri.File("/ws/" + file),
+			Range: protocol.Range{
+				Start: protocol.Position{Line: start},
+				End:   protocol.Position{Line: end, Character: 1},
+			},
+		}
+	}
+
+	localityContext := &locality.Context{
+		Captures: map[string][]*locality.CodeNode{
+			"far.go 1:0-3:1":    {node(40)},
+			"near.go 1:0-3:1":   {node(22), node(2)},
+			"inside.go 1:0-3:1": {node(11)},
+			"shared.go 1:0-3:1": {node(10)},
+		},
+		Definitions: map[string]string{
+			"far.go 1:0-3:1":    "func far() {}",
+			"near.go 1:0-3:1":   "func near() {}",
+			"inside.go 1:0-3:1": "func inside() {}",
+			"shared.go 1:0-3:1": "func shared() {}",
+			"util.go 1:0-1:9":   "type util int",
+			"types.go 1:0-1:9":  "type types int",
+		},
+		Locations: map[string]protocol.Location{
+			"far.go 1:0-3:1":    location("far.go", 0, 2),
+			"near.go 1:0-3:1":   location("near.go", 0, 2),
+			"inside.go 1:0-3:1": location("inside.go", 0, 2),
+			"shared.go 1:0-3:1": location("shared.go", 0, 2),
+			"util.go 1:0-1:9":   location("util.go", 0, 0),
+			"types.go 1:0-1:9":  location("types.go", 0, 0),
+		},
+		Hops: map[string]int{
+			"util.go 1:0-1:9":  2,
+			"types.go 1:0-1:9": 2,
+		},
+		References: map[string]int{
+			"util.go 1:0-1:9":  1,
+			"types.go 1:0-1:9": 3,
+		},
+	}
+
+	selection := protocol.Range{
+		Start: protocol.Position{Line: 10},
+		End:   protocol.Position{Line: 12},
+	}
+	existingContext := []*ContextEntry{
+		{
+			Type:        ContextItemTypeFile,
+			ContextItem: &ContextItem{Filename: "shared.go", Content: "package shared\n\nfunc shared() {}\n"},
+		},
+	}
+
+	inside := "<Definition file=\"inside.go\" range=\"1:3\">\nfunc inside() {}\n</Definition>\n"
+	near := "<Definition file=\"near.go\" range=\"1:3\">\nfunc near() {}\n</Definition>\n"
+	far := "<Definition file=\"far.go\" range=\"1:3\">\nfunc far() {}\n</Definition>\n"
+	types := "<Definition file=\"types.go\" range=\"1:1\">\ntype types int\n</Definition>\n"
+	util := "<Definition file=\"util.go\" range=\"1:1\">\ntype util int\n</Definition>\n"
+
+	tests := []struct {
+		name     string
+		budget   int
+		expected string
+	}{
+		{
+			name:     "Closest first, then the next hop by references, without what's already in the context",
+			budget:   1000,
+			expected: "<Definitions>\n" + inside + near + far + types + util + "</Definitions>\n",
+		},
+		{
+			name:     "Stops at the budget",
+			budget:   estimateTokens(inside) + estimateTokens(near),
+			expected: "<Definitions>\n" + inside + near + "</Definitions>\n",
+		},
+		{
+			name:     "No budget left",
+			budget:   -10,
+			expected: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := renderDefinitions(XMLContextRenderer{}, "/ws", localityContext, selection, existingContext, tt.budget)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if result != tt.expected {
+				t.Errorf("Expected definitions %q, but got %q", tt.expected, result)
+			}
+		})
+	}
+}
+
+func TestContextIncludesDefinition(t *testing.T) {
+	location := protocol.Location{
+		URI: uri.File("/ws/pkg/parse.go"),
+		Range: protocol.Range{
+			Start: protocol.Position{Line: 9},
+			End:   protocol.Position{Line: 11, Character: 1},
+		},
+	}
+	definition := "func parse(s string) string {\n\treturn \"<\" + s + \">\"\n}"
+
+	entry := func(itemType ContextItemType, filename, identifier, content string) *ContextEntry {
+		return &ContextEntry{
+			Type:        itemType,
+			ContextItem: &ContextItem{Filename: filename, Identifier: identifier, Content: content},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		entries  []*ContextEntry
+		expected bool
+	}{
+		{
+			name:     "Whole file",
+			entries:  []*ContextEntry{entry(ContextItemTypeFile, "pkg/parse.go", "", "package pkg\n\n"+definition)},
+			expected: true,
+		},
+		{
+			name:     "Open document by its absolute path",
+			entries:  []*ContextEntry{entry(ContextItemTypeOpen, "/ws/pkg/parse.go", "", definition)},
+			expected: true,
+		},
+		{
+			name:     "A different file",
+			entries:  []*ContextEntry{entry(ContextItemTypeFile, "pkg/print.go", "", definition)},
+			expected: false,
+		},
+		{
+			name:     "Range around it",
+			entries:  []*ContextEntry{entry(ContextItemTypeRange, "pkg/parse.go", "5:12", definition)},
+			expected: true,
+		},
+		{
+			name:     "Range with only part of it",
+			entries:  []*ContextEntry{entry(ContextItemTypeRange, "pkg/parse.go", "11:20", "}")},
+			expected: false,
+		},
+		{
+			name:     "Symbol it's part of",
+			entries:  []*ContextEntry{entry(ContextItemTypeSymbol, "pkg/parse.go", "parse", definition+"\n")},
+			expected: true,
+		},
+		{
+			name:     "Another symbol in its file",
+			entries:  []*ContextEntry{entry(ContextItemTypeSymbol, "pkg/parse.go", "print", "func print() {}")},
+			expected: false,
+		},
+		{
+			name:     "Diff that mentions it",
+			entries:  []*ContextEntry{entry(ContextItemTypeDiff, "", "", "+"+definition)},
+			expected: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := contextIncludesDefinition(tt.entries, "/ws", location, definition)
+			if result != tt.expected {
+				t.Errorf("Expected %v, but got %v", tt.expected, result)
+			}
+		})
+	}
+}
@@ -0,0 +1,333 @@
+package lsp
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"go.lsp.dev/protocol"
+)
+
+// Past this many cells in the LCS table we stop trying to find a minimal diff,
+// and just replace the whole changed block
+const maxDiffCells = 4_000_000
+
+type diffOpKind int
+
+const (
+	diffEqual diffOpKind = iota
+	diffDelete
+	diffInsert
+)
+
+type diffOp struct {
+	kind diffOpKind
+	line string
+}
+
+// splitLines splits text into lines that keep their trailing newline, so that
+// joining them back together gives the original text
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	return lines
+}
+
+func diffLines(oldLines, newLines []string) []diffOp {
+	var prefix, suffix []diffOp
+
+	for len(oldLines) > 0 && len(newLines) > 0 && oldLines[0] == newLines[0] {
+		prefix = append(prefix, diffOp{diffEqual, oldLines[0]})
+		oldLines = oldLines[1:]
+		newLines = newLines[1:]
+	}
+
+	for len(oldLines) > 0 && len(newLines) > 0 && oldLines[len(oldLines)-1] == newLines[len(newLines)-1] {
+		suffix = append([]diffOp{{diffEqual, oldLines[len(oldLines)-1]}}, suffix...)
+		oldLines = oldLines[:len(oldLines)-1]
+		newLines = newLines[:len(newLines)-1]
+	}
+
+	n, m := len(oldLines), len(newLines)
+
+	var middle []diffOp
+	if n*m > maxDiffCells {
+		for _, line := range oldLines {
+			middle = append(middle, diffOp{diffDelete, line})
+		}
+		for _, line := range newLines {
+			middle = append(middle, diffOp{diffInsert, line})
+		}
+	} else {
+		// lcs[i][j] is the length of the LCS of oldLines[i:] and newLines[j:]
+		lcs := make([][]int, n+1)
+		for i := range lcs {
+			lcs[i] = make([]int, m+1)
+		}
+
+		for i := n - 1; i >= 0; i-- {
+			for j := m - 1; j >= 0; j-- {
+				if oldLines[i] == newLines[j] {
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				} else {
+					lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+				}
+			}
+		}
+
+		i, j := 0, 0
+		for i < n || j < m {
+			switch {
+			case i < n && j < m && oldLines[i] == newLines[j]:
+				middle = append(middle, diffOp{diffEqual, oldLines[i]})
+				i++
+				j++
+			case j < m && (i == n || lcs[i][j+1] >= lcs[i+1][j]):
+				middle = append(middle, diffOp{diffInsert, newLines[j]})
+				j++
+			default:
+				middle = append(middle, diffOp{diffDelete, oldLines[i]})
+				i++
+			}
+		}
+	}
+
+	return append(append(prefix, middle...), suffix...)
+}
+
+func commonPrefixLen(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+
+	return i
+}
+
+func commonSuffixLen(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[len(a)-1-i] == b[len(b)-1-i] {
+		i++
+	}
+
+	return i
+}
+
+// ComputeTextEdits returns the edits that turn oldText into newText, where
+// oldText is located in a document starting at start. Changed lines are
+// grouped into one edit per block, and each edit is narrowed down to the
+// characters that actually differ.
+func ComputeTextEdits(oldText, newText string, start protocol.Position) []protocol.TextEdit {
+	ops := diffLines(splitLines(oldText), splitLines(newText))
+
+	edits := []protocol.TextEdit{}
+
+	pos := start
+	for i := 0; i < len(ops); {
+		if ops[i].kind == diffEqual {
+			pos = AdvancePosition(pos, ops[i].line)
+			i++
+			continue
+		}
+
+		var oldChunk, newChunk strings.Builder
+		for ; i < len(ops) && ops[i].kind != diffEqual; i++ {
+			if ops[i].kind == diffDelete {
+				oldChunk.WriteString(ops[i].line)
+			} else {
+				newChunk.WriteString(ops[i].line)
+			}
+		}
+
+		oldStr, newStr := oldChunk.String(), newChunk.String()
+		prefix := commonPrefixLen(oldStr, newStr)
+		suffix := commonSuffixLen(oldStr[prefix:], newStr[prefix:])
+
+		editStart := AdvancePosition(pos, oldStr[:prefix])
+		editEnd := AdvancePosition(editStart, oldStr[prefix:len(oldStr)-suffix])
+
+		edits = append(edits, protocol.TextEdit{
+			Range: protocol.Range{
+				Start: editStart,
+				End:   editEnd,
+			},
+			NewText: newStr[prefix : len(newStr)-suffix],
+		})
+
+		pos = AdvancePosition(pos, oldStr)
+	}
+
+	return edits
+}
+
+// UnifiedDiff renders the changes between oldText and newText as a unified
+// diff with the given number of context lines
+func UnifiedDiff(oldName, newName, oldText, newText string, contextLines int) string {
+	ops := diffLines(splitLines(oldText), splitLines(newText))
+
+	var builder strings.Builder
+	builder.WriteString("--- " + oldName + "\n")
+	builder.WriteString("+++ " + newName + "\n")
+
+	// Line numbers in the old and new text at the start of each op
+	oldLineAt := make([]int, len(ops)+1)
+	newLineAt := make([]int, len(ops)+1)
+	var changes []int
+	for i, op := range ops {
+		oldLineAt[i+1], newLineAt[i+1] = oldLineAt[i], newLineAt[i]
+		if op.kind != diffInsert {
+			oldLineAt[i+1]++
+		}
+		if op.kind != diffDelete {
+			newLineAt[i+1]++
+		}
+		if op.kind != diffEqual {
+			changes = append(changes, i)
+		}
+	}
+
+	for c := 0; c < len(changes); {
+		// Changes separated by little enough context share a hunk
+		last := c
+		for last+1 < len(changes) && changes[last+1]-changes[last]-1 <= 2*contextLines {
+			last++
+		}
+
+		hunkStart := max(changes[c]-contextLines, 0)
+		hunkEnd := min(changes[last]+1+contextLines, len(ops))
+
+		var body strings.Builder
+		for _, op := range ops[hunkStart:hunkEnd] {
+			line := op.line
+			if !strings.HasSuffix(line, "\n") {
+				line += "\n\\ No newline at end of file\n"
+			}
+
+			switch op.kind {
+			case diffEqual:
+				body.WriteString(" " + line)
+			case diffDelete:
+				body.WriteString("-" + line)
+			case diffInsert:
+				body.WriteString("+" + line)
+			}
+		}
+
+		oldCount := oldLineAt[hunkEnd] - oldLineAt[hunkStart]
+		newCount := newLineAt[hunkEnd] - newLineAt[hunkStart]
+		builder.WriteString(fmt.Sprintf("@@ -%d,%d +%d,%d @@\n", oldLineAt[hunkStart]+1, oldCount, newLineAt[hunkStart]+1, newCount))
+		builder.WriteString(body.String())
+
+		c = last + 1
+	}
+
+	return builder.String()
+}
+
+var hunkHeaderRegex = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+
+// IsUnifiedDiff reports whether text looks like a unified diff rather than code
+func IsUnifiedDiff(text string) bool {
+	for _, line := range strings.Split(strings.TrimSpace(text), "\n") {
+		if strings.HasPrefix(line, "--- ") || strings.HasPrefix(line, "+++ ") {
+			continue
+		}
+
+		return hunkHeaderRegex.MatchString(line)
+	}
+
+	return false
+}
+
+// ApplyUnifiedDiff applies a unified diff to text. LLMs are bad at counting
+// lines, so hunks are located by their content rather than the line numbers
+// in their headers.
+func ApplyUnifiedDiff(text, diff string) (string, error) {
+	lines := splitLines(text)
+
+	type hunk struct {
+		oldLines []string
+		newLines []string
+	}
+
+	var hunks []*hunk
+	var current *hunk
+
+	for _, line := range strings.Split(diff, "\n") {
+		switch {
+		case hunkHeaderRegex.MatchString(line):
+			current = &hunk{}
+			hunks = append(hunks, current)
+		case current == nil:
+			// File headers, or any prose the model put before the diff
+			continue
+		case strings.HasPrefix(line, `\`):
+			// "\ No newline at end of file"
+			if len(current.newLines) > 0 {
+				last := current.newLines[len(current.newLines)-1]
+				current.newLines[len(current.newLines)-1] = strings.TrimSuffix(last, "\n")
+			}
+		case strings.HasPrefix(line, "-"):
+			current.oldLines = append(current.oldLines, line[1:]+"\n")
+		case strings.HasPrefix(line, "+"):
+			current.newLines = append(current.newLines, line[1:]+"\n")
+		case strings.HasPrefix(line, " "):
+			current.oldLines = append(current.oldLines, line[1:]+"\n")
+			current.newLines = append(current.newLines, line[1:]+"\n")
+		case line == "":
+			// Models often strip the leading space from empty context lines
+			current.oldLines = append(current.oldLines, "\n")
+			current.newLines = append(current.newLines, "\n")
+		}
+	}
+
+	if len(hunks) == 0 {
+		return "", fmt.Errorf("No hunks found in diff")
+	}
+
+	var result []string
+	cursor := 0
+
+	for i, h := range hunks {
+		// Trailing empty context lines are usually an artifact of the diff ending in a newline
+		for len(h.oldLines) > 0 && len(h.newLines) > 0 && h.oldLines[len(h.oldLines)-1] == "\n" && h.newLines[len(h.newLines)-1] == "\n" {
+			h.oldLines = h.oldLines[:len(h.oldLines)-1]
+			h.newLines = h.newLines[:len(h.newLines)-1]
+		}
+
+		start := findLines(lines, h.oldLines, cursor)
+		if start < 0 {
+			return "", fmt.Errorf("Hunk %d does not match the document", i+1)
+		}
+
+		result = append(result, lines[cursor:start]...)
+		result = append(result, h.newLines...)
+		cursor = start + len(h.oldLines)
+	}
+
+	result = append(result, lines[cursor:]...)
+
+	return strings.Join(result, ""), nil
+}
+
+func findLines(lines, needle []string, from int) int {
+	trimmed := func(s string) string {
+		return strings.TrimRight(s, "\n")
+	}
+
+outer:
+	for i := from; i+len(needle) <= len(lines); i++ {
+		for j, line := range needle {
+			if trimmed(lines[i+j]) != trimmed(line) {
+				continue outer
+			}
+		}
+
+		return i
+	}
+
+	return -1
+}
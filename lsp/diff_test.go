@@ -0,0 +1,188 @@
+package lsp
+
+import (
+	"strings"
+	"testing"
+
+	"go.lsp.dev/protocol"
+)
+
+// applyEdits applies non-overlapping edits, given in document order, to text
+func applyEdits(t *testing.T, text string, edits []protocol.TextEdit) string {
+	lines := strings.SplitAfter(text, "\n")
+	offset := func(pos protocol.Position) int {
+		off := 0
+		for i := 0; i < int(pos.Line); i++ {
+			off += len(lines[i])
+		}
+		return off + int(pos.Character)
+	}
+
+	var builder strings.Builder
+	last := 0
+	for _, edit := range edits {
+		start, end := offset(edit.Range.Start), offset(edit.Range.End)
+		if start < last || end < start {
+			t.Fatalf("Edits overlap or are out of order: %v", edits)
+		}
+		builder.WriteString(text[last:start])
+		builder.WriteString(edit.NewText)
+		last = end
+	}
+	builder.WriteString(text[last:])
+
+	return builder.String()
+}
+
+func TestComputeTextEdits(t *testing.T) {
+	tests := []struct {
+		name          string
+		oldText       string
+		newText       string
+		expectedEdits int
+	}{
+		{
+			name:          "No changes",
+			oldText:       "a\nb\nc\n",
+			newText:       "a\nb\nc\n",
+			expectedEdits: 0,
+		},
+		{
+			name:          "Single line change",
+			oldText:       "func a() {\n\treturn 1\n}\n",
+			newText:       "func a() {\n\treturn 2\n}\n",
+			expectedEdits: 1,
+		},
+		{
+			name:          "Separate changes",
+			oldText:       "one\ntwo\nthree\nfour\nfive\n",
+			newText:       "ONE\ntwo\nthree\nfour\nFIVE\n",
+			expectedEdits: 2,
+		},
+		{
+			name:          "Insertion and deletion",
+			oldText:       "a\nb\nc\n",
+			newText:       "a\nc\nd\n",
+			expectedEdits: 2,
+		},
+		{
+			name:          "No trailing newline",
+			oldText:       "a\nb",
+			newText:       "a\nb\nc",
+			expectedEdits: 1,
+		},
+		{
+			name:          "Replace everything",
+			oldText:       "x",
+			newText:       "y\nz\n",
+			expectedEdits: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			edits := ComputeTextEdits(tt.oldText, tt.newText, protocol.Position{})
+
+			if len(edits) != tt.expectedEdits {
+				t.Errorf("Expected %d edits, but got %d: %v", tt.expectedEdits, len(edits), edits)
+			}
+
+			result := applyEdits(t, tt.oldText, edits)
+			if result != tt.newText {
+				t.Errorf("Expected result %q, but got %q", tt.newText, result)
+			}
+		})
+	}
+}
+
+func TestComputeTextEditsOffset(t *testing.T) {
+	document := "package main\n\nfunc a() int {\n\treturn 1\n}\n"
+	start := protocol.Position{Line: 2, Character: 0}
+	selection := "func a() int {\n\treturn 1\n}\n"
+
+	edits := ComputeTextEdits(selection, "func a() int {\n\treturn 42\n}\n", start)
+	result := applyEdits(t, document, edits)
+
+	expected := "package main\n\nfunc a() int {\n\treturn 42\n}\n"
+	if result != expected {
+		t.Errorf("Expected result %q, but got %q", expected, result)
+	}
+}
+
+func TestUnifiedDiffRoundTrip(t *testing.T) {
+	oldText := "one\ntwo\nthree\nfour\nfive\nsix\nseven\neight\nnine\nten\n"
+	newText := "one\nTWO\nthree\nfour\nfive\nsix\nseven\neight\nnine\nten\neleven\n"
+
+	diff := UnifiedDiff("a/file", "b/file", oldText, newText, 3)
+	if !IsUnifiedDiff(diff) {
+		t.Fatalf("Expected %q to be detected as a diff", diff)
+	}
+
+	if strings.Count(diff, "@@ -") != 2 {
+		t.Errorf("Expected 2 hunks, but got diff:\n%s", diff)
+	}
+
+	result, err := ApplyUnifiedDiff(oldText, diff)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if result != newText {
+		t.Errorf("Expected result %q, but got %q", newText, result)
+	}
+}
+
+func TestApplyUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name           string
+		text           string
+		diff           string
+		expectedResult string
+		expectError    bool
+	}{
+		{
+			name: "Wrong line numbers",
+			text: "a\nb\nc\nd\n",
+			diff: "--- a/file\n+++ b/file\n@@ -10,2 +10,2 @@\n c\n-d\n+D\n",
+
+			expectedResult: "a\nb\nc\nD\n",
+		},
+		{
+			name:           "Empty context line without leading space",
+			text:           "a\n\nb\n",
+			diff:           "@@ -1,3 +1,3 @@\n a\n\n-b\n+B\n",
+			expectedResult: "a\n\nB\n",
+		},
+		{
+			name:        "Hunk does not match",
+			text:        "a\nb\n",
+			diff:        "@@ -1,1 +1,1 @@\n-x\n+y\n",
+			expectError: true,
+		},
+		{
+			name:        "Not a diff",
+			text:        "a\nb\n",
+			diff:        "func a() {}",
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := ApplyUnifiedDiff(tt.text, tt.diff)
+
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("Expected an error, but got none")
+				}
+			} else {
+				if err != nil {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				if result != tt.expectedResult {
+					t.Errorf("Expected result %q, but got %q", tt.expectedResult, result)
+				}
+			}
+		})
+	}
+}
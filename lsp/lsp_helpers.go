@@ -1,6 +1,7 @@
 package lsp
 
 import (
+	"sort"
 	"strings"
 
 	"go.lsp.dev/protocol"
@@ -49,3 +50,120 @@ func GetRangeFromFile(text string, locationRange protocol.Range) string {
 
 	return strings.Join(snippetLines, "\n")
 }
+
+// GetOffset converts a position in text into a byte offset, clamping it to
+// the end of the line or text if it's out of bounds
+func GetOffset(text string, position protocol.Position) int {
+	offset := 0
+	for line := uint32(0); line < position.Line; line++ {
+		next := strings.IndexByte(text[offset:], '\n')
+		if next < 0 {
+			return len(text)
+		}
+		offset += next + 1
+	}
+
+	lineEnd := strings.IndexByte(text[offset:], '\n')
+	if lineEnd < 0 {
+		lineEnd = len(text) - offset
+	}
+
+	if int(position.Character) < lineEnd {
+		return offset + int(position.Character)
+	}
+
+	return offset + lineEnd
+}
+
+func isIdentifierByte(b byte) bool {
+	return b == '_' || (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9')
+}
+
+// GetIdentifierAtPosition returns the identifier the position is in or right
+// after, or an empty string if there isn't one
+func GetIdentifierAtPosition(text string, position protocol.Position) string {
+	offset := GetOffset(text, position)
+
+	start := offset
+	for start > 0 && isIdentifierByte(text[start-1]) {
+		start--
+	}
+
+	end := offset
+	for end < len(text) && isIdentifierByte(text[end]) {
+		end++
+	}
+
+	return text[start:end]
+}
+
+// AdvancePosition returns the position reached after writing text at pos
+func AdvancePosition(pos protocol.Position, text string) protocol.Position {
+	newLines := strings.Count(text, "\n")
+	if newLines == 0 {
+		pos.Character += uint32(len(text))
+		return pos
+	}
+
+	pos.Line += uint32(newLines)
+	pos.Character = uint32(len(text) - strings.LastIndex(text, "\n") - 1)
+
+	return pos
+}
+
+func positionLess(a, b protocol.Position) bool {
+	return a.Line < b.Line || (a.Line == b.Line && a.Character < b.Character)
+}
+
+// TransformPosition returns where pos ends up after the text in changeRange
+// is replaced with text. Positions inside the replaced range, or exactly at an
+// insertion point, move to the end of the new text.
+func TransformPosition(pos protocol.Position, changeRange protocol.Range, text string) protocol.Position {
+	if positionLess(pos, changeRange.Start) {
+		return pos
+	}
+
+	if positionLess(pos, changeRange.End) {
+		return AdvancePosition(changeRange.Start, text)
+	}
+
+	newEnd := AdvancePosition(changeRange.Start, text)
+	if pos.Line == changeRange.End.Line {
+		return protocol.Position{
+			Line:      newEnd.Line,
+			Character: newEnd.Character + pos.Character - changeRange.End.Character,
+		}
+	}
+
+	pos.Line = pos.Line + newEnd.Line - changeRange.End.Line
+	return pos
+}
+
+// ApplyTextEdits applies non-overlapping edits, all made against text, and
+// returns the result
+func ApplyTextEdits(text string, edits []protocol.TextEdit) string {
+	sorted := append([]protocol.TextEdit{}, edits...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return positionLess(sorted[i].Range.Start, sorted[j].Range.Start)
+	})
+
+	var result strings.Builder
+	last := 0
+	for _, edit := range sorted {
+		start := GetOffset(text, edit.Range.Start)
+		end := GetOffset(text, edit.Range.End)
+		if start < last {
+			start = last
+		}
+		if end < start {
+			end = start
+		}
+
+		result.WriteString(text[last:start])
+		result.WriteString(edit.NewText)
+		last = end
+	}
+	result.WriteString(text[last:])
+
+	return result.String()
+}
@@ -0,0 +1,168 @@
+package lsp
+
+import (
+	"testing"
+
+	"go.lsp.dev/protocol"
+)
+
+func pos(line, character uint32) protocol.Position {
+	return protocol.Position{Line: line, Character: character}
+}
+
+func TestTransformPosition(t *testing.T) {
+	tests := []struct {
+		name     string
+		position protocol.Position
+		change   protocol.Range
+		text     string
+		expected protocol.Position
+	}{
+		{
+			name:     "Edit after position",
+			position: pos(2, 4),
+			change:   protocol.Range{Start: pos(3, 0), End: pos(3, 0)},
+			text:     "hello\n",
+			expected: pos(2, 4),
+		},
+		{
+			name:     "Line inserted above",
+			position: pos(2, 4),
+			change:   protocol.Range{Start: pos(0, 0), End: pos(0, 0)},
+			text:     "hello\n",
+			expected: pos(3, 4),
+		},
+		{
+			name:     "Typing earlier on the same line",
+			position: pos(2, 4),
+			change:   protocol.Range{Start: pos(2, 1), End: pos(2, 1)},
+			text:     "abc",
+			expected: pos(2, 7),
+		},
+		{
+			name:     "Insertion at position",
+			position: pos(2, 4),
+			change:   protocol.Range{Start: pos(2, 4), End: pos(2, 4)},
+			text:     "x\ny",
+			expected: pos(3, 1),
+		},
+		{
+			name:     "Lines deleted above",
+			position: pos(5, 2),
+			change:   protocol.Range{Start: pos(1, 0), End: pos(3, 0)},
+			text:     "",
+			expected: pos(3, 2),
+		},
+		{
+			name:     "Position inside deleted range",
+			position: pos(2, 4),
+			change:   protocol.Range{Start: pos(1, 3), End: pos(3, 0)},
+			text:     "",
+			expected: pos(1, 3),
+		},
+		{
+			name:     "Join with end of line",
+			position: pos(3, 6),
+			change:   protocol.Range{Start: pos(2, 5), End: pos(3, 2)},
+			text:     "",
+			expected: pos(2, 9),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := TransformPosition(tt.position, tt.change, tt.text)
+			if result != tt.expected {
+				t.Errorf("Expected position %v, but got %v", tt.expected, result)
+			}
+		})
+	}
+}
+
+func TestGetOffset(t *testing.T) {
+	text := "ab\ncde\n"
+
+	tests := []struct {
+		position protocol.Position
+		expected int
+	}{
+		{pos(0, 0), 0},
+		{pos(0, 2), 2},
+		{pos(1, 1), 4},
+		{pos(1, 10), 6},
+		{pos(2, 0), 7},
+		{pos(5, 0), 7},
+	}
+
+	for _, tt := range tests {
+		result := GetOffset(text, tt.position)
+		if result != tt.expected {
+			t.Errorf("GetOffset(%v) = %d, expected %d", tt.position, result, tt.expected)
+		}
+	}
+}
+
+func TestGetIdentifierAtPosition(t *testing.T) {
+	text := "func (s *Server) Start(ctx context.Context) {\n\treturn\n}\n"
+
+	tests := []struct {
+		position protocol.Position
+		expected string
+	}{
+		{pos(0, 0), "func"},
+		{pos(0, 9), "Server"},
+		{pos(0, 15), "Server"},
+		{pos(0, 17), "Start"},
+		{pos(0, 27), "context"},
+		{pos(0, 44), ""},
+		{pos(1, 0), ""},
+		{pos(2, 1), ""},
+	}
+
+	for _, tt := range tests {
+		result := GetIdentifierAtPosition(text, tt.position)
+		if result != tt.expected {
+			t.Errorf("GetIdentifierAtPosition(%v) = %q, expected %q", tt.position, result, tt.expected)
+		}
+	}
+}
+
+func TestApplyTextEdits(t *testing.T) {
+	text := "one\ntwo\nthree\n"
+
+	tests := []struct {
+		name     string
+		edits    []protocol.TextEdit
+		expected string
+	}{
+		{
+			name:     "No edits",
+			expected: text,
+		},
+		{
+			name: "Inserts out of order",
+			edits: []protocol.TextEdit{
+				{Range: protocol.Range{Start: pos(2, 0), End: pos(2, 0)}, NewText: "// 3\n"},
+				{Range: protocol.Range{Start: pos(0, 0), End: pos(0, 0)}, NewText: "// 1\n"},
+			},
+			expected: "// 1\none\ntwo\n// 3\nthree\n",
+		},
+		{
+			name: "Replacement and insertion at end",
+			edits: []protocol.TextEdit{
+				{Range: protocol.Range{Start: pos(1, 0), End: pos(1, 3)}, NewText: "TWO"},
+				{Range: protocol.Range{Start: pos(3, 0), End: pos(3, 0)}, NewText: "four\n"},
+			},
+			expected: "one\nTWO\nthree\nfour\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := ApplyTextEdits(text, tt.edits)
+			if result != tt.expected {
+				t.Errorf("Expected result %q, but got %q", tt.expected, result)
+			}
+		})
+	}
+}
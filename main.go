@@ -30,7 +30,7 @@ func main() {
 		Use: "sage",
 	}
 
-	rootCmd.AddCommand(IndexCmd, LanguageServerCmd, CompletionCmd, DevCmds, CtxCmd)
+	rootCmd.AddCommand(IndexCmd, LanguageServerCmd, AskCmd, DevCmds, CtxCmd, DocsCmd, CommitMsgCmd)
 
 	if isatty.IsTerminal(os.Stdout.Fd()) {
 		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/everestmz/sage/lsp"
+	"github.com/google/uuid"
+	"go.lsp.dev/protocol"
+	"go.lsp.dev/uri"
+)
+
+// PendingEdit is a generated change that's been shown to the user as a diff,
+// but not yet applied to the document
+type PendingEdit struct {
+	Label   string
+	Target  uri.URI
+	Version int32
+	Edits   []protocol.TextEdit
+}
+
+type PreviewStore struct {
+	dir string
+
+	lock     sync.Mutex
+	previews map[uri.URI]*PendingEdit
+	latest   uri.URI
+}
+
+func NewPreviewStore(dir string) *PreviewStore {
+	return &PreviewStore{
+		dir:      dir,
+		previews: map[uri.URI]*PendingEdit{},
+	}
+}
+
+// Add writes a diff of the pending edit to a preview document, and returns the
+// URI of that document so it can be shown to the user
+func (ps *PreviewStore) Add(edit *PendingEdit, oldText, newText string) (uri.URI, error) {
+	err := os.MkdirAll(ps.dir, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	name := edit.Target.Filename()
+	diff := lsp.UnifiedDiff("a"+name, "b"+name, oldText, newText, 3)
+
+	previewPath := filepath.Join(ps.dir, fmt.Sprintf("%s.diff", uuid.NewString()))
+	err = os.WriteFile(previewPath, []byte(diff), 0644)
+	if err != nil {
+		return "", err
+	}
+
+	previewUri := uri.File(previewPath)
+
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	ps.previews[previewUri] = edit
+	ps.latest = previewUri
+
+	return previewUri, nil
+}
+
+// Get returns the pending edit for a preview document. An empty URI means the
+// most recent preview.
+func (ps *PreviewStore) Get(previewUri uri.URI) (uri.URI, *PendingEdit, bool) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	if previewUri == "" {
+		previewUri = ps.latest
+	}
+
+	edit, ok := ps.previews[previewUri]
+	return previewUri, edit, ok
+}
+
+func (ps *PreviewStore) Remove(previewUri uri.URI) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	delete(ps.previews, previewUri)
+	if ps.latest == previewUri {
+		ps.latest = ""
+	}
+
+	os.Remove(previewUri.Filename())
+}
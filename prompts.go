@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/everestmz/sage/docstate"
+	"github.com/everestmz/sage/liveconf"
+	"github.com/everestmz/sage/lsp"
+	"go.lsp.dev/protocol"
+	"go.lsp.dev/uri"
+	"gopkg.in/yaml.v3"
+)
+
+// PromptTemplateConfig is the text/template for one action, with optional
+// overrides keyed by language
+type PromptTemplateConfig struct {
+	Template  string            `yaml:"template"`
+	Languages map[string]string `yaml:"languages,omitempty"`
+}
+
+// SagePromptsConfig maps action names (completion, rewrite, explain, ...) to their templates
+type SagePromptsConfig map[string]*PromptTemplateConfig
+
+// PromptData is what's available to prompt templates
+type PromptData struct {
+	Action        string
+	Filename      string
+	Language      string
+	File          string
+	FilePrefix    string // Everything in the file before the selection
+	FileSuffix    string // Everything in the file after the selection
+	Selection     string
+	Context       string // The rendered context.txt items
+	Definitions   string // Definitions of symbols used in the selection, as a section in the model's context format
+	Examples      string // Existing code to follow the style of, like the tests already in a test file
+	Diagnostics   string // One diagnostic per line
+	OpenDocuments string // The documents open in the editor
+	RecentEdits   string // The lines around where the user last edited each open document
+	Diff          string // A unified diff of the changes being described
+	Usages        string // Lines where the selected symbol is used, one per line
+
+	// The document the prompt was built from. Edits made from the response
+	// are computed against it and pinned to its version, so they're rejected
+	// rather than applied in the wrong place if the user edits while we generate.
+	document docstate.OpenDocument
+}
+
+var defaultPrompts = SagePromptsConfig{
+	"completion": {
+		Template: `{{.Context}}{{.Definitions}}<CurrentFile path="{{.Filename}}">
+{{.FilePrefix}}
+</CurrentFile>
+{{- if .Diagnostics}}
+<Diagnostics>
+{{.Diagnostics}}
+</Diagnostics>
+{{- end}}
+<SystemPrompt>
+A user's prompt, in the form of a question, or a description code to write, is shown below. Satisfy the user's prompt or question to the best of your ability. If asked to complete code, DO NOT type out any extra text, or backticks since your response will be appended to the end of the CurrentFile. DO NOT regurgitate the whole file. Simply return the new code, or the modified code.
+</SystemPrompt>
+<UserPrompt>
+{{.Selection}}
+</UserPrompt>
+`,
+	},
+	"rewrite": {
+		Template: `{{.Context}}{{.Definitions}}<CurrentFile path="{{.Filename}}">
+{{.File}}
+</CurrentFile>
+{{- if .Diagnostics}}
+<Diagnostics>
+{{.Diagnostics}}
+</Diagnostics>
+{{- end}}
+<SystemPrompt>
+The user has selected the code shown in Selection, from the CurrentFile. It may contain instructions for how to change it, written as comments. Rewrite the selection to satisfy those instructions. Respond with ONLY the full replacement for the selection: DO NOT type out any extra text, explanations or backticks, since your response will replace the selection as-is. If the change can't be made within the selection, respond with ONLY a unified diff against the CurrentFile instead.
+</SystemPrompt>
+<Selection>
+{{.Selection}}
+</Selection>
+`,
+	},
+	"explain": {
+		Template: `{{.Context}}{{.Definitions}}<CurrentFile path="{{.Filename}}">
+{{.File}}
+</CurrentFile>
+<SystemPrompt>
+Explain the {{.Language}} code shown in Selection, from the CurrentFile, to a programmer who is reading it for the first time. Cover what it does, how it fits in with the code around it and the definitions it uses, and any non-obvious behaviour or edge cases. Be concise. Respond in Markdown.
+</SystemPrompt>
+<Selection>
+{{.Selection}}
+</Selection>
+`,
+	},
+	"hover": {
+		Template: `<Definition path="{{.Filename}}">
+{{.Selection}}
+</Definition>
+<SystemPrompt>
+Explain what the {{.Language}} code in Definition does, in one or two sentences. It will be shown when the user hovers over a use of it. DO NOT reproduce the code, or describe its parameters one by one.
+</SystemPrompt>
+`,
+	},
+	"tests": {
+		Template: `{{.Context}}<CurrentFile path="{{.Filename}}">
+{{.File}}
+</CurrentFile>
+{{if .Examples}}<ExistingTests>
+{{.Examples}}
+</ExistingTests>
+{{end}}<SystemPrompt>
+Write table-driven tests for the {{.Language}} code shown in Symbol, from the CurrentFile. Cover its edge cases and interesting codepaths. {{if .Examples}}Your tests will be appended to the end of the file shown in ExistingTests, so follow its style and helpers, and DO NOT repeat its package declaration or imports.{{else}}Your tests will be the whole of a new test file, so include everything the file needs, like a package declaration and imports.{{end}} Respond with ONLY code: DO NOT type out any extra text, explanations or backticks.
+</SystemPrompt>
+<Symbol>
+{{.Selection}}
+</Symbol>
+`,
+	},
+	"docs": {
+		Template: `{{.Context}}<CurrentFile path="{{.Filename}}">
+{{.File}}
+</CurrentFile>
+<SystemPrompt>
+Write a doc comment for the {{.Language}} definition shown in Symbol, from the CurrentFile, following the conventions for {{.Language}} doc comments (for example, Go doc comments start with the name of the definition). Concisely describe what it does, and anything a caller needs to know. Respond with ONLY the text of the comment, WITHOUT comment markers like // or #: DO NOT type out any extra text, code or backticks.
+</SystemPrompt>
+<Symbol>
+{{.Selection}}
+</Symbol>
+`,
+	},
+	"fix": {
+		Template: `{{.Context}}{{.Definitions}}<CurrentFile path="{{.Filename}}">
+{{.File}}
+</CurrentFile>
+<Diagnostics>
+{{.Diagnostics}}
+</Diagnostics>
+<SystemPrompt>
+The {{.Language}} code shown in Selection, from the CurrentFile, has the problems listed in Diagnostics. Rewrite the selection to fix them, changing as little as possible. Respond with ONLY the full replacement for the selection: DO NOT type out any extra text, explanations or backticks, since your response will replace the selection as-is. If the fix can't be made within the selection, respond with ONLY a unified diff against the CurrentFile instead.
+</SystemPrompt>
+<Selection>
+{{.Selection}}
+</Selection>
+`,
+	},
+	"chat": {
+		Template: `You are sage, an assistant for programmers, answering questions about the code they're working on. Be concise, and use Markdown. Below is the code they've chosen to share with you, and the documents they have open in their editor.
+{{.Context}}{{.OpenDocuments}}{{if .RecentEdits}}These are the places they've edited most recently:
+{{.RecentEdits}}{{end}}`,
+	},
+	"commit": {
+		Template: `{{.Definitions}}<Diff>
+{{.Diff}}
+</Diff>
+<SystemPrompt>
+Write a commit message for the changes in Diff, following the Conventional Commits format: a subject line like "fix(parser): handle empty input" of at most 72 characters, then a blank line, then a short body explaining what changed and why. Definitions holds the full definitions of the symbols the changes touch. Respond with ONLY the commit message: DO NOT type out any extra text or backticks.
+</SystemPrompt>
+`,
+	},
+	"names": {
+		Template: `<Usages>
+{{.Usages}}
+</Usages>
+<SystemPrompt>
+Suggest up to 5 better names for the {{.Language}} identifier "{{.Selection}}", based on how it's used in Usages. Follow the naming conventions of {{.Language}} and of the code around it. Respond with ONLY the names, one per line: DO NOT type out any extra text, explanations, numbering or backticks.
+</SystemPrompt>
+`,
+	},
+}
+
+// PromptTemplates resolves the template for an action, checking the workspace
+// prompts.yaml, then the global one, then the built-in defaults. Within each,
+// a template for the document's language wins over the action's default.
+type PromptTemplates struct {
+	workspace *liveconf.ConfigWatcher[SagePromptsConfig]
+	global    *liveconf.ConfigWatcher[SagePromptsConfig]
+}
+
+func loadPromptsConfig(data []byte, config any) error {
+	prompts := SagePromptsConfig{}
+	err := yaml.Unmarshal(data, &prompts)
+	if err != nil {
+		return err
+	}
+
+	*config.(*SagePromptsConfig) = prompts
+	return nil
+}
+
+// defaultGlobalPromptsConfig is the built-in templates, commented out so that
+// they're there to copy from, but don't override the built-ins once they change
+func defaultGlobalPromptsConfig() (string, error) {
+	defaults, err := yaml.Marshal(defaultPrompts)
+	if err != nil {
+		return "", err
+	}
+
+	var config strings.Builder
+	config.WriteString("# Templates here override sage's built-in ones, which are below for reference.\n")
+	config.WriteString("# Uncomment and edit just the ones you want to change.\n")
+	for _, line := range strings.Split(strings.TrimSuffix(string(defaults), "\n"), "\n") {
+		config.WriteString("# " + line + "\n")
+	}
+
+	return config.String(), nil
+}
+
+func NewPromptTemplates() (*PromptTemplates, error) {
+	defaultPromptsConfig, err := defaultGlobalPromptsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	global, err := liveconf.NewConfigWatcher[SagePromptsConfig](getGlobalPromptsPath(), defaultPromptsConfig, &SagePromptsConfig{}, loadPromptsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	workspace, err := liveconf.NewConfigWatcher[SagePromptsConfig](getWorkspacePromptsPath(), "\n", &SagePromptsConfig{}, loadPromptsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PromptTemplates{
+		workspace: workspace,
+		global:    global,
+	}, nil
+}
+
+func (pt *PromptTemplates) Get(action, language string) (string, error) {
+	for _, watcher := range []*liveconf.ConfigWatcher[SagePromptsConfig]{pt.workspace, pt.global} {
+		prompts, err := watcher.Get()
+		if err != nil {
+			return "", err
+		}
+
+		if tmpl, ok := findPromptTemplate(prompts, action, language); ok {
+			return tmpl, nil
+		}
+	}
+
+	if tmpl, ok := findPromptTemplate(defaultPrompts, action, language); ok {
+		return tmpl, nil
+	}
+
+	return "", fmt.Errorf("No prompt template for action '%s'", action)
+}
+
+func findPromptTemplate(prompts SagePromptsConfig, action, language string) (string, bool) {
+	config, ok := prompts[action]
+	if !ok || config == nil {
+		return "", false
+	}
+
+	if tmpl, ok := config.Languages[language]; ok && tmpl != "" {
+		return tmpl, true
+	}
+
+	return config.Template, config.Template != ""
+}
+
+func (pt *PromptTemplates) Render(action string, data *PromptData) (string, error) {
+	tmplText, err := pt.Get(action, data.Language)
+	if err != nil {
+		return "", err
+	}
+
+	return renderPrompt(action, tmplText, data)
+}
+
+func renderPrompt(action, tmplText string, data *PromptData) (string, error) {
+	tmpl, err := template.New(action).Parse(tmplText)
+	if err != nil {
+		return "", fmt.Errorf("Invalid prompt template for '%s': %w", action, err)
+	}
+
+	data.Action = action
+
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, data)
+	if err != nil {
+		return "", fmt.Errorf("Error rendering prompt template for '%s': %w", action, err)
+	}
+
+	return buf.String(), nil
+}
+
+// getLanguageName prefers the editor's language ID, since extensions are ambiguous
+func getLanguageName(filename uri.URI, languageID protocol.LanguageIdentifier) string {
+	if languageID != "" {
+		return string(languageID)
+	}
+
+	return strings.TrimPrefix(filepath.Ext(filename.Filename()), ".")
+}
+
+func formatDiagnostics(diagnostics []protocol.Diagnostic) string {
+	var lines []string
+	for _, diagnostic := range diagnostics {
+		line := fmt.Sprintf("line %d: %s", diagnostic.Range.Start.Line+1, diagnostic.Message)
+		if diagnostic.Source != "" {
+			line += " (" + diagnostic.Source + ")"
+		}
+		lines = append(lines, line)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// newSelectionPromptData fills in the prompt variables for a selection in an
+// open document, with the context formatted for model
+func newSelectionPromptData(args *LlmCompletionArgs, clientInfo *LanguageServerClientInfo, model string) (*PromptData, error) {
+	textDocument, ok := clientInfo.Docs.GetOpenDocument(args.Filename)
+	if !ok {
+		return nil, fmt.Errorf("No text document for supposedly open file %s", args.Filename)
+	}
+
+	filesContext, contextEntries, err := clientInfo.Config.BuildContextEntries(clientInfo, model)
+	if err != nil {
+		return nil, err
+	}
+
+	text := textDocument.Text
+	start := lsp.GetOffset(text, args.Selection.Start)
+	end := lsp.GetOffset(text, args.Selection.End)
+	if end < start {
+		end = start
+	}
+
+	definitions, err := selectionDefinitions(args, clientInfo, model, text, filesContext, contextEntries)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PromptData{
+		Filename:    args.Filename.Filename(),
+		Language:    getLanguageName(args.Filename, textDocument.LanguageID),
+		File:        text,
+		FilePrefix:  text[:start],
+		FileSuffix:  text[end:],
+		Selection:   text[start:end],
+		Context:     filesContext,
+		Definitions: definitions,
+		Diagnostics: formatDiagnostics(args.Diagnostics),
+		document:    textDocument,
+	}, nil
+}
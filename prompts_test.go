@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFindPromptTemplate(t *testing.T) {
+	prompts := SagePromptsConfig{
+		"rewrite": {
+			Template: "default",
+			Languages: map[string]string{
+				"go": "go",
+			},
+		},
+		"empty": {},
+	}
+
+	tests := []struct {
+		name     string
+		action   string
+		language string
+		expected string
+		found    bool
+	}{
+		{"Language override", "rewrite", "go", "go", true},
+		{"Action default", "rewrite", "python", "default", true},
+		{"Empty template", "empty", "go", "", false},
+		{"Unknown action", "describe", "go", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, found := findPromptTemplate(prompts, tt.action, tt.language)
+			if found != tt.found || result != tt.expected {
+				t.Errorf("Expected (%q, %v), but got (%q, %v)", tt.expected, tt.found, result, found)
+			}
+		})
+	}
+}
+
+func TestDefaultPromptsRender(t *testing.T) {
+	data := &PromptData{
+		Filename:    "main.go",
+		Language:    "go",
+		FilePrefix:  "package main\n",
+		Selection:   "// print hello",
+		Diagnostics: "line 1: undefined: foo",
+	}
+
+	for action, config := range defaultPrompts {
+		t.Run(action, func(t *testing.T) {
+			_, err := renderPrompt(action, config.Template, data)
+			if err != nil {
+				t.Errorf("Expected default %s prompt to render, but got %v", action, err)
+			}
+		})
+	}
+}
+
+func TestDefaultGlobalPromptsConfig(t *testing.T) {
+	config, err := defaultGlobalPromptsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything's commented out, so the built-ins are used until they're edited
+	prompts := SagePromptsConfig{}
+	err = loadPromptsConfig([]byte(config), &prompts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(prompts) != 0 {
+		t.Errorf("Expected no templates, but got %d", len(prompts))
+	}
+
+	// Uncommenting it, after the explanation, gives back the built-ins
+	var uncommented []string
+	for _, line := range strings.Split(config, "\n")[2:] {
+		uncommented = append(uncommented, strings.TrimPrefix(line, "# "))
+	}
+
+	err = loadPromptsConfig([]byte(strings.Join(uncommented, "\n")), &prompts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(prompts) != len(defaultPrompts) {
+		t.Fatalf("Expected %d templates, but got %d", len(defaultPrompts), len(prompts))
+	}
+
+	// yaml drops leading newlines from block scalars
+	for action, expected := range defaultPrompts {
+		got, ok := prompts[action]
+		if !ok || strings.TrimSpace(got.Template) != strings.TrimSpace(expected.Template) {
+			t.Errorf("Expected the uncommented config to have the built-in %s template", action)
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/everestmz/sage/lsp"
+	"go.lsp.dev/protocol"
+	"go.lsp.dev/uri"
+)
+
+// How many usages of a symbol we show the model when asking for names, and how
+// many of its suggestions we offer
+const (
+	maxNameUsages     = 30
+	maxSuggestedNames = 5
+)
+
+type SuggestNamesArgs struct {
+	Filename uri.URI
+	Position protocol.Position
+}
+
+// childRenameSupport returns whether the child can rename, and whether it
+// wants renames checked with prepareRename first
+func childRenameSupport(child *ChildLanguageServer) (supported, prepare bool) {
+	if child == nil || child.InitResult == nil {
+		return false, false
+	}
+
+	switch provider := child.InitResult.Capabilities.RenameProvider.(type) {
+	case nil:
+		return false, false
+	case bool:
+		return provider, false
+	default:
+		bs, err := json.Marshal(provider)
+		if err != nil {
+			return true, false
+		}
+
+		options := &protocol.RenameOptions{}
+		err = json.Unmarshal(bs, options)
+		return true, err == nil && options.PrepareProvider
+	}
+}
+
+func childSupportsReferences(child *ChildLanguageServer) bool {
+	if child == nil || child.InitResult == nil {
+		return false
+	}
+
+	provider := child.InitResult.Capabilities.ReferencesProvider
+	return provider != nil && provider != false
+}
+
+var identifierRegex = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*$`)
+
+// parseSuggestedNames pulls the names out of the model's response, which
+// doesn't always stick to one name per line
+func parseSuggestedNames(response, original string) []string {
+	seen := map[string]bool{original: true}
+
+	var names []string
+	for _, line := range strings.Split(stripCodeFences(response), "\n") {
+		name := strings.TrimSpace(line)
+		name = strings.TrimLeft(name, "-*0123456789.) ")
+		name = strings.Trim(name, "`'\" ")
+
+		if !identifierRegex.MatchString(name) || seen[name] {
+			continue
+		}
+
+		seen[name] = true
+		names = append(names, name)
+		if len(names) == maxSuggestedNames {
+			break
+		}
+	}
+
+	return names
+}
+
+// getUsages renders the lines where the symbol at position is used. If the
+// child can't find references, we make do with the current document.
+func getUsages(clientInfo *LanguageServerClientInfo, filename uri.URI, text string, position protocol.Position, identifier string) (string, error) {
+	var locations []protocol.Location
+	if childSupportsReferences(clientInfo.Child) {
+		var err error
+		locations, err = clientInfo.Child.References(context.TODO(), &protocol.ReferenceParams{
+			TextDocumentPositionParams: protocol.TextDocumentPositionParams{
+				TextDocument: protocol.TextDocumentIdentifier{URI: filename},
+				Position:     position,
+			},
+			Context: protocol.ReferenceContext{IncludeDeclaration: true},
+		})
+		if err != nil {
+			return "", err
+		}
+	} else {
+		identifierUsage := regexp.MustCompile(`\b` + regexp.QuoteMeta(identifier) + `\b`)
+		for i, line := range strings.Split(text, "\n") {
+			if identifierUsage.MatchString(line) {
+				locations = append(locations, protocol.Location{
+					URI:   filename,
+					Range: protocol.Range{Start: protocol.Position{Line: uint32(i)}},
+				})
+			}
+		}
+	}
+
+	files := map[uri.URI][]string{}
+	var usages []string
+	for _, location := range locations {
+		if len(usages) >= maxNameUsages {
+			break
+		}
+
+		lines, ok := files[location.URI]
+		if !ok {
+			fileText := text
+			if location.URI != filename {
+				if doc, open := clientInfo.Docs.GetOpenDocument(location.URI); open {
+					fileText = doc.Text
+				} else {
+					content, err := os.ReadFile(location.URI.Filename())
+					if err != nil {
+						continue
+					}
+					fileText = string(content)
+				}
+			}
+
+			lines = strings.Split(fileText, "\n")
+			files[location.URI] = lines
+		}
+
+		line := int(location.Range.Start.Line)
+		if line >= len(lines) {
+			continue
+		}
+
+		usages = append(usages, fmt.Sprintf("%s:%d: %s", location.URI.Filename(), line+1, strings.TrimSpace(lines[line])))
+	}
+
+	return strings.Join(usages, "\n"), nil
+}
+
+var lspCommandSuggestNames = &CommandDefinition{
+	Title:          "Suggest names",
+	ShowCodeAction: true,
+	Identifier:     "sage.suggest.names",
+	BuildArgs: func(params *protocol.CodeActionParams) ([]any, error) {
+		args := &SuggestNamesArgs{
+			Filename: params.TextDocument.URI,
+			Position: params.Range.Start,
+		}
+
+		return []any{args}, nil
+	},
+	CodeActionFilter: func(params *protocol.CodeActionParams, clientInfo *LanguageServerClientInfo) bool {
+		// The child does the actual renaming, so there's no point without it
+		if supported, _ := childRenameSupport(clientInfo.Child); !supported {
+			return false
+		}
+
+		doc, ok := clientInfo.Docs.GetOpenDocument(params.TextDocument.URI)
+		return ok && lsp.GetIdentifierAtPosition(doc.Text, params.Range.Start) != ""
+	},
+	Execute: func(params *protocol.ExecuteCommandParams, client LspClient, clientInfo *LanguageServerClientInfo) (*protocol.ApplyWorkspaceEditParams, error) {
+		lsLogger := globalLsLogger.With().Str("code_action", params.Command).Logger()
+		argBs, err := json.Marshal(params.Arguments[0])
+		if err != nil {
+			return nil, err
+		}
+
+		args := &SuggestNamesArgs{}
+		err = json.Unmarshal(argBs, args)
+		if err != nil {
+			return nil, err
+		}
+
+		doc, ok := clientInfo.Docs.GetOpenDocument(args.Filename)
+		if !ok {
+			return nil, fmt.Errorf("No text document for supposedly open file %s", args.Filename)
+		}
+
+		identifier := lsp.GetIdentifierAtPosition(doc.Text, args.Position)
+		if identifier == "" {
+			return nil, fmt.Errorf("There's nothing to rename here")
+		}
+
+		positionParams := protocol.TextDocumentPositionParams{
+			TextDocument: protocol.TextDocumentIdentifier{URI: args.Filename},
+			Position:     args.Position,
+		}
+
+		supported, prepare := childRenameSupport(clientInfo.Child)
+		if !supported {
+			return nil, fmt.Errorf("The language server can't rename symbols")
+		}
+
+		// No sense asking the model for names if the child won't rename it anyway
+		if prepare {
+			var prepared json.RawMessage
+			_, err = clientInfo.Child.Conn.Call(context.TODO(), protocol.MethodTextDocumentPrepareRename, &protocol.PrepareRenameParams{
+				TextDocumentPositionParams: positionParams,
+			}, &prepared)
+			if err != nil {
+				return nil, err
+			}
+			if len(prepared) == 0 || string(prepared) == "null" {
+				return nil, fmt.Errorf("'%s' can't be renamed", identifier)
+			}
+		}
+
+		usages, err := getUsages(clientInfo, args.Filename, doc.Text, args.Position, identifier)
+		if err != nil {
+			return nil, err
+		}
+
+		prompt, err := clientInfo.Config.Prompts.Render("names", &PromptData{
+			Filename:  args.Filename.Filename(),
+			Language:  getLanguageName(args.Filename, doc.LanguageID),
+			File:      doc.Text,
+			Selection: identifier,
+			Usages:    usages,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		models, err := clientInfo.Config.Models.Get()
+		if err != nil {
+			return nil, err
+		}
+
+		model := *models.Default
+
+		lsLogger.Info().Str("model", model).Str("prompt", prompt).Msg("Suggesting names")
+
+		client.Progress(context.TODO(), &protocol.ProgressParams{
+			Value: &protocol.WorkDoneProgressBegin{
+				Kind:    protocol.WorkDoneProgressKindBegin,
+				Title:   "Sage names",
+				Message: "suggesting names for " + identifier + "...",
+			},
+		})
+
+		response, err := clientInfo.LLM.GenerateCompletion(context.TODO(), model, prompt)
+		if err != nil {
+			return nil, err
+		}
+
+		client.Progress(context.TODO(), &protocol.ProgressParams{
+			Value: &protocol.WorkDoneProgressEnd{
+				Kind:    protocol.WorkDoneProgressKindEnd,
+				Message: "Done!",
+			},
+		})
+
+		names := parseSuggestedNames(response, identifier)
+		if len(names) == 0 {
+			return nil, fmt.Errorf("The model didn't suggest any names for '%s'", identifier)
+		}
+
+		var actions []protocol.MessageActionItem
+		for _, name := range names {
+			actions = append(actions, protocol.MessageActionItem{Title: name})
+		}
+
+		choice, err := client.ShowMessageRequest(context.TODO(), &protocol.ShowMessageRequestParams{
+			Type:    protocol.MessageTypeInfo,
+			Message: fmt.Sprintf("Rename '%s' to:", identifier),
+			Actions: actions,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if choice == nil {
+			// Dismissed
+			return nil, nil
+		}
+
+		// The child knows every place the symbol is used, so it does the renaming.
+		// Its edit is passed through as-is, since it can contain things like file
+		// renames that protocol.WorkspaceEdit can't hold.
+		var renameEdit json.RawMessage
+		_, err = clientInfo.Child.Conn.Call(context.TODO(), protocol.MethodTextDocumentRename, &protocol.RenameParams{
+			TextDocumentPositionParams: positionParams,
+			NewName:                    choice.Title,
+		}, &renameEdit)
+		if err != nil {
+			return nil, err
+		}
+		if len(renameEdit) == 0 || string(renameEdit) == "null" {
+			return nil, fmt.Errorf("Renaming '%s' to '%s' didn't change anything", identifier, choice.Title)
+		}
+
+		result := &protocol.ApplyWorkspaceEditResponse{}
+		_, err = client.Conn().Call(context.TODO(), protocol.MethodWorkspaceApplyEdit, map[string]any{
+			"label": fmt.Sprintf("sage: rename %s to %s", identifier, choice.Title),
+			"edit":  renameEdit,
+		}, result)
+		if err != nil {
+			return nil, err
+		}
+		if !result.Applied {
+			return nil, fmt.Errorf("Client refused to rename '%s': %s", identifier, result.FailureReason)
+		}
+
+		return nil, nil
+	},
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSuggestedNames(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		expected []string
+	}{
+		{
+			name:     "One per line",
+			response: "userCount\nnumUsers\n",
+			expected: []string{"userCount", "numUsers"},
+		},
+		{
+			name:     "Numbered and quoted",
+			response: "1. `userCount`\n2. \"numUsers\"\n- totalUsers",
+			expected: []string{"userCount", "numUsers", "totalUsers"},
+		},
+		{
+			name:     "Skips the original, duplicates and prose",
+			response: "Here are some names:\nn\nuserCount\nuserCount\n",
+			expected: []string{"userCount"},
+		},
+		{
+			name:     "Code fences",
+			response: "```\nuserCount\n```",
+			expected: []string{"userCount"},
+		},
+		{
+			name:     "At most five",
+			response: "a1\na2\na3\na4\na5\na6",
+			expected: []string{"a1", "a2", "a3", "a4", "a5"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := parseSuggestedNames(tt.response, "n")
+			if !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("Expected names %v, but got %v", tt.expected, result)
+			}
+		})
+	}
+}